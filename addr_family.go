@@ -0,0 +1,64 @@
+package dht
+
+import (
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// addrFamily is the IP version a query reaches peers over.
+type addrFamily int
+
+const (
+	anyAddrFamily addrFamily = iota
+	ipv4AddrFamily
+	ipv6AddrFamily
+)
+
+// WithIPv4Only makes the query dial peers over their IPv4 addresses only.
+// Peers without any IPv4 address are skipped, as if we knew no addresses for
+// them, and peers we're already connected to are queried over their existing
+// connection. The addresses are filtered before being handed to the host, but
+// the host may still dial the other addresses it knows of for a peer; use
+// WithDialFunc to restrict dials to the given addresses.
+func WithIPv4Only() QueryOption {
+	return func(q *dhtQuery) {
+		q.addrFamily = ipv4AddrFamily
+	}
+}
+
+// WithIPv6Only is the IPv6 counterpart of WithIPv4Only.
+func WithIPv6Only() QueryOption {
+	return func(q *dhtQuery) {
+		q.addrFamily = ipv6AddrFamily
+	}
+}
+
+// filterAddrs returns the addresses of addrs of the address family of the
+// query, all of them if it has none.
+func (q *dhtQuery) filterAddrs(addrs []ma.Multiaddr) []ma.Multiaddr {
+	if q.addrFamily == anyAddrFamily {
+		return addrs
+	}
+	var out []ma.Multiaddr
+	for _, a := range addrs {
+		if addrFamilyOf(a) == q.addrFamily {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// addrFamilyOf returns the IP version a is an address of, going by its first
+// component.
+func addrFamilyOf(a ma.Multiaddr) addrFamily {
+	protos := a.Protocols()
+	if len(protos) == 0 {
+		return anyAddrFamily
+	}
+	switch protos[0].Name {
+	case "ip4", "dns4":
+		return ipv4AddrFamily
+	case "ip6", "dns6":
+		return ipv6AddrFamily
+	}
+	return anyAddrFamily
+}
@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestQueryAddrFamily(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	v4 := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	v6 := ma.StringCast("/ip6/::1/tcp/1")
+	v4Only, v6Only, dual := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	d.peerstore.AddAddr(v4Only, v4, pstore.PermanentAddrTTL)
+	d.peerstore.AddAddr(v6Only, v6, pstore.PermanentAddrTTL)
+	d.peerstore.AddAddrs(dual, []ma.Multiaddr{v4, v6}, pstore.PermanentAddrTTL)
+
+	for _, tc := range []struct {
+		name   string
+		option QueryOption
+		addr   ma.Multiaddr
+		skip   peer.ID
+	}{
+		{"ipv4", WithIPv4Only(), v4, v6Only},
+		{"ipv6", WithIPv6Only(), v6, v4Only},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var (
+				mu     sync.Mutex
+				dialed = make(map[peer.ID][]ma.Multiaddr)
+			)
+			query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+				return &dhtQueryResult{}, nil
+			}, tc.option, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+				mu.Lock()
+				defer mu.Unlock()
+				dialed[pi.ID] = pi.Addrs
+				return nil
+			}))
+			res, err := query.Run(ctx, []peer.ID{v4Only, v6Only, dual})
+			if err != routing.ErrNotFound {
+				t.Fatalf("expected not found, got %v", err)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := dialed[tc.skip]; ok {
+				t.Errorf("expected %s to be skipped", tc.skip)
+			}
+			if len(dialed) != 2 {
+				t.Errorf("expected 2 peers to be dialed, got %v", dialed)
+			}
+			for p, addrs := range dialed {
+				if len(addrs) != 1 || !addrs[0].Equal(tc.addr) {
+					t.Errorf("expected %s to be dialed on %s only, got %v", p, tc.addr, addrs)
+				}
+			}
+			if errs := res.PeerErrors(); len(errs) != 0 {
+				t.Errorf("expected the skipped peer not to count as failed, got %v", errs)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// AuditOp is a step of a query recorded in an AuditLog.
+type AuditOp string
+
+const (
+	// AuditAdd records a peer being added to the query.
+	AuditAdd AuditOp = "add"
+	// AuditDial records an attempt to dial a peer we weren't connected to.
+	AuditDial AuditOp = "dial"
+	// AuditQuery records the query function being run against a peer.
+	AuditQuery AuditOp = "query"
+)
+
+// AuditEntry is a single step of a query.
+type AuditEntry struct {
+	Time        time.Time
+	Op          AuditOp
+	Peer        peer.ID
+	Err         string `json:",omitempty"`
+	CloserPeers int    `json:",omitempty"` // closer peers returned by a query step
+}
+
+// AuditLog records every step of a query so that it can be saved and
+// replayed after the fact, e.g. to find out why a lookup converged slowly.
+// The zero value is an empty log ready to use.
+type AuditLog struct {
+	mu      sync.Mutex
+	entries []AuditEntry
+}
+
+// NewAuditLog returns an empty AuditLog.
+func NewAuditLog() *AuditLog {
+	return new(AuditLog)
+}
+
+// record appends an entry to the log. It's a no-op on a nil log so the query
+// runner doesn't have to check whether auditing is enabled.
+func (l *AuditLog) record(op AuditOp, p peer.ID, err error, closerPeers int) {
+	if l == nil {
+		return
+	}
+	e := AuditEntry{
+		Time:        time.Now(),
+		Op:          op,
+		Peer:        p,
+		CloserPeers: closerPeers,
+	}
+	if err != nil {
+		e.Err = err.Error()
+	}
+
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	l.mu.Unlock()
+}
+
+// Entries returns a copy of the recorded entries, oldest first.
+func (l *AuditLog) Entries() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]AuditEntry(nil), l.entries...)
+}
+
+// MarshalJSON encodes the log as a JSON array of entries.
+func (l *AuditLog) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.Entries())
+}
+
+// UnmarshalJSON replaces the contents of the log with the encoded entries.
+func (l *AuditLog) UnmarshalJSON(b []byte) error {
+	var entries []AuditEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.entries = entries
+	l.mu.Unlock()
+	return nil
+}
+
+// WithAuditLog records the steps of the query in log.
+func WithAuditLog(log *AuditLog) QueryOption {
+	return func(q *dhtQuery) {
+		q.audit = log
+	}
+}
+
+type auditLogKey struct{}
+
+// ContextWithAuditLog returns a context that records the steps of the queries
+// run with it in log. Use it to audit the lookups behind the public routing
+// methods.
+func ContextWithAuditLog(ctx context.Context, log *AuditLog) context.Context {
+	return context.WithValue(ctx, auditLogKey{}, log)
+}
+
+func auditLogFromContext(ctx context.Context) *AuditLog {
+	log, _ := ctx.Value(auditLogKey{}).(*AuditLog)
+	return log
+}
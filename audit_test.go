@@ -0,0 +1,97 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+func TestAuditLog(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	// dhts[1] points at dhts[3], which we aren't connected to yet.
+	log := NewAuditLog()
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		switch p {
+		case dhts[1].self:
+			pi := dhts[3].peerstore.PeerInfo(dhts[3].self)
+			return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{&pi}}, nil
+		case dhts[2].self:
+			return nil, routing.ErrNotFound
+		}
+		return &dhtQueryResult{}, nil
+	}, WithAuditLog(log))
+	if _, err := query.Run(ctx, []peer.ID{dhts[1].self, dhts[2].self}); err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	steps := make(map[peer.ID][]AuditOp)
+	for _, e := range log.Entries() {
+		steps[e.Peer] = append(steps[e.Peer], e.Op)
+		switch {
+		case e.Op == AuditQuery && e.Peer == dhts[1].self && e.CloserPeers != 1:
+			t.Errorf("expected one closer peer from %s, got %d", e.Peer, e.CloserPeers)
+		case e.Op == AuditQuery && e.Peer == dhts[2].self && e.Err != routing.ErrNotFound.Error():
+			t.Errorf("expected the failure of %s to be recorded, got %q", e.Peer, e.Err)
+		}
+	}
+	expected := map[peer.ID][]AuditOp{
+		dhts[1].self: {AuditAdd, AuditQuery},
+		dhts[2].self: {AuditAdd, AuditQuery},
+		dhts[3].self: {AuditAdd, AuditDial, AuditQuery},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Fatalf("expected steps %v, got %v", expected, steps)
+	}
+
+	b, err := json.Marshal(log)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayed := NewAuditLog()
+	if err := json.Unmarshal(b, replayed); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := log.Entries(), replayed.Entries(); len(a) != len(b) || a[0].Peer != b[0].Peer || a[0].Op != b[0].Op {
+		t.Fatalf("expected the log to round trip, got %v", b)
+	}
+}
+
+func TestAuditLogContext(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	log := NewAuditLog()
+	if _, err := dhts[0].FindPeer(ContextWithAuditLog(ctx, log), "missing"); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+	if len(log.Entries()) == 0 {
+		t.Fatal("expected the lookup to be audited")
+	}
+}
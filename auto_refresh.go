@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	process "github.com/jbenet/goprocess"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// autoRefreshTimeout bounds the self lookups of the auto refresh.
+var autoRefreshTimeout = DefaultBootstrapConfig.Timeout
+
+// autoRefreshLoop checks the size of the routing table every interval, and
+// looks us up whenever it holds fewer than minPeers, so that queries don't
+// become ineffective as peers leave or fail, e.g. between the periods of
+// the bootstrap.
+func (dht *IpfsDHT) autoRefreshLoop(interval time.Duration, minPeers int) func(process.Process) {
+	return func(proc process.Process) {
+		// the lookups and events go through the context of the DHT, so that
+		// whoever registered for query events on it sees them, until the
+		// DHT is closed.
+		ctx, cancel := context.WithCancel(dht.ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-proc.Closing():
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+
+		tick := time.NewTicker(interval)
+		defer tick.Stop()
+		for {
+			select {
+			case <-tick.C:
+				dht.maybeAutoRefresh(ctx, minPeers)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// maybeAutoRefresh looks us up if the routing table holds fewer than
+// minPeers, and returns whether it did.
+func (dht *IpfsDHT) maybeAutoRefresh(ctx context.Context, minPeers int) bool {
+	size := dht.routingTable.Size()
+	if size >= minPeers {
+		return false
+	}
+	seeds := dht.LocalClosestPeers(string(dht.self), dht.alpha)
+	if len(seeds) == 0 {
+		// nobody left to ask, the bootstrap will have to do.
+		return false
+	}
+
+	logger.Infof("routing table down to %d peers, refreshing it", size)
+	notif.PublishQueryEvent(ctx, &notif.QueryEvent{
+		Type:  RoutingTableRefresh,
+		Extra: strconv.Itoa(size),
+	})
+	ctx, cancel := context.WithTimeout(ctx, autoRefreshTimeout)
+	defer cancel()
+	// bypass the query cache, we want to meet our neighbors again.
+	for range dht.getClosestPeers(ctx, string(dht.self), seeds) {
+	}
+	logger.Infof("refreshed the routing table, it's now %d peers", dht.routingTable.Size())
+	return true
+}
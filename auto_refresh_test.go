@@ -0,0 +1,80 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+func TestAutoRefresh(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+
+	evctx, events := notif.RegisterForQueryEvents(ctx)
+	refreshed := make(chan string, 10)
+	go func() {
+		for ev := range events {
+			if ev.Type == RoutingTableRefresh {
+				refreshed <- ev.Extra
+			}
+		}
+	}()
+	d, err := New(evctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.AutoRefresh(20*time.Millisecond, 3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+
+	// we know 3 peers, one of which knows the 2 others.
+	for _, o := range dhts[:3] {
+		connect(t, ctx, d, o)
+	}
+	connect(t, ctx, dhts[0], dhts[3])
+	connect(t, ctx, dhts[0], dhts[4])
+	// forget about the refreshes while we were connecting.
+	for len(refreshed) > 0 {
+		<-refreshed
+	}
+	select {
+	case size := <-refreshed:
+		t.Fatalf("didn't expect a refresh with a full enough routing table, got one at %s peers", size)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// two of them leave.
+	for _, o := range dhts[1:3] {
+		o.host.Close()
+	}
+	select {
+	case size := <-refreshed:
+		if size != "1" {
+			t.Errorf("expected a refresh once down to 1 peer, got one at %s peers", size)
+		}
+	case <-ctx.Done():
+		t.Fatal("expected the routing table to be refreshed")
+	}
+	for _, o := range dhts[3:] {
+		for d.routingTable.Find(o.self) == "" {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("expected the refresh to find %s, got %v", o.self, d.routingTable.ListPeers())
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// batchClusterBits is the length of the common prefix, in the XOR keyspace,
+// of the keys GetClosestPeersBatch looks up with a single traversal.
+const batchClusterBits = 8
+
+// GetClosestPeersBatch looks up the K closest peers to each of keys. Keys
+// that hash to the same region of the keyspace, i.e. that share a common
+// prefix there, are looked up together: a single traversal contacts the
+// peers of the region once, asking each about every key of the region, and
+// keeps the closest peers to each key apart. This saves the dials and rounds
+// of looking the keys up one by one, e.g. when providing many CIDs at once.
+// As the traversal starts from the seeds of every key of the region and
+// follows every answer, it meets all the peers the lookup of a single key
+// would.
+//
+// It returns the closest peers to each key, closest first.
+func (dht *IpfsDHT) GetClosestPeersBatch(ctx context.Context, keys []string) (map[string][]peer.ID, error) {
+	clusters := clusterKeys(keys)
+	seeds := make([][]peer.ID, len(clusters))
+	for i, cluster := range clusters {
+		seen := make(map[peer.ID]bool)
+		for _, k := range cluster {
+			for _, p := range dht.LocalClosestPeers(k, dht.alpha) {
+				if !seen[p] {
+					seen[p] = true
+					seeds[i] = append(seeds[i], p)
+				}
+			}
+		}
+		if len(seeds[i]) == 0 {
+			return nil, kb.ErrLookupFailure
+		}
+	}
+
+	var (
+		wg  sync.WaitGroup
+		mu  sync.Mutex
+		out = make(map[string][]peer.ID, len(keys))
+	)
+	for i, cluster := range clusters {
+		wg.Add(1)
+		go func(cluster []string, seeds []peer.ID) {
+			defer wg.Done()
+			closest := dht.clusterClosestPeers(ctx, cluster, seeds)
+			mu.Lock()
+			for k, peers := range closest {
+				out[k] = peers
+			}
+			mu.Unlock()
+		}(cluster, seeds[i])
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// clusterClosestPeers runs a single traversal for all the keys of cluster
+// and returns the closest peers that answered about each key.
+func (dht *IpfsDHT) clusterClosestPeers(ctx context.Context, cluster []string, seeds []peer.ID) map[string][]peer.ID {
+	target := cluster[0]
+	e := logger.EventBegin(ctx, "getClosestPeersBatch", loggableKey(target))
+	defer e.Done()
+
+	var (
+		mu       sync.Mutex
+		answered = make(map[string][]peer.ID, len(cluster))
+	)
+	query := dht.newQuery(target, dht.batchCloserPeersFunc(ctx, cluster, func(k string, p peer.ID) {
+		mu.Lock()
+		answered[k] = append(answered[k], p)
+		mu.Unlock()
+	}))
+	if _, err := query.Run(ctx, seeds); err != nil {
+		logger.Debugf("closestPeers batch query run error: %s", err)
+	}
+	dht.bucketRefreshed(target)
+
+	mu.Lock()
+	defer mu.Unlock()
+	out := make(map[string][]peer.ID, len(cluster))
+	for _, k := range cluster {
+		if len(answered[k]) == 0 {
+			continue
+		}
+		sorted := kb.SortClosestPeers(answered[k], kb.ConvertKey(k))
+		if len(sorted) > query.kValue {
+			sorted = sorted[:query.kValue]
+		}
+		out[k] = sorted
+	}
+	return out
+}
+
+// batchCloserPeersFunc returns a query function that asks peers for the
+// peers closer to each of keys that they know of, and calls answered for
+// every key a peer answered about. A peer that fails to answer about a key
+// isn't asked about the following ones.
+func (dht *IpfsDHT) batchCloserPeersFunc(ctx context.Context, keys []string, answered func(key string, p peer.ID)) queryFunc {
+	parent := ctx
+	return func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		notif.PublishQueryEvent(parent, &notif.QueryEvent{
+			Type: notif.SendingQuery,
+			ID:   p,
+		})
+
+		var peers []*pstore.PeerInfo
+		seen := make(map[peer.ID]bool)
+		for _, k := range keys {
+			pmes, err := dht.findPeerSingle(ctx, p, peer.ID(k))
+			if err != nil {
+				logger.Debugf("error getting closer peers: %s", err)
+				return nil, err
+			}
+			answered(k, p)
+			for _, pi := range pb.PBPeersToPeerInfos(pmes.GetCloserPeers()) {
+				if !seen[pi.ID] {
+					seen[pi.ID] = true
+					peers = append(peers, pi)
+				}
+			}
+		}
+
+		notif.PublishQueryEvent(parent, &notif.QueryEvent{
+			Type:      notif.PeerResponse,
+			ID:        p,
+			Responses: peers,
+		})
+
+		return &dhtQueryResult{closerPeers: peers}, nil
+	}
+}
+
+// clusterKeys groups keys by the first batchClusterBits bits of their
+// position in the XOR keyspace, dropping duplicates. The clusters and the
+// keys in them keep the order of keys.
+func clusterKeys(keys []string) [][]string {
+	var clusters [][]string
+	index := make(map[byte]int)
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		prefix := kb.ConvertKey(k)[0] >> (8 - batchClusterBits)
+		i, ok := index[prefix]
+		if !ok {
+			i = len(clusters)
+			index[prefix] = i
+			clusters = append(clusters, nil)
+		}
+		clusters[i] = append(clusters[i], k)
+	}
+	return clusters
+}
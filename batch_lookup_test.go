@@ -0,0 +1,127 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestGetClosestPeersBatch(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	const n = 16
+	dhts := setupDHTS(t, ctx, n)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// a ring, so the lookups take several rounds.
+	for i := range dhts {
+		connect(t, ctx, dhts[i], dhts[(i+1)%n])
+	}
+	d := dhts[0]
+	var rpcs int64
+	d.tracer = queriedTracer{onQueried: func(peer.ID) { atomic.AddInt64(&rpcs, 1) }}
+
+	// 100 keys sharing a 10 bit prefix in the keyspace.
+	var keys []string
+	for i := 0; len(keys) < 100; i++ {
+		k := fmt.Sprintf("/batch/%d", i)
+		if id := kb.ConvertKey(k); id[0] == 0x2a && id[1]>>6 == 0x1 {
+			keys = append(keys, k)
+		}
+	}
+	if c := clusterKeys(append(keys, keys[0])); len(c) != 1 || len(c[0]) != len(keys) {
+		t.Fatalf("expected the keys to make up a single cluster, got %d", len(c))
+	}
+
+	alone := make(map[string][]peer.ID, len(keys))
+	for _, k := range keys {
+		alone[k] = closestPeers(t, ctx, d, k)
+	}
+	sequential := atomic.SwapInt64(&rpcs, 0)
+
+	res, err := d.GetClosestPeersBatch(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batched := atomic.LoadInt64(&rpcs)
+
+	// every peer is contacted once, instead of once per key.
+	if batched*10 > sequential {
+		t.Errorf("expected an order of magnitude fewer peer queries, got %d batched vs %d sequential", batched, sequential)
+	}
+	checkBatchResults(t, res, alone)
+}
+
+func TestGetClosestPeersBatchLargeNetwork(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	// a network large enough for the keys of a cluster to have different
+	// closest peers.
+	d := NewMockDHT(3, 2000)
+	defer d.Close()
+	defer d.host.Close()
+
+	var keys []string
+	for i := 0; len(keys) < 20; i++ {
+		k := fmt.Sprintf("/batch/%d", i)
+		if kb.ConvertKey(k)[0] == 0x2a {
+			keys = append(keys, k)
+		}
+	}
+	alone := make(map[string][]peer.ID, len(keys))
+	distinct := make(map[peer.ID]bool)
+	for _, k := range keys {
+		alone[k] = closestPeers(t, ctx, d, k)
+		for _, p := range alone[k] {
+			distinct[p] = true
+		}
+	}
+	if len(distinct) <= d.bucketSize {
+		t.Fatal("expected the keys to have different closest peers")
+	}
+
+	res, err := d.GetClosestPeersBatch(ctx, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBatchResults(t, res, alone)
+}
+
+// closestPeers looks up the closest peers to k with GetClosestPeers.
+func closestPeers(t *testing.T, ctx context.Context, d *IpfsDHT, k string) []peer.ID {
+	ch, err := d.GetClosestPeers(ctx, k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var peers []peer.ID
+	for p := range ch {
+		peers = append(peers, p)
+	}
+	return peers
+}
+
+// checkBatchResults checks that the batched lookups found the same peers as
+// the lookups of each key alone.
+func checkBatchResults(t *testing.T, res, alone map[string][]peer.ID) {
+	t.Helper()
+	if len(res) != len(alone) {
+		t.Fatalf("expected results for %d keys, got %d", len(alone), len(res))
+	}
+	for k, expected := range alone {
+		if !reflect.DeepEqual(res[k], expected) {
+			t.Errorf("expected the closest peers to %s to be %v, got %v", k, expected, res[k])
+		}
+	}
+}
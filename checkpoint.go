@@ -0,0 +1,126 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// QueryCheckpoint is the state of an interrupted lookup, from which it can be
+// resumed with ResumeQuery instead of starting over from the routing table.
+type QueryCheckpoint struct {
+	// Key is the key the lookup was for.
+	Key string
+	// Queried holds the peers that answered the lookup. They aren't queried
+	// again on resume.
+	Queried []peer.ID
+	// Failed holds the peers that couldn't be dialed or queried. As failures
+	// are often caused by the interruption itself, they're retried on resume.
+	Failed []peer.ID
+	// Frontier holds the peers the lookup knew about but hadn't queried yet,
+	// closest to the key first.
+	Frontier []peer.ID
+}
+
+type checkpointKey struct{}
+
+// ContextWithCheckpoint returns a context that makes GetClosestPeers and
+// ResumeQuery save the state of their lookup in cp when they finish, whether
+// or not they were interrupted. cp is complete once the channel returned by
+// the lookup is closed, and must not be read before.
+func ContextWithCheckpoint(ctx context.Context, cp *QueryCheckpoint) context.Context {
+	return context.WithValue(ctx, checkpointKey{}, cp)
+}
+
+func checkpointFromContext(ctx context.Context) *QueryCheckpoint {
+	cp, _ := ctx.Value(checkpointKey{}).(*QueryCheckpoint)
+	return cp
+}
+
+// checkpoint saves the state of the query in cp. The caller must hold the
+// lock, and the query must be done.
+func (r *dhtQueryRunner) checkpoint(cp *QueryCheckpoint) {
+	cp.Key = r.query.key
+	cp.Queried = cp.Queried[:0]
+	cp.Failed = cp.Failed[:0]
+	cp.Frontier = cp.Frontier[:0]
+
+	for p := range r.failed {
+		cp.Failed = append(cp.Failed, p)
+	}
+	for _, p := range r.peersSeen.Peers() {
+		switch {
+		case r.failed[p] != nil:
+		case r.peersQueried.Contains(p):
+			cp.Queried = append(cp.Queried, p)
+		default:
+			cp.Frontier = append(cp.Frontier, p)
+		}
+	}
+	cp.Frontier = kb.SortClosestPeers(cp.Frontier, r.query.convertedKey)
+}
+
+// resume makes the query pick up where the checkpointed one left off: the
+// peers it already queried count as seen and queried.
+func (r *dhtQueryRunner) resume(cp *QueryCheckpoint) {
+	for _, p := range cp.Queried {
+		r.peersSeen.Add(p)
+		r.peersQueried.Add(p)
+	}
+}
+
+// Marshal encodes the checkpoint into a compact binary blob: the peer lists
+// are compressed relative to the key, see CompressPeerList.
+func (cp *QueryCheckpoint) Marshal() []byte {
+	buf := appendUvarint(nil, uint64(len(cp.Key)))
+	buf = append(buf, cp.Key...)
+	for _, peers := range [][]peer.ID{cp.Queried, cp.Failed, cp.Frontier} {
+		list := CompressPeerList(cp.Key, peers)
+		buf = appendUvarint(buf, uint64(len(list)))
+		buf = append(buf, list...)
+	}
+	return buf
+}
+
+// UnmarshalQueryCheckpoint decodes a checkpoint encoded with Marshal.
+func UnmarshalQueryCheckpoint(data []byte) (*QueryCheckpoint, error) {
+	readBytes := func() ([]byte, error) {
+		n, rest, err := readUvarint(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > uint64(len(rest)) {
+			return nil, fmt.Errorf("invalid checkpoint: truncated")
+		}
+		data = rest[n:]
+		return rest[:n], nil
+	}
+
+	key, err := readBytes()
+	if err != nil {
+		return nil, err
+	}
+	cp := &QueryCheckpoint{Key: string(key)}
+	for _, peers := range []*[]peer.ID{&cp.Queried, &cp.Failed, &cp.Frontier} {
+		list, err := readBytes()
+		if err != nil {
+			return nil, err
+		}
+		if *peers, err = DecompressPeerList(cp.Key, list); err != nil {
+			return nil, err
+		}
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("invalid checkpoint: %d trailing bytes", len(data))
+	}
+	return cp, nil
+}
+
+// resumeFrom makes the query pick up where the one saved in cp left off.
+func resumeFrom(cp *QueryCheckpoint) QueryOption {
+	return func(q *dhtQuery) {
+		q.resume = cp
+	}
+}
@@ -0,0 +1,116 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// queriedTracer reports every peer that answered a query.
+type queriedTracer struct {
+	NoopTracer
+	onQueried func(peer.ID)
+}
+
+func (t queriedTracer) PeerQueried(_ string, p peer.ID) { t.onQueried(p) }
+
+func TestCheckpointResume(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const n = 12
+	dhts := setupDHTS(t, ctx, n)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// a ring, so the lookup takes several rounds.
+	for i := range dhts {
+		connect(t, ctx, dhts[i], dhts[(i+1)%n])
+	}
+	d := dhts[0]
+
+	collect := func(peers <-chan peer.ID) []peer.ID {
+		var out []peer.ID
+		for p := range peers {
+			out = append(out, p)
+		}
+		return out
+	}
+	var (
+		mu        sync.Mutex
+		queried   []peer.ID
+		interrupt func() // called once a few peers answered, if set
+	)
+	d.tracer = queriedTracer{onQueried: func(p peer.ID) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried = append(queried, p)
+		if len(queried) == 3 && interrupt != nil {
+			interrupt()
+		}
+	}}
+
+	// interrupt a lookup halfway.
+	var cp QueryCheckpoint
+	ctx1, cancel1 := context.WithCancel(ctx)
+	defer cancel1()
+	mu.Lock()
+	interrupt = cancel1
+	mu.Unlock()
+	peers, err := d.GetClosestPeers(ContextWithCheckpoint(ctx1, &cp), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	collect(peers)
+	if len(cp.Queried) == 0 || len(cp.Frontier)+len(cp.Failed) == 0 {
+		t.Fatalf("expected the lookup to be interrupted halfway, got %+v", cp)
+	}
+
+	resumed, err := UnmarshalQueryCheckpoint(cp.Marshal())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resumed.Marshal(), cp.Marshal()) || len(resumed.Queried) != len(cp.Queried) {
+		t.Fatalf("expected the checkpoint to round trip, got %+v", resumed)
+	}
+
+	// resume it, without asking the same peers again.
+	mu.Lock()
+	queried, interrupt = nil, nil
+	mu.Unlock()
+	peers, err = d.ResumeQuery(ctx, "foo", resumed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := collect(peers)
+	mu.Lock()
+	for _, p := range queried {
+		for _, q := range cp.Queried {
+			if p == q {
+				t.Errorf("%s was queried again", p)
+			}
+		}
+	}
+	mu.Unlock()
+
+	// and get the same answer as a lookup that wasn't interrupted.
+	peers, err = d.GetClosestPeers(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := collect(peers); !reflect.DeepEqual(result, expected) {
+		t.Fatalf("expected the resumed lookup to find %v, got %v", expected, result)
+	}
+
+	if _, err := d.ResumeQuery(ctx, "bar", resumed); err == nil {
+		t.Fatal("expected a checkpoint for another key to be rejected")
+	}
+}
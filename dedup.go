@@ -0,0 +1,76 @@
+package dht
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+var (
+	// DefaultDedupTTL is how long a QueryDeduplicator remembers a query by
+	// default.
+	DefaultDedupTTL = 5 * time.Second
+	// DefaultDedupSize is how many queries a QueryDeduplicator remembers at
+	// most by default.
+	DefaultDedupSize = 1000
+)
+
+// QueryDeduplicator rejects the queries that are the same as one started
+// shortly before, e.g. by an application that issues the same lookup in a
+// loop. Queries are the same when they look for the same key, start from the
+// same peers and run the same query function.
+type QueryDeduplicator struct {
+	ttl   time.Duration
+	cache *lru.Cache // query fingerprint -> when it was last started
+}
+
+// NewQueryDeduplicator returns a QueryDeduplicator that remembers up to size
+// queries for ttl each.
+func NewQueryDeduplicator(ttl time.Duration, size int) (*QueryDeduplicator, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("dedup ttl must be positive; actual value: %s", ttl)
+	}
+	cache, err := lru.New(size)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryDeduplicator{ttl: ttl, cache: cache}, nil
+}
+
+// duplicate returns whether the query is the same as one started less than
+// the TTL ago, and remembers it otherwise.
+func (d *QueryDeduplicator) duplicate(key string, seeds []peer.ID, f queryFunc) bool {
+	if d == nil {
+		return false
+	}
+	fp := queryFingerprint(key, seeds, f)
+	now := time.Now()
+	if t, ok := d.cache.Get(fp); ok && now.Sub(t.(time.Time)) < d.ttl {
+		return true
+	}
+	d.cache.Add(fp, now)
+	return false
+}
+
+// queryFingerprint hashes the key, the seed peers in any order and the name
+// of the query function of a query.
+func queryFingerprint(key string, seeds []peer.ID, f queryFunc) string {
+	sorted := append([]peer.ID(nil), seeds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%d:%s", len(key), key)
+	for _, p := range sorted {
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	if f != nil {
+		h.Write([]byte(runtime.FuncForPC(reflect.ValueOf(f).Pointer()).Name()))
+	}
+	return string(h.Sum(nil))
+}
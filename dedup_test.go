@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+func TestQueryDeduplicator(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	dd, err := NewQueryDeduplicator(200*time.Millisecond, DefaultDedupSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dhts[0].dedup = dd
+
+	qfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, nil
+	}
+	otherQfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, nil
+	}
+	run := func(key string, f queryFunc, seeds ...peer.ID) error {
+		_, err := dhts[0].newQuery(key, f).Run(ctx, seeds)
+		return err
+	}
+	a, b := dhts[1].self, dhts[2].self
+
+	if err := run("foo", qfunc, a, b); err != routing.ErrNotFound {
+		t.Fatalf("expected the first query to run, got %v", err)
+	}
+	// the order of the seeds doesn't matter.
+	if err := run("foo", qfunc, b, a); err != ErrDuplicateQuery {
+		t.Fatalf("expected a duplicate query, got %v", err)
+	}
+	if err := run("bar", qfunc, a, b); err != routing.ErrNotFound {
+		t.Fatalf("expected a query for another key to run, got %v", err)
+	}
+	if err := run("foo", qfunc, a); err != routing.ErrNotFound {
+		t.Fatalf("expected a query from other peers to run, got %v", err)
+	}
+	if err := run("foo", otherQfunc, a, b); err != routing.ErrNotFound {
+		t.Fatalf("expected another kind of query to run, got %v", err)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if err := run("foo", qfunc, a, b); err != routing.ErrNotFound {
+		t.Fatalf("expected the query to run again once forgotten, got %v", err)
+	}
+}
+
+func TestQueryDeduplicatorConfig(t *testing.T) {
+	if _, err := NewQueryDeduplicator(0, DefaultDedupSize); err == nil {
+		t.Error("expected a zero ttl to be rejected")
+	}
+	if _, err := NewQueryDeduplicator(DefaultDedupTTL, 0); err == nil {
+		t.Error("expected a zero size to be rejected")
+	}
+}
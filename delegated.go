@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"strings"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// DelegatedRouter is an external content routing system the DHT can hand
+// provider lookups off to.
+type DelegatedRouter interface {
+	FindProviders(ctx context.Context, key string) ([]pstore.PeerInfo, error)
+}
+
+// RegisterDelegatedRouter registers router for all lookups whose key starts
+// with prefix. Lookups for matching keys are sent to the delegated router
+// instead of walking the DHT; the results are merged with any providers we
+// know about locally.
+//
+// If more than one registered prefix matches a key, the longest one wins.
+// Registering a nil router removes the delegation for prefix.
+func (dht *IpfsDHT) RegisterDelegatedRouter(prefix string, router DelegatedRouter) {
+	dht.drlk.Lock()
+	defer dht.drlk.Unlock()
+	if router == nil {
+		delete(dht.delegates, prefix)
+		return
+	}
+	dht.delegates[prefix] = router
+}
+
+// delegatedRouterFor returns the delegated router registered for key, if any.
+func (dht *IpfsDHT) delegatedRouterFor(key string) (DelegatedRouter, bool) {
+	dht.drlk.RLock()
+	defer dht.drlk.RUnlock()
+
+	var (
+		best   DelegatedRouter
+		bestLn = -1
+	)
+	for prefix, router := range dht.delegates {
+		if len(prefix) > bestLn && strings.HasPrefix(key, prefix) {
+			best, bestLn = router, len(prefix)
+		}
+	}
+	return best, best != nil
+}
@@ -0,0 +1,57 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+type staticDelegate struct {
+	called int
+	peers  []pstore.PeerInfo
+}
+
+func (s *staticDelegate) FindProviders(_ context.Context, _ string) ([]pstore.PeerInfo, error) {
+	s.called++
+	return s.peers, nil
+}
+
+func TestDelegatedRouter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	c := testCaseCids[0]
+	local := peer.ID("local provider")
+	d.providers.AddProvider(ctx, c, local)
+
+	remote := peer.ID("delegated provider")
+	delegate := &staticDelegate{peers: []pstore.PeerInfo{{ID: remote}, {ID: local}}}
+	d.RegisterDelegatedRouter(c.KeyString()[:2], delegate)
+
+	found := make(map[peer.ID]int)
+	for pi := range d.FindProvidersAsync(ctx, c, 10) {
+		found[pi.ID]++
+	}
+
+	if delegate.called != 1 {
+		t.Fatalf("expected the delegated router to be called once, got %d", delegate.called)
+	}
+	if len(found) != 2 || found[local] != 1 || found[remote] != 1 {
+		t.Fatalf("expected local and delegated providers exactly once each, got %v", found)
+	}
+
+	// Unregistering falls back to the normal lookup.
+	d.RegisterDelegatedRouter(c.KeyString()[:2], nil)
+	for range d.FindProvidersAsync(ctx, c, 10) {
+	}
+	if delegate.called != 1 {
+		t.Fatal("delegated router was used after being unregistered")
+	}
+}
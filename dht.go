@@ -63,7 +63,73 @@ type IpfsDHT struct {
 
 	plk sync.Mutex
 
+	delegates map[string]DelegatedRouter // delegated routers by key prefix
+	drlk      sync.RWMutex
+
+	tracer QueryTracer // notified of query progress
+
 	protocols []protocol.ID // DHT protocols
+
+	bucketSize      int // K: the bucket size and the number of closest peers to look for
+	closerPeerCount int // the number of closer peers to send on requests
+	alpha           int // the concurrency of queries
+
+	perPeerTimeout time.Duration // deadline for individual query RPCs
+	minPeerTimeout time.Duration // bounds of the deadlines derived from peer latencies,
+	maxPeerTimeout time.Duration // if maxPeerTimeout is non-zero
+	speculative    float64       // default speculative factor of queries
+
+	slo *SLOEnforcer // adjusts alpha to meet a latency SLO, if set
+
+	reputation *PeerReputationCache // query RPC track record per peer, if set
+
+	dialHistory *DialHistory // dial track record per peer, if set
+
+	idleGC *idleGC // collects garbage between bursts of queries, if set
+
+	peerFilter PeerFilter      // default filter for the peers queries may contact
+	tombstones *TombstoneStore // peers queries never contact, if set
+
+	webrtc WebRTCSignalingDialer // signals dials to WebRTC-only peers, if set
+
+	queueFactory QueueFactory // orders the peers queries dial, overriding the below, if set
+
+	dedup      *QueryDeduplicator // rejects queries repeated in quick succession, if set
+	queryCache *QueryCache        // closest peers found by recent lookups, if set
+
+	keyTransform KeyTransform // maps record keys to the keys they're stored under, if set
+
+	geo            *geoAwareness // biases queries toward nearby peers, if set
+	connectedBonus int           // head start of connected peers in queries, in bits of distance
+
+	refreshed map[int]time.Time // when lookups last covered each bucket, by common prefix length
+	rflk      sync.Mutex
+
+	verifiedAddrTTL time.Duration // how long to keep the addresses of peers that answered a query
+
+	segmentConcurrency int // segments SegmentedLookup looks up at a time
+
+	proxy peer.ID // runs our lookups on our behalf, if set
+
+	peerRPCs *peerRPCLimiter // bounds the RPCs in flight to every peer, if set
+
+	globalQuerySemaphore chan struct{} // bounds the peers queried at a time by all queries, if set
+
+	dialBackoff *dialBackoff  // the peers that failed to dial recently, if set
+	dialTimeout time.Duration // bounds every dial of our queries, if non-zero
+
+	sim *mockNetwork // answers our RPCs instead of the network, if set
+
+	dialQueueConfig dqConfig          // configuration of the dial queues of queries
+	dialMetrics     *dialQueueMetrics // metrics of the dial queues of queries
+
+	maxPeerFailures int             // evict peers after this many failures in a row, if non-zero
+	peerFailures    map[peer.ID]int // consecutive failures of routing table peers
+	pflk            sync.Mutex
+
+	closing chan struct{}  // closed once Shutdown starts, no query may start after
+	runners sync.WaitGroup // the queries in flight
+	rnlk    sync.Mutex     // orders starting queries with closing
 }
 
 // Assert that IPFS assumptions about interfaces aren't broken. These aren't a
@@ -82,7 +148,67 @@ func New(ctx context.Context, h host.Host, options ...opts.Option) (*IpfsDHT, er
 	if err := cfg.Apply(append([]opts.Option{opts.Defaults}, options...)...); err != nil {
 		return nil, err
 	}
-	dht := makeDHT(ctx, h, cfg.Datastore, cfg.Protocols)
+	// answer requests with as many closer peers as our own K, unless the
+	// package default K is in use.
+	closerPeers := cfg.KValue
+	if cfg.KValue == 0 {
+		cfg.KValue = KValue
+		closerPeers = CloserPeerCount
+	}
+	if cfg.AlphaValue == 0 {
+		cfg.AlphaValue = AlphaValue
+	}
+	if cfg.VerifiedAddrTTL == 0 {
+		cfg.VerifiedAddrTTL = DefaultVerifiedAddrTTL
+	}
+	if cfg.SegmentConcurrency == 0 {
+		cfg.SegmentConcurrency = DefaultSegmentConcurrency
+	}
+	if cfg.MaxRPCsPerPeer == 0 {
+		cfg.MaxRPCsPerPeer = DefaultMaxRPCsPerPeer
+	}
+	if cfg.MaxConcurrentQueries == 0 {
+		cfg.MaxConcurrentQueries = 10 * cfg.AlphaValue
+	}
+	if cfg.DialTimeout == 0 {
+		cfg.DialTimeout = DefaultDialTimeout
+	}
+	if cfg.AutoRefreshInterval == 0 {
+		cfg.AutoRefreshInterval = DefaultAutoRefreshInterval
+	}
+	if cfg.AutoRefreshMinPeers == 0 {
+		cfg.AutoRefreshMinPeers = cfg.KValue / 2
+	}
+	var backoff *dialBackoff
+	if cfg.DialBackoffBase != 0 {
+		var err error
+		backoff, err = newDialBackoff(cfg.DialBackoffBase, cfg.DialBackoffMax, cfg.DialBackoffSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	dht := makeDHT(ctx, h, &cfg)
+	dht.closerPeerCount = closerPeers
+	dht.segmentConcurrency = cfg.SegmentConcurrency
+	dht.proxy = cfg.Proxy
+	dht.peerRPCs = newPeerRPCLimiter(cfg.MaxRPCsPerPeer)
+	dht.globalQuerySemaphore = make(chan struct{}, cfg.MaxConcurrentQueries)
+	dht.dialBackoff = backoff
+	dht.dialTimeout = cfg.DialTimeout
+	dht.dialQueueConfig = dqDefaultConfig()
+	dht.dialMetrics = newDialQueueMetrics()
+	if cfg.DialQueueMinParallelism != 0 {
+		dht.dialQueueConfig.minParallelism = uint(cfg.DialQueueMinParallelism)
+		dht.dialQueueConfig.maxParallelism = uint(cfg.DialQueueMaxParallelism)
+		dht.dialQueueConfig.maxIdle = cfg.DialQueueMaxIdle
+		dht.dialQueueConfig.mutePeriod = cfg.DialQueueMutePeriod
+	}
+	if cfg.DialQueueSuccessWindow != 0 {
+		dht.dialQueueConfig.successWindow = cfg.DialQueueSuccessWindow
+		dht.dialQueueConfig.lowSuccessRate = cfg.DialQueueLowSuccessRate
+		dht.dialQueueConfig.highSuccessRate = cfg.DialQueueHighSuccessRate
+	}
+	dht.applyOtherOptions(&cfg)
 
 	// register for network notifs.
 	dht.host.Network().Notify((*netNotifiee)(dht))
@@ -94,6 +220,14 @@ func New(ctx context.Context, h host.Host, options ...opts.Option) (*IpfsDHT, er
 	})
 
 	dht.proc.AddChild(dht.providers.Process())
+	if dht.reputation != nil {
+		dht.proc.Go(dht.reputation.flushLoop)
+	}
+	if cfg.IdleGCThreshold > 0 {
+		dht.idleGC = newIdleGC(cfg.IdleGCThreshold)
+		dht.proc.Go(dht.idleGC.loop)
+	}
+	dht.proc.Go(dht.autoRefreshLoop(cfg.AutoRefreshInterval, cfg.AutoRefreshMinPeers))
 	dht.Validator = cfg.Validator
 
 	if !cfg.Client {
@@ -101,6 +235,9 @@ func New(ctx context.Context, h host.Host, options ...opts.Option) (*IpfsDHT, er
 			h.SetStreamHandler(p, dht.handleNewStream)
 		}
 	}
+	if cfg.ServeProxy {
+		h.SetStreamHandler(ProtocolDHTProxy, dht.handleProxyStream)
+	}
 	return dht, nil
 }
 
@@ -127,8 +264,8 @@ func NewDHTClient(ctx context.Context, h host.Host, dstore ds.Batching) *IpfsDHT
 	return dht
 }
 
-func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []protocol.ID) *IpfsDHT {
-	rt := kb.NewRoutingTable(KValue, kb.ConvertPeerID(h.ID()), time.Minute, h.Peerstore())
+func makeDHT(ctx context.Context, h host.Host, cfg *opts.Options) *IpfsDHT {
+	rt := kb.NewRoutingTable(cfg.KValue, kb.ConvertPeerID(h.ID()), time.Minute, h.Peerstore())
 
 	cmgr := h.ConnManager()
 	rt.PeerAdded = func(p peer.ID) {
@@ -139,23 +276,46 @@ func makeDHT(ctx context.Context, h host.Host, dstore ds.Batching, protocols []p
 	}
 
 	return &IpfsDHT{
-		datastore:    dstore,
-		self:         h.ID(),
-		peerstore:    h.Peerstore(),
-		host:         h,
-		strmap:       make(map[peer.ID]*messageSender),
-		ctx:          ctx,
-		providers:    providers.NewProviderManager(ctx, h.ID(), dstore),
-		birth:        time.Now(),
-		routingTable: rt,
-		protocols:    protocols,
+		datastore:       cfg.Datastore,
+		self:            h.ID(),
+		peerstore:       h.Peerstore(),
+		host:            h,
+		strmap:          make(map[peer.ID]*messageSender),
+		ctx:             ctx,
+		providers:       providers.NewProviderManager(ctx, h.ID(), cfg.Datastore),
+		birth:           time.Now(),
+		routingTable:    rt,
+		protocols:       cfg.Protocols,
+		bucketSize:      cfg.KValue,
+		closerPeerCount: cfg.KValue,
+		alpha:           cfg.AlphaValue,
+		perPeerTimeout:  cfg.PerPeerTimeout,
+		minPeerTimeout:  cfg.MinPeerTimeout,
+		maxPeerTimeout:  cfg.MaxPeerTimeout,
+		maxPeerFailures: cfg.MaxPeerFailures,
+		speculative:     cfg.SpeculativeFactor,
+		connectedBonus:  cfg.ConnectednessBonus,
+		verifiedAddrTTL: cfg.VerifiedAddrTTL,
+		peerFailures:    make(map[peer.ID]int),
+		refreshed:       make(map[int]time.Time),
+		delegates:       make(map[string]DelegatedRouter),
+		tracer:          NoopTracer{},
+		closing:         make(chan struct{}),
+	}
+}
+
+// queryConcurrency returns the concurrency new queries should use.
+func (dht *IpfsDHT) queryConcurrency() int {
+	if dht.slo != nil {
+		return dht.slo.Alpha()
 	}
+	return dht.alpha
 }
 
 // putValueToPeer stores the given key/value pair at the peer 'p'
 func (dht *IpfsDHT) putValueToPeer(ctx context.Context, p peer.ID, rec *recpb.Record) error {
 
-	pmes := pb.NewMessage(pb.Message_PUT_VALUE, rec.Key, 0)
+	pmes := pb.NewMessage(pb.Message_PUT_VALUE, []byte(dht.transformKey(string(rec.Key))), 0)
 	pmes.Record = rec
 	rpmes, err := dht.sendRequest(ctx, p, pmes)
 	if err != nil {
@@ -174,7 +334,8 @@ func (dht *IpfsDHT) putValueToPeer(ctx context.Context, p peer.ID, rec *recpb.Re
 var errInvalidRecord = errors.New("received invalid record")
 
 // getValueOrPeers queries a particular peer p for the value for
-// key. It returns either the value or a list of closer peers.
+// key, as transformed by the key transform. It returns either the value or a
+// list of closer peers.
 // NOTE: It will update the dht's peerstore with any new addresses
 // it finds for the given peer.
 func (dht *IpfsDHT) getValueOrPeers(ctx context.Context, p peer.ID, key string) (*recpb.Record, []*pstore.PeerInfo, error) {
@@ -191,8 +352,11 @@ func (dht *IpfsDHT) getValueOrPeers(ctx context.Context, p peer.ID, key string)
 		// Success! We were given the value
 		logger.Debug("getValueOrPeers: got value")
 
-		// make sure record is valid.
+		// make sure record is valid, and is the one we asked for.
 		err = dht.Validator.Validate(string(record.GetKey()), record.GetValue())
+		if err == nil && dht.transformKey(string(record.GetKey())) != key {
+			err = errors.New("record key doesn't match the requested key")
+		}
 		if err != nil {
 			logger.Info("Received invalid record! (discarded)")
 			// return a sentinal to signify an invalid record was received
@@ -238,7 +402,7 @@ func (dht *IpfsDHT) getValueSingle(ctx context.Context, p peer.ID, key string) (
 // getLocal attempts to retrieve the value from the datastore
 func (dht *IpfsDHT) getLocal(key string) (*recpb.Record, error) {
 	logger.Debugf("getLocal %s", key)
-	rec, err := dht.getRecordFromDatastore(mkDsKey(key))
+	rec, err := dht.getRecordFromDatastore(mkDsKey(dht.transformKey(key)))
 	if err != nil {
 		logger.Warningf("getLocal: %s", err)
 		return nil, err
@@ -273,7 +437,7 @@ func (dht *IpfsDHT) putLocal(key string, rec *recpb.Record) error {
 		return err
 	}
 
-	return dht.datastore.Put(mkDsKey(key), data)
+	return dht.datastore.Put(mkDsKey(dht.transformKey(key)), data)
 }
 
 // Update signals the routingTable to Update its last-seen status
@@ -283,6 +447,51 @@ func (dht *IpfsDHT) Update(ctx context.Context, p peer.ID) {
 	dht.routingTable.Update(p)
 }
 
+// peerFailed records a failed dial or query of p, removing it from the routing
+// table once it has failed too many times in a row.
+func (dht *IpfsDHT) peerFailed(p peer.ID) {
+	if dht.maxPeerFailures == 0 {
+		return
+	}
+
+	dht.pflk.Lock()
+	defer dht.pflk.Unlock()
+
+	// only keep track of the peers that we hand out as seeds.
+	if dht.routingTable.Find(p) == "" {
+		delete(dht.peerFailures, p)
+		return
+	}
+	dht.peerFailures[p]++
+	if dht.peerFailures[p] < dht.maxPeerFailures {
+		return
+	}
+	logger.Debugf("removing %s from the routing table after %d failures", p, dht.peerFailures[p])
+	delete(dht.peerFailures, p)
+	dht.routingTable.Remove(p)
+}
+
+// peerSucceeded resets the failure count of p.
+func (dht *IpfsDHT) peerSucceeded(p peer.ID) {
+	if dht.maxPeerFailures == 0 {
+		return
+	}
+
+	dht.pflk.Lock()
+	defer dht.pflk.Unlock()
+	delete(dht.peerFailures, p)
+}
+
+// peerVerified keeps the addresses of p, which just answered a query, for
+// longer than the temporary addresses we learned it by. The addresses we're
+// actually connected to it on are kept for as long as we're connected.
+func (dht *IpfsDHT) peerVerified(p peer.ID) {
+	dht.peerstore.UpdateAddrs(p, pstore.TempAddrTTL, dht.verifiedAddrTTL)
+	for _, c := range dht.host.Network().ConnsToPeer(p) {
+		dht.peerstore.AddAddr(p, c.RemoteMultiaddr(), pstore.ConnectedAddrTTL)
+	}
+}
+
 // FindLocal looks for a peer with a given ID connected to this dht and returns the peer and the table it was found in.
 func (dht *IpfsDHT) FindLocal(id peer.ID) pstore.PeerInfo {
 	switch dht.host.Network().Connectedness(id) {
@@ -390,6 +599,52 @@ func (dht *IpfsDHT) Close() error {
 	return dht.proc.Close()
 }
 
+// Shutdown closes the DHT gracefully: it fails the queries started from now
+// on with ErrShuttingDown, waits for the queries in flight to complete, and
+// closes the DHT. If ctx is done first, it closes the DHT right away and
+// returns the error of ctx; the queries still in flight then end with their
+// own contexts.
+func (dht *IpfsDHT) Shutdown(ctx context.Context) error {
+	dht.rnlk.Lock()
+	select {
+	case <-dht.closing:
+	default:
+		close(dht.closing)
+	}
+	dht.rnlk.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		dht.runners.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if cerr := dht.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// startRunner accounts for a query runner starting, unless the DHT is
+// shutting down.
+func (dht *IpfsDHT) startRunner() error {
+	dht.rnlk.Lock()
+	defer dht.rnlk.Unlock()
+	select {
+	case <-dht.closing:
+		return ErrShuttingDown
+	default:
+	}
+	dht.runners.Add(1)
+	return nil
+}
+
 func (dht *IpfsDHT) protocolStrs() []string {
 	pstrs := make([]string, len(dht.protocols))
 	for idx, proto := range dht.protocols {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"crypto/rand"
 	"fmt"
+	"sync"
 	"time"
 
 	u "github.com/ipfs/go-ipfs-util"
@@ -177,3 +178,61 @@ func (dht *IpfsDHT) BootstrapSelf(ctx context.Context) error {
 	_, err := dht.walk(ctx, dht.self)
 	return err
 }
+
+// BootstrapPeerResult is the outcome of connecting to a bootstrap peer.
+type BootstrapPeerResult struct {
+	Peer      peer.ID
+	Connected bool
+	Err       error // why we couldn't connect, if we didn't
+}
+
+// BootstrapResult is the outcome of BootstrapWithPeerInfos.
+type BootstrapResult struct {
+	// Peers are the outcomes of the bootstrap peers, in the order given.
+	Peers []BootstrapPeerResult
+	// RoutingTableSize is the size of the routing table once done.
+	RoutingTableSize int
+}
+
+// BootstrapWithPeerInfos joins the DHT through the given bootstrap peers: it
+// adds their addresses to the peerstore, connects to all of them, and looks
+// up our own ID through the ones we could connect to, which fills the
+// routing table with our neighbors. It returns an error if it couldn't
+// connect to any of them, along with the result telling why.
+func (dht *IpfsDHT) BootstrapWithPeerInfos(ctx context.Context, peers []pstore.PeerInfo) (*BootstrapResult, error) {
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no bootstrap peers")
+	}
+	for _, pi := range peers {
+		dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+	}
+
+	res := &BootstrapResult{Peers: make([]BootstrapPeerResult, len(peers))}
+	var wg sync.WaitGroup
+	for i, pi := range peers {
+		wg.Add(1)
+		go func(i int, pi pstore.PeerInfo) {
+			defer wg.Done()
+			err := dht.host.Connect(ctx, pi)
+			res.Peers[i] = BootstrapPeerResult{Peer: pi.ID, Connected: err == nil, Err: err}
+		}(i, pi)
+	}
+	wg.Wait()
+
+	var seeds []peer.ID
+	for _, pr := range res.Peers {
+		if pr.Connected {
+			seeds = append(seeds, pr.Peer)
+		}
+	}
+	if len(seeds) == 0 {
+		res.RoutingTableSize = dht.routingTable.Size()
+		return res, fmt.Errorf("failed to connect to any of the %d bootstrap peers", len(peers))
+	}
+
+	// bypass the query cache, we want to meet our neighbors.
+	for range dht.getClosestPeers(ctx, string(dht.self), seeds) {
+	}
+	res.RoutingTableSize = dht.routingTable.Size()
+	return res, ctx.Err()
+}
@@ -13,6 +13,8 @@ import (
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	mstream "github.com/multiformats/go-multistream"
 )
 
 var dhtReadMessageTimeout = time.Minute
@@ -110,6 +112,9 @@ func (dht *IpfsDHT) handleNewMessage(s inet.Stream) bool {
 // sendRequest sends out a request, but also makes sure to
 // measure the RTT for latency measurements.
 func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	if dht.sim != nil {
+		return dht.sim.sendRequest(ctx, p, pmes)
+	}
 
 	ms, err := dht.messageSenderForPeer(ctx, p)
 	if err != nil {
@@ -133,6 +138,10 @@ func (dht *IpfsDHT) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message
 
 // sendMessage sends out a message
 func (dht *IpfsDHT) sendMessage(ctx context.Context, p peer.ID, pmes *pb.Message) error {
+	if dht.sim != nil {
+		_, err := dht.sim.sendRequest(ctx, p, pmes)
+		return err
+	}
 	ms, err := dht.messageSenderForPeer(ctx, p)
 	if err != nil {
 		return err
@@ -196,6 +205,10 @@ type messageSender struct {
 
 	invalid   bool
 	singleMes int
+
+	// unconfirmed is whether no response came over s yet: its protocol
+	// was negotiated lazily, so the peer may not speak it.
+	unconfirmed bool
 }
 
 // invalidate is called before this messageSender is removed from the strmap.
@@ -227,10 +240,15 @@ func (ms *messageSender) prep(ctx context.Context) error {
 		return nil
 	}
 
-	nstr, err := ms.dht.host.NewStream(ctx, ms.p, ms.dht.protocols...)
+	nstr, err := ms.dht.host.NewStream(ctx, ms.p, ms.dht.protocolsFor(ms.p)...)
 	if err != nil {
+		if err == mstream.ErrNotSupported {
+			// the protocol version we remembered for the peer is stale.
+			ms.dht.forgetProtocol(ms.p)
+		}
 		return err
 	}
+	ms.unconfirmed = true
 
 	ms.r = ggio.NewDelimitedReader(nstr, inet.MessageSizeMax)
 	ms.w = newBufferedDelimitedWriter(nstr)
@@ -239,6 +257,17 @@ func (ms *messageSender) prep(ctx context.Context) error {
 	return nil
 }
 
+// protocol returns the protocol negotiated on the stream to the peer, opening
+// the stream if needed.
+func (ms *messageSender) protocol(ctx context.Context) (protocol.ID, error) {
+	ms.lk.Lock()
+	defer ms.lk.Unlock()
+	if err := ms.prep(ctx); err != nil {
+		return "", err
+	}
+	return ms.s.Protocol(), nil
+}
+
 // streamReuseTries is the number of times we will try to reuse a stream to a
 // given peer before giving up and reverting to the old one-message-per-stream
 // behaviour.
@@ -307,6 +336,12 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 		if err := ms.ctxReadMsg(ctx, mes); err != nil {
 			ms.s.Reset()
 			ms.s = nil
+			if ms.unconfirmed && ctx.Err() == nil && err != ErrReadTimeout {
+				// the peer may have refused the protocol version we
+				// remembered for it, and reset the stream: negotiate it
+				// afresh.
+				ms.dht.forgetProtocol(ms.p)
+			}
 
 			if retry {
 				logger.Info("error reading message, bailing: ", err)
@@ -319,6 +354,7 @@ func (ms *messageSender) SendRequest(ctx context.Context, pmes *pb.Message) (*pb
 		}
 
 		logger.Event(ctx, "dhtSentMessage", ms.dht.self, ms.p, pmes)
+		ms.unconfirmed = false
 
 		if ms.singleMes > streamReuseTries {
 			go inet.FullClose(ms.s)
@@ -0,0 +1,249 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+)
+
+// This file holds DHT construction options that refer to types defined in
+// this package and therefore can't live in the opts package.
+
+type queryTracerOptionKey struct{}
+
+// WithQueryTracer configures the DHT to report the progress of every query
+// it runs to t.
+//
+// Defaults to NoopTracer.
+func WithQueryTracer(t QueryTracer) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, queryTracerOptionKey{}, t)
+		return nil
+	}
+}
+
+type sloEnforcerOptionKey struct{}
+
+// WithSLOEnforcer configures the DHT to tune its query concurrency with s.
+// The concurrency starts at the configured alpha, clamped to the bounds of s.
+//
+// Defaults to a fixed concurrency.
+func WithSLOEnforcer(s *SLOEnforcer) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, sloEnforcerOptionKey{}, s)
+		return nil
+	}
+}
+
+type peerReputationOptionKey struct{}
+
+// WithPeerReputation configures the DHT to track the reputation of the peers
+// it queries, and to probabilistically skip peers that are slow or failing.
+//
+// Defaults to querying every peer regardless of its track record.
+func WithPeerReputation(cfg ReputationConfig) opts.Option {
+	return func(o *opts.Options) error {
+		c, err := NewPeerReputationCache(cfg)
+		if err != nil {
+			return err
+		}
+		setOtherOption(o, peerReputationOptionKey{}, c)
+		return nil
+	}
+}
+
+type dialHistoryOptionKey struct{}
+
+// WithDialHistory configures the DHT to record how dialing peers goes in h,
+// and its queries to dial the peers that keep failing after the others,
+// giving them another chance now and then. Back h with a persistent
+// datastore for the history to survive restarts.
+//
+// Defaults to dialing peers by distance only.
+func WithDialHistory(h *DialHistory) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, dialHistoryOptionKey{}, h)
+		return nil
+	}
+}
+
+type peerFilterOptionKey struct{}
+
+// WithDefaultPeerFilter configures the DHT to only contact the peers f allows
+// in its queries. Individual queries may override it with WithPeerFilter.
+//
+// Defaults to contacting any peer.
+func WithDefaultPeerFilter(f PeerFilter) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, peerFilterOptionKey{}, f)
+		return nil
+	}
+}
+
+type tombstoneStoreOptionKey struct{}
+
+// WithTombstoneStore configures the DHT to never contact the peers banned in
+// s in its queries. Back s with a persistent datastore for the bans to
+// survive restarts.
+//
+// Defaults to banning no one.
+func WithTombstoneStore(s *TombstoneStore) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, tombstoneStoreOptionKey{}, s)
+		return nil
+	}
+}
+
+type webRTCSignalingDialerOptionKey struct{}
+
+// WithWebRTCSignalingDialer configures the DHT to signal WebRTC connections
+// with d before its queries dial peers that only have WebRTC addresses.
+//
+// Defaults to dialing every peer directly.
+func WithWebRTCSignalingDialer(d WebRTCSignalingDialer) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, webRTCSignalingDialerOptionKey{}, d)
+		return nil
+	}
+}
+
+type queueFactoryOptionKey struct{}
+
+// WithQueueFactory configures the DHT to order the peers its queries dial
+// with the queues f creates, e.g. NewLatencyRoundRobinPQ. It takes precedence
+// over WithGeoAwareness and the connectedness bonus.
+//
+// Defaults to ordering peers by XOR distance to the key.
+func WithQueueFactory(f QueueFactory) opts.Option {
+	return func(o *opts.Options) error {
+		setOtherOption(o, queueFactoryOptionKey{}, f)
+		return nil
+	}
+}
+
+type queryDeduplicatorOptionKey struct{}
+
+// WithQueryDeduplicator configures the DHT to reject, with ErrDuplicateQuery,
+// the queries for the same key, from the same peers and of the same kind as
+// one it started less than ttl ago. It remembers up to size queries, see
+// DefaultDedupTTL and DefaultDedupSize.
+//
+// Defaults to running every query.
+func WithQueryDeduplicator(ttl time.Duration, size int) opts.Option {
+	return func(o *opts.Options) error {
+		d, err := NewQueryDeduplicator(ttl, size)
+		if err != nil {
+			return err
+		}
+		setOtherOption(o, queryDeduplicatorOptionKey{}, d)
+		return nil
+	}
+}
+
+type geoAwarenessOptionKey struct{}
+
+// WithGeoAwareness makes the DHT geo-aware: its queries contact the peers
+// that are closest to the key and geographically closest to us first, with
+// geographic distances computed from the IP addresses of the peers located
+// with lookup. blend is the weight given to the geographic distance, from 0.0
+// for pure XOR distance, as in standard Kademlia, to 1.0 for pure geographic
+// distance.
+//
+// Defaults to pure XOR distance.
+func WithGeoAwareness(lookup GeoLookup, blend float64) opts.Option {
+	return func(o *opts.Options) error {
+		if lookup == nil {
+			return fmt.Errorf("nil geo lookup")
+		}
+		if blend < 0 || blend > 1 {
+			return fmt.Errorf("geo blend must be between 0 and 1, got %v", blend)
+		}
+		setOtherOption(o, geoAwarenessOptionKey{}, &geoAwareness{lookup: lookup, blend: blend})
+		return nil
+	}
+}
+
+type queryCacheOptionKey struct{}
+
+// WithQueryCache makes GetClosestPeers remember the peers it found for up to
+// maxEntries keys, and answer with them instead of running a lookup for ttl
+// afterwards.
+//
+// Defaults to running every lookup.
+func WithQueryCache(maxEntries int, ttl time.Duration) opts.Option {
+	return func(o *opts.Options) error {
+		c, err := NewQueryCache(maxEntries, ttl)
+		if err != nil {
+			return err
+		}
+		setOtherOption(o, queryCacheOptionKey{}, c)
+		return nil
+	}
+}
+
+type keyTransformOptionKey struct{}
+
+// WithKeyTransform makes the DHT store value records under t(key) rather
+// than under their key, e.g. SHA256KeyTransform. Lookups for records look
+// for t(key) too. Peer and provider lookups are left as they are. Every node
+// of the network must use the same transform.
+//
+// Defaults to storing records under their key.
+func WithKeyTransform(t KeyTransform) opts.Option {
+	return func(o *opts.Options) error {
+		if t == nil {
+			return fmt.Errorf("nil key transform")
+		}
+		setOtherOption(o, keyTransformOptionKey{}, t)
+		return nil
+	}
+}
+
+func setOtherOption(o *opts.Options, key, value interface{}) {
+	if o.Other == nil {
+		o.Other = make(map[interface{}]interface{}, 1)
+	}
+	o.Other[key] = value
+}
+
+// applyOtherOptions configures dht from the dht specific options in cfg.
+func (dht *IpfsDHT) applyOtherOptions(cfg *opts.Options) {
+	if t, ok := cfg.Other[queryTracerOptionKey{}].(QueryTracer); ok && t != nil {
+		dht.tracer = t
+	}
+	if s, ok := cfg.Other[sloEnforcerOptionKey{}].(*SLOEnforcer); ok && s != nil {
+		s.setAlpha(dht.alpha)
+		dht.slo = s
+	}
+	if c, ok := cfg.Other[peerReputationOptionKey{}].(*PeerReputationCache); ok {
+		dht.reputation = c
+	}
+	if h, ok := cfg.Other[dialHistoryOptionKey{}].(*DialHistory); ok {
+		dht.dialHistory = h
+	}
+	if f, ok := cfg.Other[peerFilterOptionKey{}].(PeerFilter); ok {
+		dht.peerFilter = f
+	}
+	if s, ok := cfg.Other[tombstoneStoreOptionKey{}].(*TombstoneStore); ok {
+		dht.tombstones = s
+	}
+	if d, ok := cfg.Other[webRTCSignalingDialerOptionKey{}].(WebRTCSignalingDialer); ok {
+		dht.webrtc = d
+	}
+	if f, ok := cfg.Other[queueFactoryOptionKey{}].(QueueFactory); ok {
+		dht.queueFactory = f
+	}
+	if d, ok := cfg.Other[queryDeduplicatorOptionKey{}].(*QueryDeduplicator); ok {
+		dht.dedup = d
+	}
+	if g, ok := cfg.Other[geoAwarenessOptionKey{}].(*geoAwareness); ok {
+		dht.geo = g
+	}
+	if c, ok := cfg.Other[queryCacheOptionKey{}].(*QueryCache); ok {
+		dht.queryCache = c
+	}
+	if t, ok := cfg.Other[keyTransformOptionKey{}].(KeyTransform); ok {
+		dht.keyTransform = t
+	}
+}
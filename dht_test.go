@@ -31,6 +31,7 @@ import (
 	routing "github.com/libp2p/go-libp2p-routing"
 	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
 	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	tu "github.com/libp2p/go-testutil"
 	ci "github.com/libp2p/go-testutil/ci"
 	travisci "github.com/libp2p/go-testutil/ci/travis"
 	ma "github.com/multiformats/go-multiaddr"
@@ -1319,6 +1320,43 @@ func TestFindClosestPeers(t *testing.T) {
 	}
 }
 
+func TestFindNearestToSelf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	nDHTs := 10
+	dhts := setupDHTS(t, ctx, nDHTs)
+	defer func() {
+		for i := 0; i < nDHTs; i++ {
+			dhts[i].Close()
+			defer dhts[i].host.Close()
+		}
+	}()
+
+	for i := 0; i < nDHTs; i++ {
+		connect(t, ctx, dhts[i], dhts[(i+1)%len(dhts)])
+	}
+
+	out, err := dhts[0].FindNearestToSelf(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != nDHTs-1 {
+		t.Fatalf("got wrong number of peers (got %d, expected %d)", len(out), nDHTs-1)
+	}
+
+	var all []peer.ID
+	for _, d := range dhts[1:] {
+		all = append(all, d.self)
+	}
+	testPeerListsMatch(t, out, all)
+	for i := 1; i < len(out); i++ {
+		if kb.Closer(out[i], out[i-1], string(dhts[0].self)) {
+			t.Fatal("expected peers to be sorted closest first")
+		}
+	}
+}
+
 func TestGetSetPluggedProtocol(t *testing.T) {
 	t.Run("PutValue/GetValue - same protocol", func(t *testing.T) {
 		ctx, cancel := context.WithCancel(context.Background())
@@ -1416,3 +1454,359 @@ func TestClientModeAtInit(t *testing.T) {
 	err := pinger.Ping(context.Background(), client.PeerID())
 	assert.True(t, xerrors.Is(err, multistream.ErrNotSupported))
 }
+
+func TestPerInstanceKAndAlpha(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		opts.KValue(5),
+		opts.AlphaValue(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+
+	if d.bucketSize != 5 || d.alpha != 1 {
+		t.Fatalf("expected K=5 and alpha=1, got K=%d and alpha=%d", d.bucketSize, d.alpha)
+	}
+	if c := d.newQuery("foo", nil).concurrency; c != 1 {
+		t.Fatalf("expected query concurrency 1, got %d", c)
+	}
+
+	def := setupDHT(ctx, t, false)
+	defer def.Close()
+	defer def.host.Close()
+	if def.bucketSize != KValue || def.alpha != AlphaValue {
+		t.Fatalf("expected the package defaults, got K=%d and alpha=%d", def.bucketSize, def.alpha)
+	}
+
+	if _, err := New(ctx, def.host, opts.KValue(0)); err == nil {
+		t.Fatal("expected a zero K to be rejected")
+	}
+}
+
+func TestDifferentKInSameProcess(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newDHT := func(k int) *IpfsDHT {
+		d, err := New(
+			ctx,
+			bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+			opts.KValue(k),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	small, large := newDHT(3), newDHT(6)
+	dhts := append(setupDHTS(t, ctx, 8), small, large)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// small routing tables can't hold every peer, so don't wait for them to.
+	for i, a := range dhts {
+		for _, b := range dhts[i+1:] {
+			connectNoSync(t, ctx, a, b)
+		}
+	}
+	for _, d := range dhts {
+		for d.routingTable.Size() == 0 {
+			select {
+			case <-ctx.Done():
+				t.Fatal(ctx.Err())
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		dht *IpfsDHT
+		k   int
+	}{{small, 3}, {large, 6}} {
+		if tc.dht.closerPeerCount != tc.k {
+			t.Errorf("expected to send %d closer peers, got %d", tc.k, tc.dht.closerPeerCount)
+		}
+		peers, err := tc.dht.GetClosestPeers(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found int
+		for range peers {
+			found++
+		}
+		if found != tc.k {
+			t.Errorf("expected K=%d closest peers, got %d", tc.k, found)
+		}
+	}
+
+	if c := dhts[0].closerPeerCount; c != CloserPeerCount {
+		t.Errorf("expected the default DHT to send %d closer peers, got %d", CloserPeerCount, c)
+	}
+}
+
+func TestEvictFailedPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newDHT := func(options ...opts.Option) *IpfsDHT {
+		d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	evicting, conservative := newDHT(opts.EvictFailedPeers(1)), newDHT()
+	dhts := append(setupDHTS(t, ctx, 2), evicting, conservative)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	alive, dead := dhts[0], dhts[1]
+	for _, d := range []*IpfsDHT{evicting, conservative} {
+		connect(t, ctx, d, alive)
+		connect(t, ctx, d, dead)
+	}
+
+	// a query that's cancelled doesn't count against the peers it touched.
+	qctx, qcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer qcancel()
+	evicting.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}).Run(qctx, []peer.ID{dead.self})
+	if evicting.routingTable.Find(dead.self) == "" {
+		t.Fatal("didn't expect a cancelled query to evict the peer")
+	}
+
+	// kill the DHT but keep the connection up, so only a query notices.
+	for _, p := range dead.protocols {
+		dead.host.RemoveStreamHandler(p)
+	}
+
+	for _, d := range []*IpfsDHT{evicting, conservative} {
+		if _, err := d.FindPeer(ctx, "missing"); err == nil {
+			t.Fatal("expected the lookup to fail")
+		}
+	}
+	if evicting.routingTable.Find(dead.self) != "" {
+		t.Error("expected the failed peer to be removed from the routing table")
+	}
+	if evicting.routingTable.Find(alive.self) == "" {
+		t.Error("expected the responsive peer to stay in the routing table")
+	}
+	if conservative.routingTable.Find(dead.self) == "" {
+		t.Error("expected the conservative DHT to keep the failed peer")
+	}
+}
+
+func TestEvictUndialablePeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	d.maxPeerFailures = 1
+
+	// a peer that refuses connections can't be dialed.
+	gone := tu.RandPeerIDFatal(t)
+	refused, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.peerstore.AddAddr(gone, refused, pstore.TempAddrTTL)
+	d.routingTable.Update(gone)
+
+	r, err := newQueryRunner(d.newQuery("foo", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	r.peersRemaining.Increment(1)
+	// dial with a context from the query's process, as the dial queue does.
+	if err := r.dialPeer(r.peersDialed.ctx, gone); err == nil {
+		t.Fatal("expected the dial to fail")
+	}
+	if d.routingTable.Find(gone) != "" {
+		t.Error("expected the undialable peer to be removed from the routing table")
+	}
+}
+
+func TestPerPeerTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	var seeds []peer.ID
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+		seeds = append(seeds, d.self)
+	}
+
+	slow := seeds[0]
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == slow {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &dhtQueryResult{}, nil
+	})
+	query.perPeerTimeout = 100 * time.Millisecond
+
+	start := time.Now()
+	_, err := query.Run(ctx, seeds)
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected the query to finish normally, got %v", err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Fatalf("slow peer held up the query for %s", took)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("the per-peer deadline must not cancel the whole query")
+	}
+}
+
+func TestBootstrapWithPeerInfos(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// the others know each other, we only know of the first one, and of a
+	// peer that's gone.
+	connect(t, ctx, dhts[1], dhts[2])
+	connect(t, ctx, dhts[2], dhts[3])
+	gone := tu.RandPeerIDFatal(t)
+	infos := []pstore.PeerInfo{
+		{ID: dhts[1].self, Addrs: dhts[1].host.Addrs()},
+		{ID: gone, Addrs: []ma.Multiaddr{ma.StringCast("/ip4/127.0.0.1/tcp/1")}},
+	}
+
+	res, err := dhts[0].BootstrapWithPeerInfos(ctx, infos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Peers) != 2 {
+		t.Fatalf("expected the outcomes of the 2 bootstrap peers, got %+v", res.Peers)
+	}
+	if pr := res.Peers[0]; pr.Peer != dhts[1].self || !pr.Connected || pr.Err != nil {
+		t.Errorf("expected to connect to the first bootstrap peer, got %+v", pr)
+	}
+	if pr := res.Peers[1]; pr.Peer != gone || pr.Connected || pr.Err == nil {
+		t.Errorf("expected to fail to connect to the gone peer, got %+v", pr)
+	}
+
+	// the self lookup met the peers the bootstrap peer knows.
+	for _, d := range dhts[2:] {
+		for dhts[0].routingTable.Find(d.self) == "" {
+			select {
+			case <-ctx.Done():
+				t.Fatalf("expected %s in the routing table, got %v", d.self, dhts[0].routingTable.ListPeers())
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}
+
+	if _, err := dhts[0].BootstrapWithPeerInfos(ctx, infos[1:]); err == nil {
+		t.Error("expected an error with no reachable bootstrap peer")
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.host.Close()
+
+	// a query held up by a fake peer until released.
+	release := make(chan struct{})
+	started := make(chan struct{})
+	run := func(ctx context.Context, hold bool) error {
+		_, err := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			if !hold {
+				return &dhtQueryResult{}, nil
+			}
+			close(started)
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+			return &dhtQueryResult{}, nil
+		}, WithDialFunc(func(context.Context, pstore.PeerInfo) error {
+			return nil
+		})).Run(ctx, []peer.ID{tu.RandPeerIDFatal(t)})
+		return err
+	}
+	go run(ctx, true)
+	<-started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- d.Shutdown(ctx)
+	}()
+
+	// new queries are turned down, the one in flight gets to complete.
+	for {
+		if err := run(ctx, false); err == ErrShuttingDown {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			t.Fatal("expected new queries to be turned down")
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("expected the shutdown to wait for the query in flight, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-d.Process().Closed():
+	default:
+		t.Error("expected the DHT to be closed")
+	}
+
+	// unless it takes too long.
+	d2 := setupDHT(ctx, t, false)
+	defer d2.host.Close()
+	d = d2
+	release, started = make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go run(ctx, true)
+	<-started
+	sctx, scancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer scancel()
+	if err := d2.Shutdown(sctx); err != context.DeadlineExceeded {
+		t.Errorf("expected the shutdown to give up on the query in flight, got %v", err)
+	}
+}
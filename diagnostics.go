@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// LookupDiagnostics describes how a lookup went, so that a surprisingly small
+// result can be told apart from a small network or from unreachable peers.
+type LookupDiagnostics struct {
+	// Candidates is the number of peers the lookup tried to contact.
+	Candidates int
+	// Failed holds the error of every candidate that couldn't be dialed or
+	// queried.
+	Failed map[peer.ID]error
+	// Timings breaks down the time spent on every candidate, slowest first.
+	Timings []PeerTiming
+}
+
+// PeerTiming is the time a query spent getting a peer's answer, split between
+// dialing it and querying it, to tell slow connections from slow peers.
+type PeerTiming struct {
+	Peer peer.ID
+	// Connected is whether we were already connected to the peer, in which
+	// case it wasn't dialed.
+	Connected bool
+	// Dial is how long connecting to the peer took.
+	Dial time.Duration
+	// RPC is how long the peer took to answer the query, zero if it wasn't
+	// queried.
+	RPC time.Duration
+	// Err is the error the peer failed with, nil if it answered.
+	Err error
+}
+
+// TopError returns the most common error among the failed candidates, or nil
+// if none failed.
+func (d *LookupDiagnostics) TopError() error {
+	errs := make([]error, 0, len(d.Failed))
+	for _, err := range d.Failed {
+		errs = append(errs, err)
+	}
+	return mostCommonError(errs)
+}
+
+func (d *LookupDiagnostics) String() string {
+	if len(d.Failed) == 0 {
+		return fmt.Sprintf("all %d candidates reachable", d.Candidates)
+	}
+	return fmt.Sprintf("%d of %d candidates unreachable, top error: %s",
+		len(d.Failed), d.Candidates, d.TopError())
+}
+
+type lookupDiagnosticsKey struct{}
+
+// ContextWithLookupDiagnostics returns a context that makes GetClosestPeers
+// fill in d. d is complete once the channel returned by GetClosestPeers is
+// closed, and must not be read before.
+func ContextWithLookupDiagnostics(ctx context.Context, d *LookupDiagnostics) context.Context {
+	return context.WithValue(ctx, lookupDiagnosticsKey{}, d)
+}
+
+func lookupDiagnosticsFromContext(ctx context.Context) *LookupDiagnostics {
+	d, _ := ctx.Value(lookupDiagnosticsKey{}).(*LookupDiagnostics)
+	return d
+}
+
+// fill sets d from the result of the lookup query.
+func (d *LookupDiagnostics) fill(res *dhtQueryResult) {
+	if res.finalSet != nil {
+		d.Candidates = res.finalSet.Size()
+	}
+	d.Failed = res.failedPeers
+	d.Timings = res.peerTimings
+}
@@ -0,0 +1,117 @@
+package dht
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestLookupDiagnostics(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+
+	// kill two of the DHTs, keeping their connections up. with three peers
+	// in the routing table, all of them are seeds of the lookup.
+	failing := dhts[2:]
+	for _, d := range failing {
+		for _, p := range d.protocols {
+			d.host.RemoveStreamHandler(p)
+		}
+	}
+
+	var diag LookupDiagnostics
+	peers, err := dhts[0].GetClosestPeers(ContextWithLookupDiagnostics(ctx, &diag), "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range peers {
+	}
+
+	if diag.Candidates != 3 {
+		t.Errorf("expected 3 candidates, got %d", diag.Candidates)
+	}
+	if len(diag.Failed) != len(failing) {
+		t.Fatalf("expected %d failed peers, got %v", len(failing), diag.Failed)
+	}
+	for _, d := range failing {
+		if diag.Failed[d.self] == nil {
+			t.Errorf("expected %s to have failed", d.self)
+		}
+	}
+	if diag.TopError() == nil {
+		t.Error("expected a top error")
+	}
+	if s := diag.String(); !strings.HasPrefix(s, "2 of 3 candidates unreachable, top error: ") {
+		t.Errorf("unexpected summary %q", s)
+	}
+	if len(diag.Timings) != 3 {
+		t.Fatalf("expected the timings of the 3 candidates, got %v", diag.Timings)
+	}
+	for _, pt := range diag.Timings {
+		if !pt.Connected || pt.Dial != 0 {
+			t.Errorf("expected %s to be already connected, got %+v", pt.Peer, pt)
+		}
+		if (pt.Err != nil) != (diag.Failed[pt.Peer] != nil) {
+			t.Errorf("expected the timing of %s to carry its error, got %+v", pt.Peer, pt)
+		}
+	}
+}
+
+func TestQueryPeerTimings(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	// fake peers, one slow to dial and one slow to answer.
+	slowDial, slowRPC := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	delay := 100 * time.Millisecond
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == slowRPC {
+			time.Sleep(delay)
+		}
+		return &dhtQueryResult{}, nil
+	}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		if pi.ID == slowDial {
+			time.Sleep(delay)
+		}
+		return nil
+	}))
+	res, err := query.Run(ctx, []peer.ID{slowDial, slowRPC})
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	timings := make(map[peer.ID]PeerTiming)
+	for _, pt := range res.PeerTimings() {
+		timings[pt.Peer] = pt
+	}
+	if len(timings) != 2 {
+		t.Fatalf("expected the timings of 2 peers, got %v", res.PeerTimings())
+	}
+	if pt := timings[slowDial]; pt.Connected || pt.Dial < delay || pt.RPC >= delay {
+		t.Errorf("expected %s to be slow to dial, got %+v", slowDial, pt)
+	}
+	if pt := timings[slowRPC]; pt.Connected || pt.Dial >= delay || pt.RPC < delay {
+		t.Errorf("expected %s to be slow to answer, got %+v", slowRPC, pt)
+	}
+}
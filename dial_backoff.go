@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// errDialBackoff is the error of the peers a query doesn't dial as they
+// failed to dial recently.
+var errDialBackoff = errors.New("dial backoff")
+
+// dialBackoff remembers the peers the queries of a DHT failed to dial, so
+// that the next queries don't dial them again right away. The backoff of a
+// peer doubles with every failed dial, up to a maximum, and is cleared by a
+// successful one. All of its methods are safe to call on a nil pointer.
+type dialBackoff struct {
+	base, max time.Duration
+
+	mu    sync.Mutex
+	cache *lru.Cache // peer.ID -> *dialBackoffEntry
+}
+
+type dialBackoffEntry struct {
+	delay time.Duration
+	until time.Time // no dial before then
+}
+
+func newDialBackoff(base, max time.Duration, maxEntries int) (*dialBackoff, error) {
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &dialBackoff{base: base, max: max, cache: cache}, nil
+}
+
+// backedOff returns whether p failed to dial too recently to dial it again.
+func (b *dialBackoff) backedOff(p peer.ID) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e, ok := b.entry(p)
+	return ok && time.Now().Before(e.until)
+}
+
+// failed backs off p, twice as long as the last time if it's still
+// remembered.
+func (b *dialBackoff) failed(p peer.ID) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delay := b.base
+	if e, ok := b.entry(p); ok {
+		delay = 2 * e.delay
+		if delay > b.max {
+			delay = b.max
+		}
+	}
+	b.cache.Add(p, &dialBackoffEntry{delay: delay, until: time.Now().Add(delay)})
+}
+
+// succeeded forgets the failures of p.
+func (b *dialBackoff) succeeded(p peer.ID) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.cache.Remove(p)
+}
+
+// entry returns the backoff of p, unless it expired: once a peer didn't fail
+// for the maximum backoff after its last one, it starts afresh. The caller
+// must hold the lock.
+func (b *dialBackoff) entry(p peer.ID) (*dialBackoffEntry, bool) {
+	v, ok := b.cache.Get(p)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*dialBackoffEntry)
+	if time.Now().After(e.until.Add(b.max)) {
+		b.cache.Remove(p)
+		return nil, false
+	}
+	return e, true
+}
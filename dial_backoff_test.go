@@ -0,0 +1,107 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestDialBackoffAcrossQueries(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dead := tu.RandPeerIDFatal(t)
+	var dials int32
+	lookup := func(d *IpfsDHT) error {
+		_, err := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			return &dhtQueryResult{}, nil
+		}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+			atomic.AddInt32(&dials, 1)
+			return errors.New("connection refused")
+		})).Run(ctx, []peer.ID{dead})
+		return err
+	}
+
+	// without the option, every lookup dials the dead peer.
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	for i := 0; i < 2; i++ {
+		err := lookup(d)
+		if lf, ok := err.(*ErrLookupFailure); !ok || len(lf.Errs) != 1 || lf.Errs[0] == errDialBackoff {
+			t.Fatalf("expected the lookup to fail on the dial, got %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&dials); n != 2 {
+		t.Errorf("expected the dead peer to be dialed by both lookups without dial backoff, got %d dials", n)
+	}
+
+	atomic.StoreInt32(&dials, 0)
+	d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx)),
+		opts.DialBackoff(DefaultDialBackoffBase, DefaultDialBackoffMax, DefaultDialBackoffSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+	if err := lookup(d); err == nil {
+		t.Fatal("expected the first lookup to fail")
+	}
+	err = lookup(d)
+	if lf, ok := err.(*ErrLookupFailure); !ok || len(lf.Errs) != 1 || lf.Errs[0] != errDialBackoff {
+		t.Fatalf("expected the second lookup to fail on the backoff, got %v", err)
+	}
+	if n := atomic.LoadInt32(&dials); n != 1 {
+		t.Errorf("expected the dead peer to be dialed once, got %d dials", n)
+	}
+}
+
+func TestDialBackoff(t *testing.T) {
+	b, err := newDialBackoff(20*time.Millisecond, 50*time.Millisecond, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := tu.RandPeerIDFatal(t)
+	delay := func() time.Duration {
+		e, ok := b.entry(p)
+		if !ok {
+			return 0
+		}
+		return e.delay
+	}
+
+	if b.backedOff(p) {
+		t.Fatal("expected no backoff before any failure")
+	}
+	for _, want := range []time.Duration{20, 40, 50, 50} {
+		b.failed(p)
+		if !b.backedOff(p) || delay() != want*time.Millisecond {
+			t.Fatalf("expected a backoff of %dms, got %s", want, delay())
+		}
+	}
+
+	b.succeeded(p)
+	if b.backedOff(p) {
+		t.Fatal("expected a successful dial to clear the backoff")
+	}
+
+	b.failed(p)
+	b.failed(p)
+	time.Sleep(40 * time.Millisecond)
+	if b.backedOff(p) || delay() != 40*time.Millisecond {
+		t.Fatalf("expected the backoff to be over but remembered, got %s", delay())
+	}
+	time.Sleep(60 * time.Millisecond)
+	if delay() != 0 {
+		t.Fatalf("expected the backoff to expire, got %s", delay())
+	}
+}
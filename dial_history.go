@@ -0,0 +1,228 @@
+package dht
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// dialHistoryPrefix namespaces the dial stats in the datastore.
+var dialHistoryPrefix = ds.NewKey("/dialhistory")
+
+// forgottenWeight is the decayed number of dials under which the stats of a
+// peer are forgotten.
+const forgottenWeight = 0.1
+
+// DialHistoryConfig configures a DialHistory.
+type DialHistoryConfig struct {
+	// MaxPeers is how many peers are tracked at most. The peers dialed the
+	// longest ago are forgotten first.
+	MaxPeers int
+	// HalfLife is how long it takes for the dial counts of a peer to halve,
+	// so that old failures weigh less than recent ones, and are eventually
+	// forgotten.
+	HalfLife time.Duration
+	// MinFailures is how many failed dials, once decayed, make a peer flaky
+	// if they outnumber its successful ones.
+	MinFailures float64
+	// Probation is how long after its last dial a flaky peer gets its normal
+	// priority back for a retry.
+	Probation time.Duration
+}
+
+// DefaultDialHistoryConfig is a reasonable starting point for most networks.
+var DefaultDialHistoryConfig = DialHistoryConfig{
+	MaxPeers:    1000,
+	HalfLife:    24 * time.Hour,
+	MinFailures: 3,
+	Probation:   10 * time.Minute,
+}
+
+func (c *DialHistoryConfig) validate() error {
+	if c.MaxPeers < 1 {
+		return fmt.Errorf("max peers must be at least 1; actual value: %d", c.MaxPeers)
+	}
+	if c.HalfLife <= 0 {
+		return fmt.Errorf("half life must be positive; actual value: %s", c.HalfLife)
+	}
+	if c.MinFailures <= 0 {
+		return fmt.Errorf("min failures must be positive; actual value: %f", c.MinFailures)
+	}
+	if c.Probation <= 0 {
+		return fmt.Errorf("probation must be positive; actual value: %s", c.Probation)
+	}
+	return nil
+}
+
+// DialStats are the decayed counts of the dials to a peer.
+type DialStats struct {
+	Successes   float64
+	Failures    float64
+	LastDial    time.Time
+	LastFailure time.Time // zero if it never failed
+}
+
+// DialHistory keeps track of how dialing peers went, so that queries dial
+// the peers that keep failing, e.g. as they're only known by stale
+// addresses, after the others. The stats are written through to a datastore
+// so that, when the datastore is persistent, they survive restarts.
+type DialHistory struct {
+	cfg    DialHistoryConfig
+	dstore ds.Datastore
+	now    func() time.Time
+
+	mu    sync.Mutex
+	peers map[peer.ID]*DialStats
+}
+
+// NewDialHistory returns a DialHistory backed by dstore, loaded with the
+// stats already in it.
+func NewDialHistory(dstore ds.Datastore, cfg DialHistoryConfig) (*DialHistory, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	res, err := dstore.Query(dsq.Query{Prefix: dialHistoryPrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	h := &DialHistory{
+		cfg:    cfg,
+		dstore: dstore,
+		now:    time.Now,
+		peers:  make(map[peer.ID]*DialStats, len(entries)),
+	}
+	for _, e := range entries {
+		p, err := peer.IDB58Decode(ds.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			logger.Warningf("skipping dial stats with invalid key %s: %s", e.Key, err)
+			continue
+		}
+		var s DialStats
+		if err := json.Unmarshal(e.Value, &s); err != nil {
+			logger.Warningf("skipping invalid dial stats of %s: %s", p, err)
+			continue
+		}
+		h.peers[p] = &s
+	}
+	return h, nil
+}
+
+// Stats returns the stats of p, decayed to now, if it's tracked.
+func (h *DialHistory) Stats(p peer.ID) (DialStats, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.stats(p, h.now())
+}
+
+// record records a dial to p.
+func (h *DialHistory) record(p peer.ID, success bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	s, ok := h.stats(p, now)
+	if !ok {
+		h.makeRoom()
+	}
+	if success {
+		s.Successes++
+	} else {
+		s.Failures++
+		s.LastFailure = now
+	}
+	s.LastDial = now
+	h.peers[p] = &s
+	h.put(p, &s)
+}
+
+// penalty is added to the distance metric of p in the dial order of queries:
+// 1 for flaky peers, which puts them after all the others, unless they're on
+// probation.
+func (h *DialHistory) penalty(p peer.ID) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.now()
+	s, ok := h.stats(p, now)
+	if !ok || s.Failures < h.cfg.MinFailures || s.Failures <= s.Successes {
+		return 0
+	}
+	if now.Sub(s.LastDial) >= h.cfg.Probation {
+		return 0
+	}
+	return 1
+}
+
+// stats returns the stats of p decayed to now, forgetting them if they're
+// too old to matter. The counts are stored as of the last dial. The caller
+// must hold the lock.
+func (h *DialHistory) stats(p peer.ID, now time.Time) (DialStats, bool) {
+	stored, ok := h.peers[p]
+	if !ok {
+		return DialStats{}, false
+	}
+	s := *stored
+	if elapsed := now.Sub(s.LastDial); elapsed > 0 {
+		decay := math.Exp2(-float64(elapsed) / float64(h.cfg.HalfLife))
+		s.Successes *= decay
+		s.Failures *= decay
+	}
+	if s.Successes+s.Failures < forgottenWeight {
+		h.forget(p)
+		return DialStats{}, false
+	}
+	return s, true
+}
+
+// makeRoom forgets the peer dialed the longest ago if the history is full.
+// The caller must hold the lock.
+func (h *DialHistory) makeRoom() {
+	if len(h.peers) < h.cfg.MaxPeers {
+		return
+	}
+	var oldest peer.ID
+	for p, s := range h.peers {
+		if oldest == "" || s.LastDial.Before(h.peers[oldest].LastDial) {
+			oldest = p
+		}
+	}
+	h.forget(oldest)
+}
+
+// put writes the stats of p through to the datastore. The caller must hold
+// the lock.
+func (h *DialHistory) put(p peer.ID, s *DialStats) {
+	b, err := json.Marshal(s)
+	if err == nil {
+		err = h.dstore.Put(dialHistoryKey(p), b)
+	}
+	if err != nil {
+		logger.Warningf("failed to store the dial stats of %s: %s", p, err)
+	}
+}
+
+// forget forgets p. The caller must hold the lock.
+func (h *DialHistory) forget(p peer.ID) {
+	delete(h.peers, p)
+	if err := h.dstore.Delete(dialHistoryKey(p)); err != nil && err != ds.ErrNotFound {
+		logger.Warningf("failed to delete the dial stats of %s: %s", p, err)
+	}
+}
+
+func dialHistoryKey(p peer.ID) ds.Key {
+	return dialHistoryPrefix.ChildString(peer.IDB58Encode(p))
+}
@@ -0,0 +1,131 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-testutil"
+)
+
+// newTestDialHistory returns a DialHistory over dstore whose clock only
+// moves with the returned function.
+func newTestDialHistory(t *testing.T, dstore ds.Datastore, cfg DialHistoryConfig) (*DialHistory, func(time.Duration)) {
+	h, err := NewDialHistory(dstore, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1500000000, 0)
+	h.now = func() time.Time { return now }
+	return h, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestDialHistoryOrdering(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	h, advance := newTestDialHistory(t, dssync.MutexWrap(ds.NewMapDatastore()), DefaultDialHistoryConfig)
+	d.dialHistory = h
+
+	peers := []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey("foo"))
+	flaky := sorted[0]
+	for i := 0; i < 3; i++ {
+		h.record(flaky, false)
+	}
+	h.record(flaky, true)
+
+	order := func() []peer.ID {
+		pq := d.newPeerQueue("foo", kb.ConvertKey("foo"))
+		for _, p := range peers {
+			pq.Enqueue(p)
+		}
+		var out []peer.ID
+		for pq.Len() > 0 {
+			out = append(out, pq.Dequeue())
+		}
+		return out
+	}
+
+	if got := order(); got[0] == flaky || got[2] != flaky {
+		t.Errorf("expected the flaky peer to be dialed last, got %v", got)
+	}
+
+	// flaky peers get a retry once on probation.
+	advance(DefaultDialHistoryConfig.Probation)
+	if got := order(); got[0] != flaky {
+		t.Errorf("expected the flaky peer on probation to be dialed first, got %v", got)
+	}
+
+	// and a successful one gets them out of trouble.
+	h.record(flaky, true)
+	h.record(flaky, true)
+	if got := order(); got[0] != flaky {
+		t.Errorf("expected the recovered peer to be dialed first, got %v", got)
+	}
+}
+
+func TestDialHistoryDecay(t *testing.T) {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	cfg := DefaultDialHistoryConfig
+	cfg.MaxPeers = 2
+	h, advance := newTestDialHistory(t, dstore, cfg)
+
+	p := tu.RandPeerIDFatal(t)
+	for i := 0; i < 4; i++ {
+		h.record(p, false)
+	}
+	if h.penalty(p) != 1 {
+		t.Fatal("expected the peer to be flaky")
+	}
+
+	// the failures halve with every half life, and so do their weight.
+	advance(cfg.HalfLife)
+	s, ok := h.Stats(p)
+	if !ok || s.Failures != 2 || s.LastFailure.IsZero() {
+		t.Fatalf("expected 2 failures after a half life, got %+v", s)
+	}
+	h.record(p, false)
+	if h.penalty(p) != 1 {
+		t.Fatal("expected the peer to be flaky again after a new failure")
+	}
+
+	// they survive restarts.
+	restarted, _ := newTestDialHistory(t, dstore, cfg)
+	restarted.now = h.now
+	if s, ok := restarted.Stats(p); !ok || s.Failures != 3 {
+		t.Fatalf("expected the 3 failures to survive a restart, got %+v", s)
+	}
+
+	// until they're forgotten.
+	advance(10 * cfg.HalfLife)
+	if _, ok := h.Stats(p); ok {
+		t.Error("expected the old failures to be forgotten")
+	}
+	if _, err := dstore.Get(dialHistoryKey(p)); err != ds.ErrNotFound {
+		t.Errorf("expected the forgotten stats to be deleted, got %v", err)
+	}
+
+	// the peers dialed the longest ago make room for new ones.
+	peers := []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)}
+	for _, p := range peers {
+		h.record(p, false)
+		advance(time.Second)
+	}
+	if _, ok := h.Stats(peers[0]); ok {
+		t.Error("expected the oldest peer to be forgotten")
+	}
+	for _, p := range peers[1:] {
+		if _, ok := h.Stats(p); !ok {
+			t.Errorf("expected %s to be tracked", p)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// DialFunc connects to the peer of pi, which holds the addresses we know of.
+type DialFunc func(ctx context.Context, pi pstore.PeerInfo) error
+
+// DialSuccessHook is called when a query got ready to query p: connected to
+// it, if it wasn't already, and agreed on a protocol version. rtt is how long
+// that took.
+type DialSuccessHook func(p peer.ID, rtt time.Duration)
+
+// DialFailureHook is called when a query failed to get ready to query p.
+type DialFailureHook func(p peer.ID, err error)
+
+// WithDialSuccessHook makes the query call f whenever it successfully dials a
+// peer. f is called synchronously, before the peer is queried, so it must not
+// block.
+func WithDialSuccessHook(f DialSuccessHook) QueryOption {
+	return func(q *dhtQuery) {
+		q.onDialSuccess = f
+	}
+}
+
+// WithDialFailureHook makes the query call f whenever it fails to dial a peer,
+// including when the dial is aborted because the query was cancelled. f is
+// called synchronously, so it must not block.
+func WithDialFailureHook(f DialFailureHook) QueryOption {
+	return func(q *dhtQuery) {
+		q.onDialFailure = f
+	}
+}
+
+// WithDialFunc makes the query connect to peers with f rather than with the
+// host, e.g. to test the query logic without any networking. f is also given
+// the peers we know no addresses of, and is expected to get the peers ready
+// to be queried: the query doesn't negotiate a protocol version with them.
+func WithDialFunc(f DialFunc) QueryOption {
+	return func(q *dhtQuery) {
+		q.dialFunc = f
+	}
+}
@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestDialHooks(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	good, bad := dhts[1].self, tu.RandPeerIDFatal(t)
+	refused, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dhts[0].peerstore.AddAddr(bad, refused, pstore.TempAddrTTL)
+
+	var (
+		mu        sync.Mutex
+		succeeded = make(map[peer.ID]time.Duration)
+		failed    = make(map[peer.ID]error)
+	)
+	query := dhts[0].newQuery("foo",
+		func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if _, ok := succeeded[p]; !ok {
+				t.Errorf("expected %s to be queried only after the success hook ran", p)
+			}
+			return &dhtQueryResult{}, nil
+		},
+		WithDialSuccessHook(func(p peer.ID, rtt time.Duration) {
+			mu.Lock()
+			defer mu.Unlock()
+			succeeded[p] = rtt
+		}),
+		WithDialFailureHook(func(p peer.ID, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			failed[p] = err
+		}),
+	)
+	if _, err := query.Run(ctx, []peer.ID{good, bad}); err != routing.ErrNotFound {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if rtt, ok := succeeded[good]; !ok || rtt <= 0 {
+		t.Errorf("expected the success hook to be called for %s with a round trip time, got %v", good, rtt)
+	}
+	if len(succeeded) != 1 {
+		t.Errorf("expected the success hook to be called once, got %v", succeeded)
+	}
+	if failed[bad] == nil || len(failed) != 1 {
+		t.Errorf("expected the failure hook to be called for %s only, got %v", bad, failed)
+	}
+}
+
+func TestQueryDialFunc(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	// fake peers that exist only as far as the dial and query functions go.
+	peers := make([]peer.ID, 5)
+	for i := range peers {
+		peers[i] = tu.RandPeerIDFatal(t)
+	}
+	a, b, c, unreachable, e := peers[0], peers[1], peers[2], peers[3], peers[4]
+	closer := map[peer.ID][]peer.ID{
+		a: {c, unreachable},
+		c: {e},
+	}
+
+	var (
+		mu      sync.Mutex
+		dialed  = make(map[peer.ID]bool)
+		queried = make(map[peer.ID]bool)
+	)
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried[p] = true
+		res := &dhtQueryResult{}
+		for _, next := range closer[p] {
+			res.closerPeers = append(res.closerPeers, &pstore.PeerInfo{ID: next})
+		}
+		return res, nil
+	}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		dialed[pi.ID] = true
+		if pi.ID == unreachable {
+			return routing.ErrNotFound
+		}
+		return nil
+	}))
+	res, err := query.Run(ctx, []peer.ID{a, b})
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range peers {
+		if !dialed[p] {
+			t.Errorf("expected %s to be dialed with the dial function", p)
+		}
+		if queried[p] == (p == unreachable) {
+			t.Errorf("expected only the reachable peers to be queried, got queried=%v for %s", queried[p], p)
+		}
+	}
+	if errs := res.PeerErrors(); len(errs) != 1 || errs[0].Peer != unreachable {
+		t.Errorf("expected the dial error of %s, got %v", unreachable, errs)
+	}
+}
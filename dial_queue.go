@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sync"
 	"time"
 
 	peer "github.com/libp2p/go-libp2p-peer"
@@ -26,6 +27,15 @@ const (
 	// DefaultDialQueueScalingFactor is the default factor by which the current number of workers will be multiplied
 	// or divided when upscaling and downscaling events occur, respectively.
 	DefaultDialQueueScalingFactor = 1.5
+	// DefaultDialQueueSuccessWindow is the default value for the number of recent dials the success rate of the
+	// queue is computed over.
+	DefaultDialQueueSuccessWindow = 10
+	// DefaultDialQueueLowSuccessRate is the default value for the success rate under which the queue grows straight
+	// to its max parallelism, and doesn't shrink, while there are peers left to dial.
+	DefaultDialQueueLowSuccessRate = 0.3
+	// DefaultDialQueueHighSuccessRate is the default value for the success rate from which the queue shrinks
+	// without waiting for the mute period.
+	DefaultDialQueueHighSuccessRate = 0.8
 )
 
 type dialQueue struct {
@@ -38,6 +48,28 @@ type dialQueue struct {
 	dieCh     chan struct{}
 	growCh    chan struct{}
 	shrinkCh  chan struct{}
+
+	// dialing tracks the dials in progress, see Wait.
+	dialing sync.WaitGroup
+	dialMu  sync.Mutex
+
+	// queued counts the peers in the input queue for the metrics, until the
+	// queue is closed.
+	queuedMu sync.Mutex
+	queued   int64
+	closed   bool
+
+	// workers counts the workers alive for the metrics, until the query is
+	// over.
+	workersMu sync.Mutex
+	workers   int64
+	over      bool
+
+	// outcomes are whether the last dials succeeded, in a ring buffer of the
+	// size of the success window.
+	outcomesMu sync.Mutex
+	outcomes   []bool
+	nOutcomes  int
 }
 
 type dqParams struct {
@@ -46,6 +78,20 @@ type dqParams struct {
 	dialFn func(context.Context, peer.ID) error
 	in     *queue.ChanQueue
 	config dqConfig
+	// metrics, if set, are updated with the workers, queued peers and dials
+	// of the queue.
+	metrics *dialQueueMetrics
+}
+
+// skippedDial is the error dialFn returns for the peers it skips without
+// dialing them. They say nothing about the network, so the queue counts them
+// neither as dials in its metrics nor in its success rate.
+type skippedDial struct {
+	err error // why the peer was skipped
+}
+
+func (e skippedDial) Error() string {
+	return e.err.Error()
 }
 
 type dqConfig struct {
@@ -61,6 +107,15 @@ type dqConfig struct {
 	mutePeriod time.Duration
 	// maxIdle is the period that a worker dial goroutine waits before signalling a worker pool downscaling.
 	maxIdle time.Duration
+	// successWindow is the number of recent dials the success rate is computed over. The success rate isn't taken
+	// into account until that many dials completed.
+	successWindow int
+	// lowSuccessRate is the success rate under which we grow straight to maxParallelism, and don't shrink, while
+	// there are peers left to dial: on networks where most dials fail fast, we need to try more candidates at a
+	// time to find the few reachable ones.
+	lowSuccessRate float64
+	// highSuccessRate is the success rate from which we shrink without waiting for the mute period.
+	highSuccessRate float64
 }
 
 // dqDefaultConfig returns the default configuration for dial queues. See const documentation to learn the default values.
@@ -71,6 +126,10 @@ func dqDefaultConfig() dqConfig {
 		scalingFactor:  DefaultDialQueueScalingFactor,
 		maxIdle:        DefaultDialQueueMaxIdle,
 		mutePeriod:     DefaultDialQueueScalingMutePeriod,
+
+		successWindow:   DefaultDialQueueSuccessWindow,
+		lowSuccessRate:  DefaultDialQueueLowSuccessRate,
+		highSuccessRate: DefaultDialQueueHighSuccessRate,
 	}
 }
 
@@ -82,6 +141,13 @@ func (dqc *dqConfig) validate() error {
 	if dqc.scalingFactor < 1 {
 		return fmt.Errorf("scalingFactor must be >= 1; actual value: %f", dqc.scalingFactor)
 	}
+	if dqc.successWindow < 1 {
+		return fmt.Errorf("successWindow must be >= 1; actual value: %d", dqc.successWindow)
+	}
+	if dqc.lowSuccessRate < 0 || dqc.lowSuccessRate > dqc.highSuccessRate || dqc.highSuccessRate > 1 {
+		return fmt.Errorf("success rates must be within [0, 1], the low one below the high one; actual values: low=%f, high=%f",
+			dqc.lowSuccessRate, dqc.highSuccessRate)
+	}
 	return nil
 }
 
@@ -106,6 +172,10 @@ type waitingCh struct {
 // - we scale down when we've been idle for a while waiting for new dial attempts.
 // - we scale down when we complete a dial and realise nobody was waiting for it.
 //
+// The recent dial success rate overrides those: when it's below config.lowSuccessRate, we grow straight to
+// config.maxParallelism and don't shrink as long as there are peers left to dial, and when it's at least
+// config.highSuccessRate, we shrink without waiting for the mute period.
+//
 // Dialler throttling (e.g. FD limit exceeded) is a concern, as we can easily spin up more workers to compensate, and
 // end up adding fuel to the fire. Since we have no deterministic way to detect this for now, we hard-limit concurrency
 // to config.maxParallelism.
@@ -118,6 +188,7 @@ func newDialQueue(params *dqParams) (*dialQueue, error) {
 		shrinkCh:  make(chan struct{}, 1),
 		waitingCh: make(chan waitingCh),
 		dieCh:     make(chan struct{}, params.config.maxParallelism),
+		outcomes:  make([]bool, params.config.successWindow),
 	}
 
 	for i := 0; i < int(params.config.minParallelism); i++ {
@@ -139,6 +210,7 @@ func (dq *dialQueue) control() {
 			close(w.ch)
 		}
 		waiting = nil
+		dq.closeQueued()
 	}()
 
 	for {
@@ -189,13 +261,22 @@ func (dq *dialQueue) control() {
 				dialled = nil
 			}
 		case <-dq.growCh:
+			if dq.struggling() {
+				dq.growTo(dq.config.maxParallelism)
+				lastScalingEvt = time.Now()
+				continue
+			}
 			if time.Since(lastScalingEvt) < dq.config.mutePeriod {
 				continue
 			}
 			dq.grow()
 			lastScalingEvt = time.Now()
 		case <-dq.shrinkCh:
-			if time.Since(lastScalingEvt) < dq.config.mutePeriod {
+			if dq.struggling() {
+				continue
+			}
+			if rate, ok := dq.successRate(); (!ok || rate < dq.config.highSuccessRate) &&
+				time.Since(lastScalingEvt) < dq.config.mutePeriod {
 				continue
 			}
 			dq.shrink()
@@ -239,7 +320,67 @@ func (dq *dialQueue) Consume() <-chan peer.ID {
 	return ch
 }
 
+// Ready hands over p, which we're already connected to, to the consumers as
+// soon as dialFn is done with it. It bypasses the dial workers, so that peers
+// that are ready to be queried don't wait for slow dials to complete.
+func (dq *dialQueue) Ready(p peer.ID) {
+	if !dq.startDial() {
+		return
+	}
+	go func() {
+		err := dq.dialFn(dq.ctx, p)
+		dq.dialing.Done()
+		if err != nil {
+			logger.Debugf("discarding connected peer because of error: %v", err)
+			return
+		}
+		select {
+		case dq.out.EnqChan <- p:
+		case <-dq.ctx.Done():
+		}
+	}()
+}
+
+// startDial accounts for a dial starting, unless the context is done
+// already: the query is over then, and no dial may start. The caller must
+// call dq.dialing.Done once the dial is done.
+func (dq *dialQueue) startDial() bool {
+	dq.dialMu.Lock()
+	defer dq.dialMu.Unlock()
+	// the context comes from a process, its Err is never nil.
+	select {
+	case <-dq.ctx.Done():
+		return false
+	default:
+	}
+	dq.dialing.Add(1)
+	return true
+}
+
+// Wait waits for the dials in progress to be aborted, so that none outlives
+// the query. It must only be called once the context is done.
+func (dq *dialQueue) Wait() {
+	// startDial doesn't start any dial once it sees the context done, and
+	// holding the lock orders the Adds that happened before it with Wait.
+	dq.dialMu.Lock()
+	dq.dialMu.Unlock()
+	dq.dialing.Wait()
+
+	// the workers left exit as soon as they see the context done, don't
+	// wait for them: remove them from the metrics right away.
+	dq.workersMu.Lock()
+	defer dq.workersMu.Unlock()
+	dq.over = true
+	dq.metrics.addWorkers(-dq.workers)
+	dq.workers = 0
+}
+
 func (dq *dialQueue) grow() {
+	// choosing not to worry about uint wrapping beyond max value.
+	dq.growTo(uint(math.Floor(float64(dq.nWorkers) * dq.config.scalingFactor)))
+}
+
+func (dq *dialQueue) growTo(target uint) {
 	// no mutex needed as this is only called from the (single-threaded) control loop.
 	defer func(prev uint) {
 		if prev == dq.nWorkers {
@@ -248,11 +389,6 @@ func (dq *dialQueue) grow() {
 		logger.Debugf("grew dial worker pool: %d => %d", prev, dq.nWorkers)
 	}(dq.nWorkers)
 
-	if dq.nWorkers == dq.config.maxParallelism {
-		return
-	}
-	// choosing not to worry about uint wrapping beyond max value.
-	target := uint(math.Floor(float64(dq.nWorkers) * dq.config.scalingFactor))
 	if target > dq.config.maxParallelism {
 		target = dq.config.maxParallelism
 	}
@@ -261,6 +397,39 @@ func (dq *dialQueue) grow() {
 	}
 }
 
+// recordOutcome records whether a dial succeeded for the success rate.
+func (dq *dialQueue) recordOutcome(success bool) {
+	dq.outcomesMu.Lock()
+	defer dq.outcomesMu.Unlock()
+	dq.outcomes[dq.nOutcomes%len(dq.outcomes)] = success
+	dq.nOutcomes++
+}
+
+// successRate returns the success rate of the last dials, if there were
+// enough of them.
+func (dq *dialQueue) successRate() (float64, bool) {
+	dq.outcomesMu.Lock()
+	defer dq.outcomesMu.Unlock()
+	if dq.nOutcomes < len(dq.outcomes) {
+		return 0, false
+	}
+	succeeded := 0
+	for _, ok := range dq.outcomes {
+		if ok {
+			succeeded++
+		}
+	}
+	return float64(succeeded) / float64(len(dq.outcomes)), true
+}
+
+// struggling returns whether most recent dials failed while there are peers
+// left to dial, so that we need more dials at a time to find the reachable
+// ones.
+func (dq *dialQueue) struggling() bool {
+	rate, ok := dq.successRate()
+	return ok && rate < dq.config.lowSuccessRate && dq.in.Queue.Len() > 0
+}
+
 func (dq *dialQueue) shrink() {
 	// no mutex needed as this is only called from the (single-threaded) control loop.
 	defer func(prev uint) {
@@ -287,7 +456,43 @@ func (dq *dialQueue) shrink() {
 	}
 }
 
+// AddQueued accounts for n peers added to the input queue, or removed from it
+// if negative, in the metrics.
+func (dq *dialQueue) AddQueued(n int64) {
+	dq.queuedMu.Lock()
+	defer dq.queuedMu.Unlock()
+	if dq.closed {
+		return
+	}
+	dq.queued += n
+	dq.metrics.addQueued(n)
+}
+
+// addWorkers accounts for n workers starting, or exiting if n is negative.
+func (dq *dialQueue) addWorkers(n int64) {
+	dq.workersMu.Lock()
+	defer dq.workersMu.Unlock()
+	if dq.over {
+		return
+	}
+	dq.workers += n
+	dq.metrics.addWorkers(n)
+}
+
+// closeQueued removes the peers left in the input queue from the metrics, as
+// nobody will dial them.
+func (dq *dialQueue) closeQueued() {
+	dq.queuedMu.Lock()
+	defer dq.queuedMu.Unlock()
+	dq.closed = true
+	dq.metrics.addQueued(-dq.queued)
+	dq.queued = 0
+}
+
 func (dq *dialQueue) worker() {
+	dq.addWorkers(1)
+	defer dq.addWorkers(-1)
+
 	// This idle timer tracks if the environment is slow. If we're waiting to long to acquire a peer to dial,
 	// it means that the DHT query is progressing slow and we should shrink the worker pool.
 	idleTimer := time.NewTimer(24 * time.Hour) // placeholder init value which will be overridden immediately.
@@ -319,10 +524,31 @@ func (dq *dialQueue) worker() {
 			if !ok {
 				return
 			}
+			dq.AddQueued(-1)
+			// don't start a dial if the query is over, even though a peer
+			// was ready too.
+			if !dq.startDial() {
+				return
+			}
 
 			t := time.Now()
-			if err := dq.dialFn(dq.ctx, p); err != nil {
+			err := dq.dialFn(dq.ctx, p)
+			dq.dialing.Done()
+			if _, ok := err.(skippedDial); ok {
+				logger.Debugf("discarding skipped peer: %v", err)
+				dq.metrics.dialSkipped()
+				continue
+			}
+			dq.metrics.dialDone(time.Since(t), err)
+			dq.recordOutcome(err == nil)
+			if err != nil {
 				logger.Debugf("discarding dialled peer because of error: %v", err)
+				if dq.struggling() {
+					select {
+					case dq.growCh <- struct{}{}:
+					default:
+					}
+				}
 				continue
 			}
 			logger.Debugf("dialling %v took %dms (as observed by the dht subsystem).", p, time.Since(t)/time.Millisecond)
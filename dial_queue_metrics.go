@@ -0,0 +1,137 @@
+package dht
+
+import (
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// dialLatencyBounds are the upper bounds of the buckets of the dial latency
+// histogram, the last bucket holding the slower dials.
+var dialLatencyBounds = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// DialQueueStats is a snapshot of the dial queues of the queries of a DHT,
+// see DialQueueStats.
+type DialQueueStats struct {
+	// Parallelism is the number of dial workers running.
+	Parallelism int
+	// Queued is the number of peers waiting for a dial worker.
+	Queued int
+
+	DialsStarted   uint64
+	DialsSucceeded uint64
+	DialsFailed    uint64
+	// DialsSkipped is the number of peers the queues didn't dial, as they
+	// were under dial backoff or the query moved past them for instance.
+	// They aren't counted as dials.
+	DialsSkipped uint64
+
+	// DialLatency is the histogram of the durations of the dials, successful
+	// or not.
+	DialLatency []LatencyBucket
+}
+
+// LatencyBucket counts the durations of a histogram up to UpperBound, and
+// above the upper bound of the previous bucket.
+type LatencyBucket struct {
+	UpperBound time.Duration // math.MaxInt64 for the last bucket
+	Count      uint64
+}
+
+// DialQueueStats returns the current state of the dial queues of the queries
+// of the DHT, and counts of the dials they made, to tell a starved queue from
+// a saturated one.
+func (dht *IpfsDHT) DialQueueStats() DialQueueStats {
+	return dht.dialMetrics.snapshot()
+}
+
+// dialQueueMetrics are the metrics of the dial queues of a DHT. All of its
+// methods are safe to call on a nil pointer.
+type dialQueueMetrics struct {
+	parallelism int64
+	queued      int64
+	started     uint64
+	succeeded   uint64
+	failed      uint64
+	skipped     uint64
+
+	mu      sync.Mutex
+	latency []uint64 // counts, one per bound and one for the slower dials
+}
+
+func newDialQueueMetrics() *dialQueueMetrics {
+	return &dialQueueMetrics{latency: make([]uint64, len(dialLatencyBounds)+1)}
+}
+
+func (m *dialQueueMetrics) addWorkers(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.parallelism, n)
+	}
+}
+
+func (m *dialQueueMetrics) addQueued(n int64) {
+	if m != nil {
+		atomic.AddInt64(&m.queued, n)
+	}
+}
+
+func (m *dialQueueMetrics) dialSkipped() {
+	if m != nil {
+		atomic.AddUint64(&m.skipped, 1)
+	}
+}
+
+func (m *dialQueueMetrics) dialDone(took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	atomic.AddUint64(&m.started, 1)
+	if err != nil {
+		atomic.AddUint64(&m.failed, 1)
+	} else {
+		atomic.AddUint64(&m.succeeded, 1)
+	}
+	i := 0
+	for i < len(dialLatencyBounds) && took > dialLatencyBounds[i] {
+		i++
+	}
+	m.mu.Lock()
+	m.latency[i]++
+	m.mu.Unlock()
+}
+
+func (m *dialQueueMetrics) snapshot() DialQueueStats {
+	if m == nil {
+		return DialQueueStats{}
+	}
+	s := DialQueueStats{
+		Parallelism:    int(atomic.LoadInt64(&m.parallelism)),
+		Queued:         int(atomic.LoadInt64(&m.queued)),
+		DialsStarted:   atomic.LoadUint64(&m.started),
+		DialsSucceeded: atomic.LoadUint64(&m.succeeded),
+		DialsFailed:    atomic.LoadUint64(&m.failed),
+		DialsSkipped:   atomic.LoadUint64(&m.skipped),
+		DialLatency:    make([]LatencyBucket, len(m.latency)),
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, n := range m.latency {
+		bound := time.Duration(math.MaxInt64)
+		if i < len(dialLatencyBounds) {
+			bound = dialLatencyBounds[i]
+		}
+		s.DialLatency[i] = LatencyBucket{UpperBound: bound, Count: n}
+	}
+	return s
+}
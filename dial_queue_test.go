@@ -2,13 +2,22 @@ package dht
 
 import (
 	"context"
+	"errors"
+	"reflect"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
 	queue "github.com/libp2p/go-libp2p-peerstore/queue"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	tu "github.com/libp2p/go-testutil"
 )
 
 func TestDialQueueGrowsOnSlowDials(t *testing.T) {
@@ -222,6 +231,187 @@ func TestDialQueueMutePeriodHonored(t *testing.T) {
 	waitForWg(t, &wg, 2*time.Second)
 }
 
+func TestDialQueueDialsCloserPeersFirst(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	in := queue.NewChanQueue(ctx, queue.NewXORDistancePQ("test"))
+	blocker := tu.RandPeerIDFatal(t)
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		peers = append(peers, tu.RandPeerIDFatal(t))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey("test"))
+	near, far := sorted[:5], sorted[5:]
+
+	var (
+		mu      sync.Mutex
+		dialed  []peer.ID
+		blocked = make(chan struct{})
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+	wg.Add(len(peers) + 1)
+	dialFn := func(ctx context.Context, p peer.ID) error {
+		defer wg.Done()
+		if p == blocker {
+			close(blocked)
+			<-release
+			return nil
+		}
+		mu.Lock()
+		dialed = append(dialed, p)
+		mu.Unlock()
+		return nil
+	}
+
+	config := dqDefaultConfig()
+	config.minParallelism, config.maxParallelism = 1, 1
+	if _, err := newDialQueue(&dqParams{
+		ctx:    ctx,
+		target: "test",
+		in:     in,
+		dialFn: dialFn,
+		config: config,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the far peers are discovered first, while the only worker is busy.
+	in.EnqChan <- blocker
+	<-blocked
+	for i := len(far) - 1; i >= 0; i-- {
+		in.EnqChan <- far[i]
+	}
+	for _, p := range near {
+		in.EnqChan <- p
+	}
+	close(release)
+	waitForWg(t, &wg, 5*time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if !reflect.DeepEqual(dialed, sorted) {
+		t.Errorf("expected the peers to be dialed closest first, got %v, want %v", dialed, sorted)
+	}
+}
+
+func TestDialQueueOption(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	for _, o := range []opts.Option{
+		opts.DialQueue(4, 2, time.Second, time.Second),
+		opts.DialQueue(0, 2, time.Second, time.Second),
+		opts.DialQueue(1, 2, 0, time.Second),
+		opts.DialQueue(1, 2, time.Second, 0),
+	} {
+		h := bhost.New(swarmt.GenSwarm(t, ctx))
+		if _, err := New(ctx, h, o); err == nil {
+			t.Error("expected a nonsensical dial queue config to be rejected")
+		}
+		h.Close()
+	}
+
+	const maxParallelism = 2
+	d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx)),
+		opts.DialQueue(1, maxParallelism, time.Second, 10*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+
+	// a seed returning many slow to dial fake peers, so that the dial queue
+	// is under pressure to grow.
+	seed := tu.RandPeerIDFatal(t)
+	var closer []*pstore.PeerInfo
+	for i := 0; i < 30; i++ {
+		closer = append(closer, &pstore.PeerInfo{ID: tu.RandPeerIDFatal(t)})
+	}
+	var (
+		mu            sync.Mutex
+		dialing, most int
+	)
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == seed {
+			return &dhtQueryResult{closerPeers: closer}, nil
+		}
+		return &dhtQueryResult{}, nil
+	}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		mu.Lock()
+		dialing++
+		if dialing > most {
+			most = dialing
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		dialing--
+		mu.Unlock()
+		return nil
+	}))
+	query.Run(ctx, []peer.ID{seed})
+
+	mu.Lock()
+	defer mu.Unlock()
+	if most > maxParallelism {
+		t.Errorf("expected at most %d dials at a time, got %d", maxParallelism, most)
+	}
+}
+
+func TestDialQueueStats(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	if s := d.DialQueueStats(); s.DialsStarted != 0 || s.Parallelism != 0 || s.Queued != 0 {
+		t.Fatalf("expected no dials before any query, got %+v", s)
+	}
+
+	// a seed returning fake peers, every other one of which fails to dial.
+	seed := tu.RandPeerIDFatal(t)
+	failing := make(map[peer.ID]bool)
+	var closer []*pstore.PeerInfo
+	for i := 0; i < 10; i++ {
+		p := tu.RandPeerIDFatal(t)
+		failing[p] = i%2 == 0
+		closer = append(closer, &pstore.PeerInfo{ID: p})
+	}
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == seed {
+			return &dhtQueryResult{closerPeers: closer}, nil
+		}
+		return &dhtQueryResult{}, nil
+	}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		if failing[pi.ID] {
+			return errors.New("unreachable")
+		}
+		return nil
+	}))
+	query.Run(ctx, []peer.ID{seed})
+
+	s := d.DialQueueStats()
+	if s.DialsStarted != 11 || s.DialsSucceeded != 6 || s.DialsFailed != 5 {
+		t.Errorf("expected 11 dials, 6 successful and 5 failed, got %+v", s)
+	}
+	var observed uint64
+	for _, b := range s.DialLatency {
+		observed += b.Count
+	}
+	if observed != s.DialsStarted {
+		t.Errorf("expected the latency of the %d dials, got %d in %v", s.DialsStarted, observed, s.DialLatency)
+	}
+	if s.Parallelism != 0 || s.Queued != 0 {
+		t.Errorf("expected no worker nor queued peer once the query is over, got %+v", s)
+	}
+}
+
 func waitForWg(t *testing.T, wg *sync.WaitGroup, wait time.Duration) {
 	t.Helper()
 
@@ -237,3 +427,103 @@ func waitForWg(t *testing.T, wg *sync.WaitGroup, wait time.Duration) {
 	case <-done:
 	}
 }
+
+func TestDialQueueGrowsOnLowSuccessRate(t *testing.T) {
+	// timeToK returns how long the dial queue takes to deliver k reachable
+	// peers out of many, 80% of which are unreachable.
+	timeToK := func(config dqConfig) time.Duration {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		const k = 40
+		in := queue.NewChanQueue(ctx, queue.NewXORDistancePQ("test"))
+		reachable := make(map[peer.ID]bool)
+		for i := 0; i < 10*k; i++ {
+			p := peer.ID(strconv.Itoa(i))
+			reachable[p] = i%5 == 0
+			in.EnqChan <- p
+		}
+		dq, err := newDialQueue(&dqParams{
+			ctx:    ctx,
+			target: "test",
+			in:     in,
+			dialFn: func(ctx context.Context, p peer.ID) error {
+				time.Sleep(10 * time.Millisecond)
+				if !reachable[p] {
+					return errors.New("unreachable")
+				}
+				return nil
+			},
+			config: config,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		start := time.Now()
+		for i := 0; i < k; i++ {
+			if _, ok := <-dq.Consume(); !ok {
+				t.Fatal("expected the dial queue to deliver a peer")
+			}
+		}
+		return time.Since(start)
+	}
+
+	// the success rate is never low enough to count for the previous policy.
+	idleOnly := dqDefaultConfig()
+	idleOnly.lowSuccessRate = 0
+	idleOnly.highSuccessRate = 1
+	before := timeToK(idleOnly)
+	after := timeToK(dqDefaultConfig())
+	t.Logf("time to K reachable peers: %s scaling on idle time only, %s on the success rate too", before, after)
+	if after >= before {
+		t.Errorf("expected scaling on the success rate to deliver the reachable peers faster, took %s rather than %s", after, before)
+	}
+}
+
+func TestDialQueueDoesntGrowOnSkippedPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// many peers, all of which are skipped: a query full of peers under dial
+	// backoff for instance.
+	const n = 100
+	in := queue.NewChanQueue(ctx, queue.NewXORDistancePQ("test"))
+	for i := 0; i < n; i++ {
+		in.EnqChan <- peer.ID(strconv.Itoa(i))
+	}
+	var wg sync.WaitGroup
+	wg.Add(n)
+
+	config := dqDefaultConfig()
+	config.minParallelism = 1
+	config.successWindow = 4
+	config.mutePeriod = time.Hour
+	config.maxIdle = time.Hour
+	metrics := newDialQueueMetrics()
+	if _, err := newDialQueue(&dqParams{
+		ctx:    ctx,
+		target: "test",
+		in:     in,
+		dialFn: func(ctx context.Context, p peer.ID) error {
+			defer wg.Done()
+			time.Sleep(time.Millisecond)
+			return skippedDial{errDialBackoff}
+		},
+		config:  config,
+		metrics: metrics,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	waitForWg(t, &wg, 5*time.Second)
+	// give the queue the time to grow, if it were to.
+	time.Sleep(50 * time.Millisecond)
+
+	s := metrics.snapshot()
+	if s.Parallelism != 1 {
+		t.Errorf("expected skipped peers not to grow the dial queue, got %d workers", s.Parallelism)
+	}
+	if s.DialsStarted != 0 || s.DialsFailed != 0 || s.DialsSkipped != n {
+		t.Errorf("expected %d skipped peers and no dial, got %+v", n, s)
+	}
+}
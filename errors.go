@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	"golang.org/x/xerrors"
+)
+
+// ErrLookupFailure is returned by a query when every peer it contacted
+// failed. It keeps the individual errors so that callers can tell a
+// cancelled lookup from a network failure or from peers that simply didn't
+// have what we asked for.
+type ErrLookupFailure struct {
+	// Errs holds one error per failed peer.
+	Errs []error
+}
+
+func (e *ErrLookupFailure) Error() string {
+	counts := make(map[string]int)
+	for _, err := range e.Errs {
+		counts[err.Error()]++
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		if counts[kinds[i]] != counts[kinds[j]] {
+			return counts[kinds[i]] > counts[kinds[j]]
+		}
+		return kinds[i] < kinds[j]
+	})
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%dx %s", counts[kind], kind)
+	}
+	return fmt.Sprintf("all %d queried peers failed: %s", len(e.Errs), strings.Join(kinds, ", "))
+}
+
+// Unwrap returns the most common per-peer error.
+func (e *ErrLookupFailure) Unwrap() error {
+	return mostCommonError(e.Errs)
+}
+
+// Is reports whether any of the per-peer errors matches target.
+func (e *ErrLookupFailure) Is(target error) bool {
+	for _, err := range e.Errs {
+		if xerrors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrDuplicateQuery is returned by a query that was rejected by the
+// QueryDeduplicator of the DHT, as the same query was started shortly before.
+var ErrDuplicateQuery = errors.New("duplicate query")
+
+// ErrDialTimeout is the error of the peers a query failed to dial within the
+// dial timeout of the DHT, see the DialTimeout DHT option, as opposed to the
+// peers that refused the connection.
+var ErrDialTimeout = errors.New("dial timed out")
+
+// ErrShuttingDown is returned by the queries started once the DHT started
+// shutting down, see Shutdown.
+var ErrShuttingDown = errors.New("dht is shutting down")
+
+// ErrInsufficientPeers is returned by a query that ran its course without
+// getting answers from as many peers as it required, see
+// WithMinSuccessfulPeers.
+type ErrInsufficientPeers struct {
+	Succeeded int // the number of peers that answered
+	Needed    int // the number of peers that had to
+}
+
+func (e *ErrInsufficientPeers) Error() string {
+	return fmt.Sprintf("only %d of the %d required peers answered the query", e.Succeeded, e.Needed)
+}
+
+// PeerError is the error a query got from dialing or querying a peer.
+type PeerError struct {
+	Peer peer.ID
+	Err  error
+	At   time.Time // when the error happened
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %s", e.Peer, e.Err)
+}
+
+func (e *PeerError) Unwrap() error {
+	return e.Err
+}
+
+// mostCommonError returns the error that occurs most often in errs, by message.
+func mostCommonError(errs []error) error {
+	var (
+		best  error
+		count = make(map[string]int)
+	)
+	for _, err := range errs {
+		count[err.Error()]++
+		if best == nil || count[err.Error()] > count[best.Error()] {
+			best = err
+		}
+	}
+	return best
+}
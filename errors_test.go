@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+func TestErrLookupFailure(t *testing.T) {
+	timeout := xerrors.Errorf("reading response: %w", context.DeadlineExceeded)
+	err := error(&ErrLookupFailure{Errs: []error{
+		routing.ErrNotFound,
+		routing.ErrNotFound,
+		timeout,
+	}})
+
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Error("expected the lookup failure to match a wrapped per-peer deadline")
+	}
+	if !xerrors.Is(err, routing.ErrNotFound) {
+		t.Error("expected the lookup failure to match not found")
+	}
+	if xerrors.Is(err, context.Canceled) {
+		t.Error("didn't expect the lookup failure to match a cancellation")
+	}
+	if xerrors.Unwrap(err) != routing.ErrNotFound {
+		t.Errorf("expected to unwrap to the most common error, got %v", xerrors.Unwrap(err))
+	}
+	if msg := err.Error(); !strings.Contains(msg, "2x "+routing.ErrNotFound.Error()) {
+		t.Errorf("expected the message to summarize the errors, got %q", msg)
+	}
+}
+
+func TestQueryAllPeersFail(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	var seeds []peer.ID
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+		seeds = append(seeds, d.self)
+	}
+
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return nil, xerrors.Errorf("querying %s: %w", p, context.DeadlineExceeded)
+	})
+	_, err := query.Run(ctx, seeds)
+
+	var lookupErr *ErrLookupFailure
+	if !xerrors.As(err, &lookupErr) {
+		t.Fatalf("expected an ErrLookupFailure, got %v", err)
+	}
+	if len(lookupErr.Errs) != len(seeds) {
+		t.Fatalf("expected %d per-peer errors, got %d", len(seeds), len(lookupErr.Errs))
+	}
+	if !xerrors.Is(err, context.DeadlineExceeded) {
+		t.Fatal("expected the lookup failure to match context.DeadlineExceeded")
+	}
+	if xerrors.Is(err, context.Canceled) {
+		t.Fatal("didn't expect the lookup failure to match context.Canceled")
+	}
+}
+
+func TestQueryPeerErrors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	var seeds []peer.ID
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+		seeds = append(seeds, d.self)
+	}
+	bad := seeds[0]
+
+	start := time.Now()
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == bad {
+			return nil, xerrors.Errorf("querying %s: %w", p, routing.ErrNotFound)
+		}
+		return &dhtQueryResult{}, nil
+	})
+	res, err := query.Run(ctx, seeds)
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected the query to find nothing, got %v", err)
+	}
+
+	errs := res.PeerErrors()
+	if len(errs) != 1 {
+		t.Fatalf("expected 1 peer error, got %d", len(errs))
+	}
+	pe := errs[0]
+	if pe.Peer != bad {
+		t.Errorf("expected the error of %s, got %s", bad, pe.Peer)
+	}
+	if pe.At.Before(start) {
+		t.Errorf("expected the error to be timestamped, got %s", pe.At)
+	}
+	if !xerrors.Is(&pe, routing.ErrNotFound) {
+		t.Error("expected the peer error to match its cause")
+	}
+	if !strings.Contains(pe.Error(), bad.String()) {
+		t.Errorf("expected the peer in the message, got %q", pe.Error())
+	}
+}
@@ -0,0 +1,141 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// Query event types published in addition to the ones defined by the
+// notifications package. They're numbered well clear of those so that new
+// upstream event types can't collide with them.
+const (
+	// QueryStarted is published when a lookup starts querying peers.
+	QueryStarted notif.QueryEventType = iota + 0x100
+	// QueryCompleted is published when a lookup finishes, whether it ran its
+	// course or was cancelled. Its Extra field holds the JSON encoded
+	// QueryStats of the lookup; use ParseQueryStats to decode them.
+	QueryCompleted
+	// QueryCanceled is published as soon as the context of a lookup is
+	// cancelled, before the lookup winds down and publishes QueryCompleted.
+	QueryCanceled
+	// RoutingTableRefresh is published, on the context the DHT was created
+	// with, when the routing table shrank below the auto refresh threshold
+	// and the DHT looks itself up to repopulate it. Its Extra field holds the
+	// size the routing table was down to.
+	RoutingTableRefresh
+)
+
+// The Extra field of the notif.FinalPeer events published for every peer a
+// lookup for the closest peers returns tells how the peer was confirmed.
+const (
+	// FinalPeerQueried peers answered the lookup itself.
+	FinalPeerQueried = "queried"
+	// FinalPeerResumed peers answered the interrupted lookup a resumed one
+	// picked up from, see ResumeQuery, and weren't queried again.
+	FinalPeerResumed = "resumed"
+)
+
+// CancellationReason tells why a lookup was cancelled.
+type CancellationReason int
+
+const (
+	// NotCanceled lookups ran their course.
+	NotCanceled CancellationReason = iota
+	// ContextTimeout lookups ran past the deadline of their context.
+	ContextTimeout
+	// ContextCanceled lookups had their context cancelled by the caller.
+	ContextCanceled
+	// ManualCancel lookups were stopped with their Cancel method.
+	ManualCancel
+)
+
+func (r CancellationReason) String() string {
+	switch r {
+	case NotCanceled:
+		return "not canceled"
+	case ContextTimeout:
+		return "context timeout"
+	case ContextCanceled:
+		return "context canceled"
+	case ManualCancel:
+		return "manual cancel"
+	default:
+		return fmt.Sprintf("CancellationReason(%d)", int(r))
+	}
+}
+
+// QueryStats summarizes a finished lookup.
+type QueryStats struct {
+	PeersSeen          int                // peers added to the query
+	PeersQueried       int                // peers the query function was run against
+	PeersFailed        int                // peers that couldn't be dialed or queried
+	PeersNoAddrs       int                // peers skipped as we knew no addresses for them
+	Duration           time.Duration      // time from start to completion
+	CancellationReason CancellationReason // why the lookup was cancelled, if it was
+}
+
+// ParseQueryStats decodes the stats carried by a QueryCompleted event.
+func ParseQueryStats(ev *notif.QueryEvent) (*QueryStats, error) {
+	if ev.Type != QueryCompleted {
+		return nil, fmt.Errorf("expected a query completed event, got event type %d", ev.Type)
+	}
+	var stats QueryStats
+	if err := json.Unmarshal([]byte(ev.Extra), &stats); err != nil {
+		return nil, err
+	}
+	return &stats, nil
+}
+
+// publishCompleted publishes the QueryCompleted event of the query.
+func (q *dhtQuery) publishCompleted(ctx context.Context, stats *QueryStats) {
+	extra, err := json.Marshal(stats)
+	if err != nil {
+		logger.Errorf("failed to encode query stats: %s", err)
+		return
+	}
+	// deliver the event even if the query itself was cancelled.
+	q.publish(detachedContext{ctx}, &notif.QueryEvent{
+		Type:  QueryCompleted,
+		Extra: string(extra),
+	})
+}
+
+// QueryEventFilter tells whether a query publishes an event, see
+// WithQueryEventFilter.
+type QueryEventFilter func(*notif.QueryEvent) bool
+
+// WithQueryEventFilter makes the query publish only the events f returns
+// true for, sparing busy nodes the events nobody listens to.
+func WithQueryEventFilter(f QueryEventFilter) QueryOption {
+	return func(q *dhtQuery) {
+		q.eventFilter = f
+	}
+}
+
+// SuppressDialEvents is a QueryEventFilter that drops the notif.DialingPeer
+// events, the most frequent ones.
+func SuppressDialEvents() QueryEventFilter {
+	return func(ev *notif.QueryEvent) bool {
+		return ev.Type != notif.DialingPeer
+	}
+}
+
+// publish publishes ev to the listeners of ctx, unless the event filter of
+// the query drops it.
+func (q *dhtQuery) publish(ctx context.Context, ev *notif.QueryEvent) {
+	if q.eventFilter != nil && !q.eventFilter(ev) {
+		return
+	}
+	notif.PublishQueryEvent(ctx, ev)
+}
+
+// detachedContext carries the values of its parent but never expires.
+type detachedContext struct{ context.Context }
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
@@ -0,0 +1,275 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestQueryStartedCompletedEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	seeds := []peer.ID{dhts[1].self, dhts[2].self}
+
+	// collect runs a query with the given timeout and returns the events it
+	// published.
+	collect := func(timeout time.Duration, f queryFunc) []*notif.QueryEvent {
+		evctx, evcancel := context.WithCancel(ctx)
+		evctx, events := notif.RegisterForQueryEvents(evctx)
+		done := make(chan []*notif.QueryEvent)
+		go func() {
+			var evs []*notif.QueryEvent
+			for ev := range events {
+				evs = append(evs, ev)
+			}
+			done <- evs
+		}()
+		qctx, qcancel := context.WithTimeout(evctx, timeout)
+		dhts[0].newQuery("foo", f).Run(qctx, seeds)
+		qcancel()
+		evcancel()
+		return <-done
+	}
+
+	evs := collect(time.Minute, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == dhts[2].self {
+			return nil, routing.ErrNotFound
+		}
+		return &dhtQueryResult{}, nil
+	})
+	if len(evs) < 2 || evs[0].Type != QueryStarted || evs[len(evs)-1].Type != QueryCompleted {
+		t.Fatalf("expected the events to be bracketed by start and completion, got %v", evs)
+	}
+	for _, ev := range evs {
+		if ev.Type == QueryCanceled {
+			t.Fatal("expected no cancellation event for a query that ran its course")
+		}
+	}
+	stats, err := ParseQueryStats(evs[len(evs)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.PeersSeen != 2 || stats.PeersQueried != 2 || stats.PeersFailed != 1 || stats.Duration <= 0 || stats.CancellationReason != NotCanceled {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// a cancelled query still reports its completion.
+	evs = collect(50*time.Millisecond, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+	if len(evs) == 0 || evs[len(evs)-1].Type != QueryCompleted {
+		t.Fatalf("expected a completion event for the cancelled query, got %v", evs)
+	}
+	canceled := false
+	for _, ev := range evs {
+		canceled = canceled || ev.Type == QueryCanceled
+	}
+	if !canceled {
+		t.Fatalf("expected a cancellation event before the completion, got %v", evs)
+	}
+	if _, err := ParseQueryStats(evs[0]); err == nil {
+		t.Fatal("expected only completion events to carry stats")
+	}
+}
+
+func TestQueryCancellationReason(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// stats runs a query with the given timeout that waits to be cancelled,
+	// stops it with stop once it's querying, and returns the stats it
+	// published.
+	stats := func(timeout time.Duration, stop func(*dhtQuery, context.CancelFunc)) *QueryStats {
+		evctx, evcancel := context.WithCancel(ctx)
+		evctx, events := notif.RegisterForQueryEvents(evctx)
+		done := make(chan *QueryStats, 1)
+		go func() {
+			var stats *QueryStats
+			for ev := range events {
+				if ev.Type == QueryCompleted {
+					stats, _ = ParseQueryStats(ev)
+				}
+			}
+			done <- stats
+		}()
+
+		qctx, qcancel := context.WithTimeout(evctx, timeout)
+		defer qcancel()
+		started := make(chan struct{}, 1)
+		query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			started <- struct{}{}
+			<-ctx.Done()
+			return nil, ctx.Err()
+		})
+		go func() {
+			<-started
+			stop(query, qcancel)
+		}()
+		query.Run(qctx, []peer.ID{dhts[1].self})
+		evcancel()
+		s := <-done
+		if s == nil {
+			t.Fatal("expected a completion event")
+		}
+		return s
+	}
+
+	wait := func(*dhtQuery, context.CancelFunc) {}
+	if r := stats(50*time.Millisecond, wait).CancellationReason; r != ContextTimeout {
+		t.Errorf("expected a timed out query to report %s, got %s", ContextTimeout, r)
+	}
+	cancelContext := func(_ *dhtQuery, cancel context.CancelFunc) { cancel() }
+	if r := stats(time.Minute, cancelContext).CancellationReason; r != ContextCanceled {
+		t.Errorf("expected a query with a cancelled context to report %s, got %s", ContextCanceled, r)
+	}
+	cancelQuery := func(q *dhtQuery, _ context.CancelFunc) { q.Cancel() }
+	if r := stats(time.Minute, cancelQuery).CancellationReason; r != ManualCancel {
+		t.Errorf("expected a query stopped with Cancel to report %s, got %s", ManualCancel, r)
+	}
+}
+
+func TestFinalPeerEvents(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+
+	// lookup runs the lookup of f and returns the peers it returned and the
+	// confirmation of every final peer event it published.
+	lookup := func(f func(context.Context) (<-chan peer.ID, error)) ([]peer.ID, map[peer.ID]string) {
+		evctx, evcancel := context.WithCancel(ctx)
+		evctx, events := notif.RegisterForQueryEvents(evctx)
+		done := make(chan map[peer.ID]string)
+		go func() {
+			final := make(map[peer.ID]string)
+			for ev := range events {
+				if ev.Type == notif.FinalPeer {
+					if _, ok := final[ev.ID]; ok {
+						t.Errorf("got two final peer events for %s", ev.ID)
+					}
+					final[ev.ID] = ev.Extra
+				}
+			}
+			done <- final
+		}()
+		ch, err := f(evctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var peers []peer.ID
+		for p := range ch {
+			peers = append(peers, p)
+		}
+		evcancel()
+		return peers, <-done
+	}
+
+	peers, final := lookup(func(ctx context.Context) (<-chan peer.ID, error) {
+		return dhts[0].GetClosestPeers(ctx, "foo")
+	})
+	if len(peers) == 0 || len(final) != len(peers) {
+		t.Fatalf("expected one final peer event per peer of %v, got %v", peers, final)
+	}
+	for _, p := range peers {
+		if final[p] != FinalPeerQueried {
+			t.Errorf("expected %s to be confirmed by a query, got %q", p, final[p])
+		}
+	}
+
+	// resume a lookup that already queried dhts[1].
+	cp := &QueryCheckpoint{Key: "foo", Queried: []peer.ID{dhts[1].self}, Frontier: []peer.ID{dhts[2].self}}
+	peers, final = lookup(func(ctx context.Context) (<-chan peer.ID, error) {
+		return dhts[0].ResumeQuery(ctx, "foo", cp)
+	})
+	if len(final) != len(peers) {
+		t.Fatalf("expected one final peer event per peer of %v, got %v", peers, final)
+	}
+	for _, p := range peers {
+		want := FinalPeerQueried
+		if p == dhts[1].self {
+			want = FinalPeerResumed
+		}
+		if final[p] != want {
+			t.Errorf("expected %s to be %s, got %q", p, want, final[p])
+		}
+	}
+	if _, ok := final[dhts[1].self]; !ok {
+		t.Errorf("expected the resumed peer among the final peers, got %v", final)
+	}
+}
+
+func TestQueryEventFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	seeds := []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)}
+	count := func(options ...QueryOption) map[notif.QueryEventType]int {
+		evctx, evcancel := context.WithCancel(ctx)
+		evctx, events := notif.RegisterForQueryEvents(evctx)
+		done := make(chan map[notif.QueryEventType]int)
+		go func() {
+			counts := make(map[notif.QueryEventType]int)
+			for ev := range events {
+				counts[ev.Type]++
+			}
+			done <- counts
+		}()
+		options = append(options, WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil }))
+		d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			return &dhtQueryResult{}, nil
+		}, options...).Run(evctx, seeds)
+		evcancel()
+		return <-done
+	}
+
+	all := count()
+	if all[notif.DialingPeer] != len(seeds) || all[notif.AddingPeer] != len(seeds) || all[QueryCompleted] != 1 {
+		t.Fatalf("expected dialing and adding events for every seed, got %v", all)
+	}
+	filtered := count(WithQueryEventFilter(SuppressDialEvents()))
+	if filtered[notif.DialingPeer] != 0 {
+		t.Errorf("expected no dialing events, got %d", filtered[notif.DialingPeer])
+	}
+	if filtered[notif.AddingPeer] != len(seeds) || filtered[QueryCompleted] != 1 {
+		t.Errorf("expected the other events to be published, got %v", filtered)
+	}
+}
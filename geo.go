@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"math"
+	"net"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// GeoLookup locates an IP address, typically with an IP geolocation
+// database. It returns the latitude and longitude of the address, in degrees.
+type GeoLookup func(ip net.IP) (lat, lon float64)
+
+// geoAwareness configures a geo-aware DHT, see WithGeoAwareness.
+type geoAwareness struct {
+	lookup GeoLookup
+	blend  float64 // 0 is pure XOR distance, 1 pure geographic distance
+}
+
+// locate returns the location of p, if we know an IP address of it.
+func (dht *IpfsDHT) locate(p peer.ID) (lat, lon float64, ok bool) {
+	ip := firstIP(dht.peerstore.Addrs(p))
+	if ip == nil {
+		return 0, 0, false
+	}
+	lat, lon = dht.geo.lookup(ip)
+	return lat, lon, true
+}
+
+// firstIP returns the first non-loopback IP in addrs, or the first loopback
+// one if there are no others.
+func firstIP(addrs []ma.Multiaddr) net.IP {
+	var loopback net.IP
+	for _, a := range addrs {
+		s, err := a.ValueForProtocol(ma.P_IP4)
+		if err != nil {
+			s, err = a.ValueForProtocol(ma.P_IP6)
+		}
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(s)
+		switch {
+		case ip == nil:
+		case !ip.IsLoopback():
+			return ip
+		case loopback == nil:
+			loopback = ip
+		}
+	}
+	return loopback
+}
+
+// haversine returns the central angle between two points on a sphere, in
+// radians, given their latitudes and longitudes in degrees.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	const rad = math.Pi / 180
+	dlat := (lat2 - lat1) * rad
+	dlon := (lon2 - lon1) * rad
+	a := math.Pow(math.Sin(dlat/2), 2) +
+		math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Pow(math.Sin(dlon/2), 2)
+	return 2 * math.Asin(math.Sqrt(math.Min(a, 1)))
+}
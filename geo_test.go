@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"math"
+	"net"
+	"testing"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	queue "github.com/libp2p/go-libp2p-peerstore/queue"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func drainQueue(pq queue.PeerQueue) []peer.ID {
+	var out []peer.ID
+	for pq.Len() > 0 {
+		out = append(out, pq.Dequeue())
+	}
+	return out
+}
+
+func TestGeoDistancePQ(t *testing.T) {
+	const key = "foo"
+	peers := make([]peer.ID, 8)
+	for i := range peers {
+		peers[i] = tu.RandPeerIDFatal(t)
+	}
+	xorOrder := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+
+	// the farther from the key, the closer to us, at longitude 0.
+	lons := make(map[peer.ID]float64)
+	for i, p := range xorOrder {
+		lons[p] = float64(len(xorOrder)-i) * 10
+	}
+	newPQ := func(blend float64) queue.PeerQueue {
+		return &distancePQ{
+			from:    kb.ConvertKey(key),
+			blend:   blend,
+			located: true,
+			locate: func(p peer.ID) (float64, float64, bool) {
+				return 0, lons[p], true
+			},
+		}
+	}
+
+	pq := newPQ(0)
+	for _, p := range peers {
+		pq.Enqueue(p)
+	}
+	for i, p := range drainQueue(pq) {
+		if p != xorOrder[i] {
+			t.Fatalf("expected a blend of 0 to order peers by XOR distance")
+		}
+	}
+
+	pq = newPQ(1)
+	for _, p := range peers {
+		pq.Enqueue(p)
+	}
+	for i, p := range drainQueue(pq) {
+		if p != xorOrder[len(xorOrder)-1-i] {
+			t.Fatalf("expected a blend of 1 to order peers by geographic distance")
+		}
+	}
+}
+
+func TestGeoDistancePQUnlocated(t *testing.T) {
+	near, nowhere := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	pq := &distancePQ{
+		from:    kb.ConvertKey("foo"),
+		blend:   1,
+		located: true,
+		locate: func(p peer.ID) (float64, float64, bool) {
+			return 0, 0, p == near
+		},
+	}
+	pq.Enqueue(nowhere)
+	pq.Enqueue(near)
+	if p := pq.Dequeue(); p != near {
+		t.Fatal("expected peers we can't locate to come last")
+	}
+}
+
+func TestHaversine(t *testing.T) {
+	if d := haversine(0, 0, 0, 180); math.Abs(d-math.Pi) > 1e-9 {
+		t.Errorf("expected antipodes to be pi radians apart, got %v", d)
+	}
+	// Paris to New York, about 5837km.
+	if d := haversine(48.8566, 2.3522, 40.7128, -74.0060) * 6371; math.Abs(d-5837) > 10 {
+		t.Errorf("expected about 5837km, got %v", d)
+	}
+}
+
+func TestGeoAwarenessOption(t *testing.T) {
+	lookup := func(net.IP) (float64, float64) { return 0, 0 }
+	for _, blend := range []float64{-0.1, 1.1} {
+		if err := WithGeoAwareness(lookup, blend)(&opts.Options{}); err == nil {
+			t.Errorf("expected a blend of %v to be rejected", blend)
+		}
+	}
+	if err := WithGeoAwareness(nil, 0.5)(&opts.Options{}); err == nil {
+		t.Error("expected a nil lookup to be rejected")
+	}
+	if err := WithGeoAwareness(lookup, 0.5)(&opts.Options{}); err != nil {
+		t.Error(err)
+	}
+}
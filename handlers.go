@@ -1,7 +1,6 @@
 package dht
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
@@ -20,6 +19,9 @@ import (
 )
 
 // The number of closer peers to send on requests.
+//
+// Deprecated: this is only the default for DHTs that use the default K; DHTs
+// constructed with the KValue option send K closer peers instead.
 var CloserPeerCount = KValue
 
 // dhthandler specifies the signature of functions that handle DHT messages.
@@ -67,7 +69,7 @@ func (dht *IpfsDHT) handleGetValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 	resp.Record = rec
 
 	// Find closest peer on given cluster to desired key and reply with that info
-	closer := dht.betterPeersToQuery(pmes, p, CloserPeerCount)
+	closer := dht.betterPeersToQuery(pmes, p, dht.closerPeerCount)
 	if len(closer) > 0 {
 		closerinfos := pstore.PeerInfos(dht.peerstore, closer)
 		for _, pi := range closerinfos {
@@ -156,7 +158,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, errors.New("nil record")
 	}
 
-	if !bytes.Equal(pmes.GetKey(), rec.GetKey()) {
+	if string(pmes.GetKey()) != dht.transformKey(string(rec.GetKey())) {
 		return nil, errors.New("put key doesn't match record key")
 	}
 
@@ -168,7 +170,7 @@ func (dht *IpfsDHT) handlePutValue(ctx context.Context, p peer.ID, pmes *pb.Mess
 		return nil, err
 	}
 
-	dskey := convertToDsKey(rec.GetKey())
+	dskey := convertToDsKey(pmes.GetKey())
 
 	// Make sure the new record is "better" than the record we have locally.
 	// This prevents a record with for example a lower sequence number from
@@ -251,7 +253,7 @@ func (dht *IpfsDHT) handleFindPeer(ctx context.Context, p peer.ID, pmes *pb.Mess
 	if targetPid == dht.self {
 		closest = []peer.ID{dht.self}
 	} else {
-		closest = dht.betterPeersToQuery(pmes, p, CloserPeerCount)
+		closest = dht.betterPeersToQuery(pmes, p, dht.closerPeerCount)
 
 		// Never tell a peer about itself.
 		if targetPid != p {
@@ -327,7 +329,7 @@ func (dht *IpfsDHT) handleGetProviders(ctx context.Context, p peer.ID, pmes *pb.
 	}
 
 	// Also send closer peers.
-	closer := dht.betterPeersToQuery(pmes, p, CloserPeerCount)
+	closer := dht.betterPeersToQuery(pmes, p, dht.closerPeerCount)
 	if closer != nil {
 		infos := pstore.PeerInfos(dht.peerstore, closer)
 		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"runtime"
+	"sync"
+	"time"
+
+	process "github.com/jbenet/goprocess"
+)
+
+// idleGC runs the garbage collector once the DHT has gone without queries for
+// a while, so that the garbage left behind by a burst of queries is collected
+// while nobody is waiting on us rather than during the next query.
+type idleGC struct {
+	threshold time.Duration
+	gc        func() // runtime.GC, replaceable in tests
+
+	mu         sync.Mutex
+	active     int       // queries in flight
+	lastActive time.Time // when the last query finished
+	collected  bool      // whether we've already collected in this idle period
+}
+
+func newIdleGC(threshold time.Duration) *idleGC {
+	return &idleGC{
+		threshold:  threshold,
+		gc:         runtime.GC,
+		lastActive: time.Now(),
+		collected:  true, // nothing to collect before the first query
+	}
+}
+
+func (g *idleGC) queryStarted() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active++
+	g.collected = false
+}
+
+func (g *idleGC) queryFinished() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.active--
+	g.lastActive = time.Now()
+}
+
+// maybeCollect runs the garbage collector if we've been idle for long enough
+// and haven't collected yet in this idle period.
+func (g *idleGC) maybeCollect(now time.Time) bool {
+	g.mu.Lock()
+	if g.collected || g.active > 0 || now.Sub(g.lastActive) < g.threshold {
+		g.mu.Unlock()
+		return false
+	}
+	g.collected = true
+	g.mu.Unlock()
+
+	logger.Debugf("no queries for %s, running the garbage collector", g.threshold)
+	g.gc()
+	return true
+}
+
+func (g *idleGC) loop(proc process.Process) {
+	tick := time.NewTicker(g.threshold / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			g.maybeCollect(now)
+		case <-proc.Closing():
+			return
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIdleGC(t *testing.T) {
+	g := newIdleGC(time.Minute)
+	var runs int
+	g.gc = func() { runs++ }
+
+	now := time.Now()
+	if g.maybeCollect(now.Add(time.Hour)) {
+		t.Fatal("didn't expect to collect before any query ran")
+	}
+
+	g.queryStarted()
+	if g.maybeCollect(now.Add(time.Hour)) {
+		t.Fatal("didn't expect to collect while a query is running")
+	}
+	g.queryFinished()
+
+	now = time.Now()
+	if g.maybeCollect(now.Add(time.Second)) {
+		t.Fatal("didn't expect to collect before the idle threshold")
+	}
+	if !g.maybeCollect(now.Add(2 * time.Minute)) {
+		t.Fatal("expected to collect after the idle threshold")
+	}
+	if g.maybeCollect(now.Add(time.Hour)) {
+		t.Fatal("expected to collect only once per idle period")
+	}
+
+	g.queryStarted()
+	g.queryFinished()
+	if !g.maybeCollect(time.Now().Add(2 * time.Minute)) {
+		t.Fatal("expected to collect again after the next idle period")
+	}
+	if runs != 2 {
+		t.Fatalf("expected 2 collections, got %d", runs)
+	}
+}
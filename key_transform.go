@@ -0,0 +1,28 @@
+package dht
+
+import (
+	"crypto/sha256"
+)
+
+// KeyTransform maps the key of a value record to the key the DHT stores it
+// under. The transformed key is the one sent over the wire and the one XOR
+// distances are computed from, while the record itself keeps its original key
+// so that it can be validated. All the nodes of a network must use the same
+// transform.
+type KeyTransform func(key string) string
+
+// SHA256KeyTransform stores records under the SHA256 of their keys, so that
+// the peers a lookup goes through can't tell what it's looking for without
+// already knowing the key.
+func SHA256KeyTransform(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return string(sum[:])
+}
+
+// transformKey returns the key the record of key is stored under.
+func (dht *IpfsDHT) transformKey(key string) string {
+	if dht.keyTransform == nil {
+		return key
+	}
+	return dht.keyTransform(key)
+}
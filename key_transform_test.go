@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestKeyTransform(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts {
+		d.keyTransform = SHA256KeyTransform
+	}
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	if err := dhts[0].PutValue(ctx, "/v/hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the peer the record was put to stores it under the hashed key only.
+	wireKey := SHA256KeyTransform("/v/hello")
+	if has, _ := dhts[1].datastore.Has(mkDsKey(wireKey)); !has {
+		t.Error("expected the record to be stored under the transformed key")
+	}
+	if has, _ := dhts[1].datastore.Has(mkDsKey("/v/hello")); has {
+		t.Error("expected the record not to be stored under its key")
+	}
+
+	val, err := dhts[2].GetValue(ctx, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "world" {
+		t.Fatalf("expected 'world', got %q", val)
+	}
+}
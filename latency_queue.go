@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"sync"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	queue "github.com/libp2p/go-libp2p-peerstore/queue"
+)
+
+// QueueFactory creates the queue that orders the peers a query for key
+// dials and queries. ps is the peerstore of the DHT. The queues must be safe
+// for concurrent use.
+type QueueFactory func(key string, ps pstore.Peerstore) queue.PeerQueue
+
+// latencyBuckets are the upper bounds of the expected latency of the peers
+// in each bucket of a latency round-robin queue, but the last one.
+var latencyBuckets = []time.Duration{10 * time.Millisecond, 100 * time.Millisecond}
+
+// NewLatencyRoundRobinPQ returns a PeerQueue that groups peers by expected
+// latency, estimated from the latency the peerstore recorded for them: under
+// 10ms, 10ms to 100ms, and over 100ms. It takes turns dequeueing from each
+// group, closest to key first within a group, so that fast and slow dials are
+// always in flight together rather than the slow peers bunching up. Peers of
+// unknown latency go with the middle group.
+//
+// It's a QueueFactory, see WithQueueFactory.
+func NewLatencyRoundRobinPQ(key string, ps pstore.Peerstore) queue.PeerQueue {
+	pq := &latencyRoundRobinPQ{
+		ps:      ps,
+		buckets: make([]queue.PeerQueue, len(latencyBuckets)+1),
+	}
+	for i := range pq.buckets {
+		pq.buckets[i] = queue.NewXORDistancePQ(key)
+	}
+	return pq
+}
+
+type latencyRoundRobinPQ struct {
+	ps pstore.Peerstore
+
+	mu      sync.Mutex
+	buckets []queue.PeerQueue
+	next    int // the bucket to dequeue from next, if it isn't empty
+}
+
+var _ QueueFactory = NewLatencyRoundRobinPQ
+
+func (pq *latencyRoundRobinPQ) bucket(p peer.ID) int {
+	latency := pq.ps.LatencyEWMA(p)
+	if latency == 0 {
+		return 1
+	}
+	for i, max := range latencyBuckets {
+		if latency < max {
+			return i
+		}
+	}
+	return len(latencyBuckets)
+}
+
+func (pq *latencyRoundRobinPQ) Len() int {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	n := 0
+	for _, b := range pq.buckets {
+		n += b.Len()
+	}
+	return n
+}
+
+func (pq *latencyRoundRobinPQ) Enqueue(p peer.ID) {
+	i := pq.bucket(p)
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	pq.buckets[i].Enqueue(p)
+}
+
+func (pq *latencyRoundRobinPQ) Dequeue() peer.ID {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+	for range pq.buckets {
+		b := pq.buckets[pq.next]
+		pq.next = (pq.next + 1) % len(pq.buckets)
+		if b.Len() > 0 {
+			return b.Dequeue()
+		}
+	}
+	panic("called Dequeue on an empty PeerQueue")
+}
@@ -0,0 +1,55 @@
+package dht
+
+import (
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestLatencyRoundRobinPQ(t *testing.T) {
+	const key = "foo"
+	ps := pstoremem.NewPeerstore()
+	var fast, medium, slow, unknown []peer.ID
+	for i := 0; i < 3; i++ {
+		for _, c := range []struct {
+			peers   *[]peer.ID
+			latency time.Duration
+		}{{&fast, time.Millisecond}, {&medium, 50 * time.Millisecond}, {&slow, time.Second}, {&unknown, 0}} {
+			p := tu.RandPeerIDFatal(t)
+			if c.latency > 0 {
+				ps.RecordLatency(p, c.latency)
+			}
+			*c.peers = append(*c.peers, p)
+		}
+	}
+
+	pq := NewLatencyRoundRobinPQ(key, ps)
+	for _, peers := range [][]peer.ID{slow, unknown, medium, fast} {
+		for _, p := range peers {
+			pq.Enqueue(p)
+		}
+	}
+	if n := pq.Len(); n != 12 {
+		t.Fatalf("expected 12 peers, got %d", n)
+	}
+
+	id := kb.ConvertKey(key)
+	fast = kb.SortClosestPeers(fast, id)
+	mid := kb.SortClosestPeers(append(medium, unknown...), id)
+	slow = kb.SortClosestPeers(slow, id)
+	var expected []peer.ID
+	for i := 0; i < 3; i++ {
+		expected = append(expected, fast[i], mid[i], slow[i])
+	}
+	// the middle group, with the peers of unknown latency, is left.
+	expected = append(expected, mid[3:]...)
+	for i, p := range drainQueue(pq) {
+		if p != expected[i] {
+			t.Fatalf("expected the latency groups to take turns, got %s at %d", p, i)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
 	kb "github.com/libp2p/go-libp2p-kbucket"
 	peer "github.com/libp2p/go-libp2p-peer"
+	routing "github.com/libp2p/go-libp2p-routing"
 	notif "github.com/libp2p/go-libp2p-routing/notifications"
 )
 
@@ -54,18 +55,119 @@ func loggableKey(k string) logging.LoggableMap {
 // Kademlia 'node lookup' operation. Returns a channel of the K closest peers
 // to the given key
 func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan peer.ID, error) {
-	e := logger.EventBegin(ctx, "getClosestPeers", loggableKey(key))
-	tablepeers := dht.routingTable.NearestPeers(kb.ConvertKey(key), AlphaValue)
+	if dht.proxy != "" {
+		peers, err := dht.proxyClosestPeers(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		out := make(chan peer.ID, len(peers))
+		for _, pi := range peers {
+			out <- pi.ID
+		}
+		close(out)
+		return out, nil
+	}
+
+	if peers, ok := dht.queryCache.get(key); ok {
+		out := make(chan peer.ID, len(peers))
+		for _, p := range peers {
+			out <- p
+		}
+		close(out)
+		return out, nil
+	}
+
+	tablepeers := dht.LocalClosestPeers(key, dht.alpha)
 	if len(tablepeers) == 0 {
 		return nil, kb.ErrLookupFailure
 	}
+	return dht.getClosestPeers(ctx, key, tablepeers), nil
+}
+
+// LocalClosestPeers returns the count peers of our routing table that are
+// closest to key, closest first, without any network activity. It's what a
+// lookup for key would start from.
+func (dht *IpfsDHT) LocalClosestPeers(key string, count int) []peer.ID {
+	return dht.routingTable.NearestPeers(kb.ConvertKey(key), count)
+}
+
+// ResumeQuery resumes the GetClosestPeers lookup saved in cp, see
+// ContextWithCheckpoint. It doesn't query the peers that already answered
+// the interrupted lookup again, but includes them in its result. The
+// addresses of the peers are taken afresh from the peerstore.
+func (dht *IpfsDHT) ResumeQuery(ctx context.Context, key string, cp *QueryCheckpoint) (<-chan peer.ID, error) {
+	if cp.Key != key {
+		return nil, fmt.Errorf("checkpoint is for another key")
+	}
+	seeds := append(append([]peer.ID(nil), cp.Frontier...), cp.Failed...)
+	if len(seeds) == 0 {
+		// the lookup was done, there's nothing left to ask.
+		seeds = dht.LocalClosestPeers(key, dht.alpha)
+	}
+	return dht.getClosestPeers(ctx, key, seeds, resumeFrom(cp)), nil
+}
+
+func (dht *IpfsDHT) getClosestPeers(ctx context.Context, key string, seeds []peer.ID, options ...QueryOption) <-chan peer.ID {
+	e := logger.EventBegin(ctx, "getClosestPeers", loggableKey(key))
+	out := make(chan peer.ID, dht.bucketSize)
+
+	query := dht.newQuery(key, dht.closerPeersFunc(ctx, key), options...)
+
+	go func() {
+		defer close(out)
+		defer e.Done()
+		// run it!
+		res, err := query.Run(ctx, seeds)
+		if err != nil {
+			logger.Debugf("closestPeers query run error: %s", err)
+		}
+		dht.bucketRefreshed(key)
+		if diag := lookupDiagnosticsFromContext(ctx); diag != nil && res != nil {
+			diag.fill(res)
+		}
+
+		if res != nil && res.queriedSet != nil {
+			sorted := kb.SortClosestPeers(res.queriedSet.Peers(), query.convertedKey)
+			if len(sorted) > query.kValue {
+				sorted = sorted[:query.kValue]
+			}
+			// only cache complete lookups.
+			if (err == nil || err == routing.ErrNotFound) && ctx.Err() == nil && len(sorted) > 0 {
+				dht.queryCache.add(key, sorted)
+			}
+
+			var resumed map[peer.ID]bool
+			if cp := query.resume; cp != nil {
+				resumed = make(map[peer.ID]bool, len(cp.Queried))
+				for _, p := range cp.Queried {
+					resumed[p] = true
+				}
+			}
+			for _, p := range sorted {
+				how := FinalPeerQueried
+				if resumed[p] {
+					how = FinalPeerResumed
+				}
+				notif.PublishQueryEvent(ctx, &notif.QueryEvent{
+					Type:  notif.FinalPeer,
+					ID:    p,
+					Extra: how,
+				})
+				out <- p
+			}
+		}
+	}()
 
-	out := make(chan peer.ID, KValue)
+	return out
+}
 
+// closerPeersFunc returns a query function that asks peers for the peers
+// closer to key that they know of.
+func (dht *IpfsDHT) closerPeersFunc(ctx context.Context, key string) queryFunc {
 	// since the query doesnt actually pass our context down
 	// we have to hack this here. whyrusleeping isnt a huge fan of goprocess
 	parent := ctx
-	query := dht.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+	return func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
 		// For DHT query command
 		notif.PublishQueryEvent(parent, &notif.QueryEvent{
 			Type: notif.SendingQuery,
@@ -87,28 +189,60 @@ func (dht *IpfsDHT) GetClosestPeers(ctx context.Context, key string) (<-chan pee
 		})
 
 		return &dhtQueryResult{closerPeers: peers}, nil
-	})
+	}
+}
 
-	go func() {
-		defer close(out)
-		defer e.Done()
-		// run it!
-		res, err := query.Run(ctx, tablepeers)
-		if err != nil {
-			logger.Debugf("closestPeers query run error: %s", err)
-		}
+// FindNearestToSelf looks up our own ID in the DHT and returns the K peers
+// closest to it, closest first. These are the peers responsible for our
+// region of the keyspace; checking them helps detect eclipse attacks.
+func (dht *IpfsDHT) FindNearestToSelf(ctx context.Context) ([]peer.ID, error) {
+	peers, err := dht.GetClosestPeers(ctx, string(dht.self))
+	if err != nil {
+		return nil, err
+	}
 
-		if res != nil && res.queriedSet != nil {
-			sorted := kb.SortClosestPeers(res.queriedSet.Peers(), kb.ConvertKey(key))
-			if len(sorted) > KValue {
-				sorted = sorted[:KValue]
-			}
+	var out []peer.ID
+	for p := range peers {
+		out = append(out, p)
+	}
+	return out, ctx.Err()
+}
 
-			for _, p := range sorted {
-				out <- p
-			}
-		}
-	}()
+// FindClosestN walks the DHT toward key and returns the n peers closest to
+// it that answered the lookup, closest first, e.g. to map keys to live peers
+// with consistent hashing. Unlike GetClosestPeers, n needn't be K, and the
+// peers that failed to answer are left out.
+func (dht *IpfsDHT) FindClosestN(ctx context.Context, key []byte, n int) ([]peer.ID, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("the number of peers must be at least 1; got %d", n)
+	}
+	k := string(key)
+	// peers answer with at most K closer peers, all of them close to the
+	// key as the lookup converges: start from enough of our own to find n.
+	count := dht.alpha
+	if n > count {
+		count = n
+	}
+	seeds := dht.LocalClosestPeers(k, count)
+	if len(seeds) == 0 {
+		return nil, kb.ErrLookupFailure
+	}
+
+	query := dht.newQuery(k, dht.closerPeersFunc(ctx, k), WithKValue(n))
+	res, err := query.Run(ctx, seeds)
+	if err != nil && err != routing.ErrNotFound {
+		return nil, err
+	}
 
-	return out, nil
+	var answered []peer.ID
+	for _, p := range res.queriedSet.Peers() {
+		if _, failed := res.failedPeers[p]; !failed {
+			answered = append(answered, p)
+		}
+	}
+	sorted := kb.SortClosestPeers(answered, query.convertedKey)
+	if len(sorted) > n {
+		sorted = sorted[:n]
+	}
+	return sorted, nil
 }
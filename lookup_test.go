@@ -1,9 +1,15 @@
 package dht
 
 import (
+	"context"
+	"reflect"
 	"testing"
+	"time"
 
 	cid "github.com/ipfs/go-cid"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
 )
 
 func TestLoggableKey(t *testing.T) {
@@ -34,3 +40,131 @@ func TestLoggableKey(t *testing.T) {
 		}
 	}
 }
+
+func TestGetClosestPeersReturnsK(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	// more than K peers, each of which only knows its neighbours, so that
+	// the lookup has to find most of them through the others.
+	n := KValue + 10
+	mn := mocknet.New(ctx)
+	dhts := make([]*IpfsDHT, n)
+	for i := range dhts {
+		h, err := mn.GenPeer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if dhts[i], err = New(ctx, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	if err := mn.LinkAll(); err != nil {
+		t.Fatal(err)
+	}
+	for i := range dhts {
+		if _, err := mn.ConnectPeers(dhts[i].self, dhts[(i+1)%n].self); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range dhts {
+		for d.routingTable.Size() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	for _, d := range dhts[:3] {
+		peers, err := d.GetClosestPeers(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var found int
+		for range peers {
+			found++
+		}
+		if found != KValue {
+			t.Fatalf("expected K=%d closest peers, got %d", KValue, found)
+		}
+	}
+}
+
+func TestLocalClosestPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 6)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d := dhts[0]
+	var peers []peer.ID
+	for _, other := range dhts[1:] {
+		connect(t, ctx, d, other)
+		peers = append(peers, other.self)
+	}
+
+	const key = "foo"
+	expected := kb.SortClosestPeers(peers, kb.ConvertKey(key))[:3]
+	closest := d.LocalClosestPeers(key, 3)
+	if len(closest) != len(expected) {
+		t.Fatalf("expected %d peers, got %d", len(expected), len(closest))
+	}
+	for i, p := range closest {
+		if p != expected[i] {
+			t.Fatalf("expected the closest peers of the routing table, closest first, got %s at %d", p, i)
+		}
+	}
+	if n := len(d.LocalClosestPeers(key, 20)); n != len(peers) {
+		t.Fatalf("expected all %d peers of the routing table, got %d", len(peers), n)
+	}
+}
+
+func TestFindClosestN(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	d := NewMockDHT(42, 300)
+	defer d.Close()
+	defer d.host.Close()
+
+	var all []peer.ID
+	for p := range d.sim.nodes {
+		all = append(all, p)
+	}
+	sorted := kb.SortClosestPeers(all, kb.ConvertKey("foo"))
+
+	// fewer and more peers than K.
+	for _, n := range []int{5, 2 * d.bucketSize} {
+		peers, err := d.FindClosestN(ctx, []byte("foo"), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(peers, sorted[:n]) {
+			t.Errorf("expected the %d closest virtual nodes, got %v", n, peers)
+		}
+	}
+
+	// the closest peer is gone, it's left out.
+	gone := sorted[0]
+	delete(d.sim.nodes, gone)
+	peers, err := d.FindClosestN(ctx, []byte("foo"), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(peers, sorted[1:6]) {
+		t.Errorf("expected the 5 closest virtual nodes still answering, got %v", peers)
+	}
+
+	if _, err := d.FindClosestN(ctx, []byte("foo"), 0); err == nil {
+		t.Error("expected an error looking for no peers")
+	}
+}
@@ -0,0 +1,171 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+
+	ci "github.com/libp2p/go-libp2p-crypto"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// NewMockDHT returns a DHT that is part of a simulated network of size
+// virtual nodes, for benchmarks and load tests that can't rely on a live
+// network. The IDs of the DHT and of the nodes, and so every XOR distance and
+// routing table, are derived from seed: the same seed always makes the same
+// network. Every node keeps up to K peers per bucket, like a real routing
+// table, and answers the RPCs of the DHT from it in-process, without any
+// networking or latency. The DHT itself is a regular one, its lookups run
+// the same code as on a live network.
+//
+// Building the network takes time quadratic in size. Close the DHT, and its
+// host, when done.
+func NewMockDHT(seed int64, size int) *IpfsDHT {
+	rng := rand.New(rand.NewSource(seed))
+	newID := func() (ci.PrivKey, peer.ID) {
+		sk, pk, err := ci.GenerateEd25519Key(rng)
+		if err != nil {
+			panic(err)
+		}
+		id, err := peer.IDFromPublicKey(pk)
+		if err != nil {
+			panic(err)
+		}
+		return sk, id
+	}
+
+	ctx := context.Background()
+	sk, _ := newID()
+	h, err := mocknet.New(ctx).AddPeer(sk, ma.StringCast("/ip4/127.0.0.1/tcp/4001"))
+	if err != nil {
+		panic(err)
+	}
+	dht, err := New(ctx, h)
+	if err != nil {
+		panic(err)
+	}
+
+	ids := make([]peer.ID, size)
+	for i := range ids {
+		_, ids[i] = newID()
+	}
+	dht.sim = newMockNetwork(rng, dht.bucketSize, ids)
+	for _, i := range rng.Perm(size) {
+		dht.routingTable.Update(ids[i])
+	}
+	return dht
+}
+
+// mockNetwork is the simulated network of a mock DHT: virtual nodes that
+// answer its RPCs from routing tables computed up front.
+type mockNetwork struct {
+	k     int
+	nodes map[peer.ID]*mockNode
+
+	mu sync.Mutex // guards the records and providers of the nodes
+}
+
+type mockNode struct {
+	known     []peer.ID // the peers of its routing table
+	records   map[string]*recpb.Record
+	providers map[string][]*pb.Message_Peer
+}
+
+func newMockNetwork(rng *rand.Rand, k int, ids []peer.ID) *mockNetwork {
+	n := &mockNetwork{k: k, nodes: make(map[peer.ID]*mockNode, len(ids))}
+	converted := make([]kb.ID, len(ids))
+	for i, id := range ids {
+		converted[i] = kb.ConvertPeerID(id)
+	}
+	for i, id := range ids {
+		// fill the buckets in a random order, as peers come and go.
+		buckets := make(map[int]int)
+		node := &mockNode{
+			records:   make(map[string]*recpb.Record),
+			providers: make(map[string][]*pb.Message_Peer),
+		}
+		for _, j := range rng.Perm(len(ids)) {
+			if j == i {
+				continue
+			}
+			cpl := bitPrefixLen(converted[i], converted[j])
+			if buckets[cpl] < k {
+				buckets[cpl]++
+				node.known = append(node.known, ids[j])
+			}
+		}
+		n.nodes[id] = node
+	}
+	return n
+}
+
+// dial "connects" to the virtual node of pi.
+func (n *mockNetwork) dial(ctx context.Context, pi pstore.PeerInfo) error {
+	if _, ok := n.nodes[pi.ID]; !ok {
+		return fmt.Errorf("no virtual node %s", pi.ID)
+	}
+	return nil
+}
+
+// sendRequest has the virtual node p answer pmes.
+func (n *mockNetwork) sendRequest(ctx context.Context, p peer.ID, pmes *pb.Message) (*pb.Message, error) {
+	node, ok := n.nodes[p]
+	if !ok {
+		return nil, fmt.Errorf("no virtual node %s", p)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	default:
+	}
+
+	key := string(pmes.GetKey())
+	resp := pb.NewMessage(pmes.GetType(), pmes.GetKey(), pmes.GetClusterLevel())
+	switch pmes.GetType() {
+	case pb.Message_FIND_NODE:
+		resp.CloserPeers = node.closest(key, n.k)
+	case pb.Message_GET_VALUE:
+		n.mu.Lock()
+		resp.Record = node.records[key]
+		n.mu.Unlock()
+		resp.CloserPeers = node.closest(key, n.k)
+	case pb.Message_PUT_VALUE:
+		n.mu.Lock()
+		node.records[key] = pmes.GetRecord()
+		n.mu.Unlock()
+		resp.Record = pmes.GetRecord()
+	case pb.Message_GET_PROVIDERS:
+		n.mu.Lock()
+		resp.ProviderPeers = node.providers[key]
+		n.mu.Unlock()
+		resp.CloserPeers = node.closest(key, n.k)
+	case pb.Message_ADD_PROVIDER:
+		n.mu.Lock()
+		node.providers[key] = append(node.providers[key], pmes.GetProviderPeers()...)
+		n.mu.Unlock()
+	case pb.Message_PING:
+	default:
+		return nil, fmt.Errorf("virtual nodes don't handle messages of type %v", pmes.GetType())
+	}
+	return resp, nil
+}
+
+// closest returns the count peers the node knows of closest to key.
+func (node *mockNode) closest(key string, count int) []*pb.Message_Peer {
+	sorted := kb.SortClosestPeers(node.known, kb.ConvertKey(key))
+	if len(sorted) > count {
+		sorted = sorted[:count]
+	}
+	out := make([]*pb.Message_Peer, len(sorted))
+	for i, p := range sorted {
+		out[i] = &pb.Message_Peer{Id: []byte(p)}
+	}
+	return out
+}
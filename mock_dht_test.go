@@ -0,0 +1,81 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	cid "github.com/ipfs/go-cid"
+	u "github.com/ipfs/go-ipfs-util"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	record "github.com/libp2p/go-libp2p-record"
+)
+
+func TestMockDHT(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	lookup := func(seed int64) (*IpfsDHT, []peer.ID) {
+		d := NewMockDHT(seed, 300)
+		ch, err := d.GetClosestPeers(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var peers []peer.ID
+		for p := range ch {
+			peers = append(peers, p)
+		}
+		return d, peers
+	}
+
+	d, peers := lookup(42)
+	defer d.Close()
+	defer d.host.Close()
+
+	// the lookup converges on the K closest of all the virtual nodes.
+	var all []peer.ID
+	for p := range d.sim.nodes {
+		all = append(all, p)
+	}
+	want := kb.SortClosestPeers(all, kb.ConvertKey("foo"))[:d.bucketSize]
+	if !reflect.DeepEqual(peers, want) {
+		t.Errorf("expected the %d closest virtual nodes, got %v", len(want), peers)
+	}
+
+	// the same seed makes the same network.
+	d2, peers2 := lookup(42)
+	defer d2.Close()
+	defer d2.host.Close()
+	if d2.self != d.self || !reflect.DeepEqual(peers2, peers) {
+		t.Error("expected the same seed to make the same network")
+	}
+
+	// records and provider records are stored on the virtual nodes.
+	d.Validator = record.NamespacedValidator{"v": blankValidator{}}
+	if err := d.PutValue(ctx, "/v/hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	vals, err := d.GetValues(ctx, "/v/hello", 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one of them is our own copy.
+	if len(vals) < 5 {
+		t.Errorf("expected the record from at least 5 peers, got %d", len(vals))
+	}
+	c := cid.NewCidV0(u.Hash([]byte("hello")))
+	if err := d.Provide(ctx, c, true); err != nil {
+		t.Fatal(err)
+	}
+	stored := 0
+	for _, node := range d.sim.nodes {
+		if len(node.providers[string(c.Bytes())]) > 0 {
+			stored++
+		}
+	}
+	if stored != d.bucketSize {
+		t.Errorf("expected the provider record on %d virtual nodes, got %d", d.bucketSize, stored)
+	}
+}
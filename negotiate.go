@@ -0,0 +1,140 @@
+package dht
+
+import (
+	"context"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+)
+
+// negotiatedProtocolKey is the peerstore key under which we keep the DHT
+// protocol negotiated with a peer.
+const negotiatedProtocolKey = "kad-dht/protocol"
+
+// NegotiateProtocol returns the newest DHT protocol version that both we and
+// p speak, in the order of preference of our configured protocols. The result
+// is remembered in the peerstore so that later requests to p go straight to
+// that version rather than offering newer ones p would refuse.
+func (dht *IpfsDHT) NegotiateProtocol(ctx context.Context, p peer.ID) (protocol.ID, error) {
+	if proto, ok := dht.negotiatedProtocol(p); ok {
+		return proto, nil
+	}
+
+	// identify may have already told us which protocols p supports.
+	proto := dht.preferredSupportedProtocol(p)
+	if proto == "" {
+		// negotiate on the stream we'll send our requests to p on anyway.
+		ms, err := dht.messageSenderForPeer(ctx, p)
+		if err != nil {
+			return "", err
+		}
+		if proto, err = ms.protocol(ctx); err != nil {
+			return "", err
+		}
+
+		// Remember this choice (makes subsequent negotiations faster)
+		dht.peerstore.AddProtocols(p, string(proto))
+	}
+
+	if err := dht.peerstore.Put(p, negotiatedProtocolKey, proto); err != nil {
+		logger.Warningf("failed to remember the protocol of %s: %s", p, err)
+	}
+	return proto, nil
+}
+
+// negotiatedProtocol returns the protocol previously negotiated with p.
+func (dht *IpfsDHT) negotiatedProtocol(p peer.ID) (protocol.ID, bool) {
+	v, err := dht.peerstore.Get(p, negotiatedProtocolKey)
+	if err != nil {
+		return "", false
+	}
+	proto, ok := v.(protocol.ID)
+	return proto, ok && proto != ""
+}
+
+// knowsProtocol returns whether the peerstore knows a DHT protocol version to
+// speak with p already, so that there's nothing to negotiate.
+func (dht *IpfsDHT) knowsProtocol(p peer.ID) bool {
+	if _, ok := dht.negotiatedProtocol(p); ok {
+		return true
+	}
+	return dht.preferredSupportedProtocol(p) != ""
+}
+
+// negotiateUnknownProtocol negotiates the DHT protocol version to speak with
+// p, unless the peerstore knows one already.
+func (dht *IpfsDHT) negotiateUnknownProtocol(ctx context.Context, p peer.ID) error {
+	if dht.knowsProtocol(p) {
+		return nil
+	}
+	_, err := dht.NegotiateProtocol(ctx, p)
+	return err
+}
+
+// forgetProtocol forgets the DHT protocol versions the peerstore thinks p
+// speaks, after p refused, or may have refused, the one we offered: it may
+// have upgraded or downgraded since, so the next stream to p negotiates the
+// version afresh.
+func (dht *IpfsDHT) forgetProtocol(p peer.ID) {
+	// the peerstore can't delete metadata, so overwrite it.
+	if err := dht.peerstore.Put(p, negotiatedProtocolKey, protocol.ID("")); err != nil {
+		logger.Warningf("failed to forget the protocol of %s: %s", p, err)
+	}
+	protos, err := dht.peerstore.GetProtocols(p)
+	if err != nil {
+		return
+	}
+	kept := protos[:0]
+	for _, proto := range protos {
+		if !dht.speaks(proto) {
+			kept = append(kept, proto)
+		}
+	}
+	if len(kept) < len(protos) {
+		dht.peerstore.SetProtocols(p, kept...)
+	}
+}
+
+// speaks returns whether proto is one of our DHT protocols.
+func (dht *IpfsDHT) speaks(proto string) bool {
+	for _, ours := range dht.protocols {
+		if string(ours) == proto {
+			return true
+		}
+	}
+	return false
+}
+
+// preferredSupportedProtocol returns the first of our protocols that the
+// peerstore knows p supports, if any.
+func (dht *IpfsDHT) preferredSupportedProtocol(p peer.ID) protocol.ID {
+	supported, err := dht.peerstore.SupportsProtocols(p, dht.protocolStrs()...)
+	if err != nil || len(supported) == 0 {
+		return ""
+	}
+	for _, proto := range dht.protocols {
+		for _, s := range supported {
+			if string(proto) == s {
+				return proto
+			}
+		}
+	}
+	return ""
+}
+
+// protocolsFor returns the protocols to offer p when opening a stream, with
+// the one negotiated with p, if any, first.
+func (dht *IpfsDHT) protocolsFor(p peer.ID) []protocol.ID {
+	proto, ok := dht.negotiatedProtocol(p)
+	if !ok || proto == dht.protocols[0] {
+		return dht.protocols
+	}
+	protos := make([]protocol.ID, 0, len(dht.protocols))
+	protos = append(protos, proto)
+	for _, other := range dht.protocols {
+		if other != proto {
+			protos = append(protos, other)
+		}
+	}
+	return protos
+}
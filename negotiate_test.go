@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+func TestNegotiateProtocol(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	const newer protocol.ID = "/test/kad/2.0.0"
+	newDHT := func(protos ...protocol.ID) *IpfsDHT {
+		d, err := New(
+			ctx,
+			bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+			opts.Protocols(protos...),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	upgraded := newDHT(newer, opts.ProtocolDHT)
+	legacy := newDHT(opts.ProtocolDHT)
+	peer := newDHT(newer, opts.ProtocolDHT)
+	defer func() {
+		for _, d := range []*IpfsDHT{upgraded, legacy, peer} {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, upgraded, legacy)
+	connect(t, ctx, upgraded, peer)
+
+	for _, tc := range []struct {
+		remote   *IpfsDHT
+		expected protocol.ID
+	}{{legacy, opts.ProtocolDHT}, {peer, newer}} {
+		proto, err := upgraded.NegotiateProtocol(ctx, tc.remote.self)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if proto != tc.expected {
+			t.Errorf("expected to negotiate %s, got %s", tc.expected, proto)
+		}
+		if remembered, ok := upgraded.negotiatedProtocol(tc.remote.self); !ok || remembered != tc.expected {
+			t.Errorf("expected %s to be remembered, got %s", tc.expected, remembered)
+		}
+		if protos := upgraded.protocolsFor(tc.remote.self); protos[0] != tc.expected {
+			t.Errorf("expected to offer %s first, got %v", tc.expected, protos)
+		}
+	}
+
+	// requests go out over the negotiated versions.
+	for _, d := range []*IpfsDHT{legacy, peer} {
+		if err := upgraded.Ping(ctx, d.self); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the peer downgrades: the next stream to it offers the version it
+	// doesn't speak anymore, which it refuses, and the request is retried
+	// over the version negotiated afresh.
+	peer.host.RemoveStreamHandler(newer)
+	upgraded.smlk.Lock()
+	upgraded.strmap[peer.self].invalidate()
+	delete(upgraded.strmap, peer.self)
+	upgraded.smlk.Unlock()
+	if err := upgraded.Ping(ctx, peer.self); err != nil {
+		t.Fatal(err)
+	}
+	if proto, err := upgraded.NegotiateProtocol(ctx, peer.self); err != nil || proto != opts.ProtocolDHT {
+		t.Errorf("expected to negotiate %s after the downgrade, got %s, %v", opts.ProtocolDHT, proto, err)
+	}
+}
@@ -2,9 +2,11 @@ package dhtopts
 
 import (
 	"fmt"
+	"time"
 
 	ds "github.com/ipfs/go-datastore"
 	dssync "github.com/ipfs/go-datastore/sync"
+	peer "github.com/libp2p/go-libp2p-peer"
 	"github.com/libp2p/go-libp2p-protocol"
 	record "github.com/libp2p/go-libp2p-record"
 )
@@ -19,6 +21,95 @@ type Options struct {
 	Validator record.Validator
 	Client    bool
 	Protocols []protocol.ID
+
+	// KValue and AlphaValue are the bucket size and query concurrency. Zero
+	// means "use the dht package defaults".
+	KValue     int
+	AlphaValue int
+
+	// PerPeerTimeout bounds every individual peer RPC made by a query.
+	PerPeerTimeout time.Duration
+
+	// MinPeerTimeout and MaxPeerTimeout bound the per-peer RPC deadlines
+	// derived from the latency of the peers. A zero MaxPeerTimeout disables
+	// adaptive deadlines.
+	MinPeerTimeout time.Duration
+	MaxPeerTimeout time.Duration
+
+	// MaxPeerFailures is the number of consecutive failed dials or queries
+	// after which a peer is removed from the routing table. Zero disables this.
+	MaxPeerFailures int
+
+	// IdleGCThreshold is how long the DHT must go without queries before it
+	// runs the garbage collector. Zero disables this.
+	IdleGCThreshold time.Duration
+
+	// SpeculativeFactor is how many more peers than the concurrency queries
+	// query at a time, as a factor. Speculation is disabled at 1 or less.
+	SpeculativeFactor float64
+
+	// ConnectednessBonus is how many bits of XOR distance connected peers
+	// are given a head start by in queries. Zero disables this.
+	ConnectednessBonus int
+
+	// VerifiedAddrTTL is how long the addresses of the peers that answered
+	// a query are kept. Zero means "use the dht package default".
+	VerifiedAddrTTL time.Duration
+
+	// SegmentConcurrency is how many segments dht.SegmentedLookup looks up
+	// at a time. Zero means "use the dht package default".
+	SegmentConcurrency int
+
+	// Proxy is the peer that runs the lookups of the DHT on its behalf, if set.
+	Proxy peer.ID
+
+	// ServeProxy is whether the DHT runs lookups on behalf of the peers that
+	// use it as their proxy.
+	ServeProxy bool
+
+	// MaxRPCsPerPeer is how many RPCs the queries of the DHT send to the same
+	// peer at a time, all queries together. Zero means "use the dht package
+	// default".
+	MaxRPCsPerPeer int
+
+	// MaxConcurrentQueries is how many peers the queries of the DHT query at
+	// a time, all queries together. Zero means "use the dht package default".
+	MaxConcurrentQueries int
+
+	// DialBackoffBase, DialBackoffMax and DialBackoffSize configure the dial
+	// backoff of the DHT. Zero means no dial backoff.
+	DialBackoffBase time.Duration
+	DialBackoffMax  time.Duration
+	DialBackoffSize int
+
+	// DialTimeout bounds every dial of the queries of the DHT. Zero means
+	// "use the dht package default".
+	DialTimeout time.Duration
+
+	// DialQueueMinParallelism, DialQueueMaxParallelism, DialQueueMaxIdle and
+	// DialQueueMutePeriod configure the dial queues of queries. Zero means
+	// "use the dht package default".
+	DialQueueMinParallelism int
+	DialQueueMaxParallelism int
+	DialQueueMaxIdle        time.Duration
+	DialQueueMutePeriod     time.Duration
+
+	// DialQueueSuccessWindow, DialQueueLowSuccessRate and
+	// DialQueueHighSuccessRate configure how the dial queues of queries scale
+	// on their dial success rate. Zero means "use the dht package default".
+	DialQueueSuccessWindow   int
+	DialQueueLowSuccessRate  float64
+	DialQueueHighSuccessRate float64
+
+	// AutoRefreshInterval is how often the DHT checks the size of its
+	// routing table, and AutoRefreshMinPeers the size under which it looks
+	// itself up to repopulate it. Zero means "use the dht package default".
+	AutoRefreshInterval time.Duration
+	AutoRefreshMinPeers int
+
+	// Other contains options that are specific to the dht package and can't
+	// be expressed here without an import cycle.
+	Other map[interface{}]interface{}
 }
 
 // Apply applies the given options to this Option
@@ -93,6 +184,333 @@ func NamespacedValidator(ns string, v record.Validator) Option {
 	}
 }
 
+// KValue sets the bucket size (K) of the routing table, which is also the
+// number of closest peers lookups try to find.
+//
+// Defaults to dht.KValue.
+func KValue(k int) Option {
+	return func(o *Options) error {
+		if k <= 0 {
+			return fmt.Errorf("k must be positive; got %d", k)
+		}
+		o.KValue = k
+		return nil
+	}
+}
+
+// AlphaValue sets the number of peers a query contacts concurrently.
+//
+// Defaults to dht.AlphaValue.
+func AlphaValue(alpha int) Option {
+	return func(o *Options) error {
+		if alpha <= 0 {
+			return fmt.Errorf("alpha must be positive; got %d", alpha)
+		}
+		o.AlphaValue = alpha
+		return nil
+	}
+}
+
+// PerPeerTimeout sets a deadline for each RPC a query sends to an individual
+// peer. A peer that doesn't answer in time is counted as failed without
+// affecting the rest of the query.
+//
+// Defaults to 0 (no per-peer deadline).
+func PerPeerTimeout(timeout time.Duration) Option {
+	return func(o *Options) error {
+		if timeout < 0 {
+			return fmt.Errorf("per peer timeout must not be negative; got %s", timeout)
+		}
+		o.PerPeerTimeout = timeout
+		return nil
+	}
+}
+
+// AdaptivePeerTimeout configures the queries of the DHT to give each peer a
+// deadline of four times its average RPC latency, clamped to [min, max], so
+// that little time is wasted on dead nearby peers while slow distant ones
+// still get to answer. Peers we don't know the latency of get the
+// PerPeerTimeout deadline.
+//
+// Defaults to the PerPeerTimeout for every peer.
+func AdaptivePeerTimeout(min, max time.Duration) Option {
+	return func(o *Options) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("peer timeout bounds must be positive and ordered; got [%s, %s]", min, max)
+		}
+		o.MinPeerTimeout = min
+		o.MaxPeerTimeout = max
+		return nil
+	}
+}
+
+// EvictFailedPeers configures the DHT to remove a peer from its routing table
+// once maxFailures dials or queries of that peer have failed in a row, so that
+// dead peers stop being handed out as seeds for new queries. Failures caused by
+// the cancellation of the query itself don't count.
+//
+// Defaults to 0 (never evict peers because of failures).
+func EvictFailedPeers(maxFailures int) Option {
+	return func(o *Options) error {
+		if maxFailures < 0 {
+			return fmt.Errorf("max failures must not be negative; got %d", maxFailures)
+		}
+		o.MaxPeerFailures = maxFailures
+		return nil
+	}
+}
+
+// IdleGCHint configures the DHT to run the garbage collector once whenever it
+// has gone without running any queries for idleThreshold, to reclaim the
+// garbage left behind by past queries before the next ones need the CPU.
+//
+// Defaults to 0 (leave garbage collection to the runtime).
+func IdleGCHint(idleThreshold time.Duration) Option {
+	return func(o *Options) error {
+		if idleThreshold < 0 {
+			return fmt.Errorf("idle threshold must not be negative; got %s", idleThreshold)
+		}
+		o.IdleGCThreshold = idleThreshold
+		return nil
+	}
+}
+
+// SpeculativeFactor configures the queries of the DHT to hedge against slow
+// peers by querying ceil(f * alpha) peers at a time, cancelling the slowest
+// ones once alpha of them answered. See dht.WithSpeculativeFactor.
+//
+// Defaults to 1 (no speculation).
+func SpeculativeFactor(f float64) Option {
+	return func(o *Options) error {
+		if f < 1 {
+			return fmt.Errorf("speculative factor must be at least 1; got %v", f)
+		}
+		o.SpeculativeFactor = f
+		return nil
+	}
+}
+
+// ConnectednessBonus configures the queries of the DHT to query the peers
+// they're already connected to before the peers they'd have to dial, as long
+// as those are no more than 2^bits times closer to the key. Dialing is often
+// the slowest part of querying a peer, so on nodes with many standing
+// connections this cuts lookup latency at the cost of a slightly longer path.
+//
+// Defaults to 0 (order peers by distance alone).
+func ConnectednessBonus(bits int) Option {
+	return func(o *Options) error {
+		if bits < 0 || bits > 256 {
+			return fmt.Errorf("connectedness bonus must be between 0 and 256 bits; got %d", bits)
+		}
+		o.ConnectednessBonus = bits
+		return nil
+	}
+}
+
+// VerifiedAddrTTL sets how long the DHT keeps the addresses of the peers
+// that answered one of its queries. Addresses learned from other peers are
+// only kept for a short while until then.
+//
+// Defaults to dht.DefaultVerifiedAddrTTL.
+func VerifiedAddrTTL(ttl time.Duration) Option {
+	return func(o *Options) error {
+		if ttl <= 0 {
+			return fmt.Errorf("verified address ttl must be positive; got %s", ttl)
+		}
+		o.VerifiedAddrTTL = ttl
+		return nil
+	}
+}
+
+// SegmentConcurrency sets how many segments dht.SegmentedLookup looks up at a
+// time. Each segment is looked up with its own query.
+//
+// Defaults to dht.DefaultSegmentConcurrency.
+func SegmentConcurrency(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("segment concurrency must be at least 1; got %d", n)
+		}
+		o.SegmentConcurrency = n
+		return nil
+	}
+}
+
+// Proxy configures the DHT to have the trusted peer p run its lookups on its
+// behalf, for nodes behind firewalls that can't reach the DHT peers directly.
+// p must serve the lookups, see ServeProxy. Lookups for the closest peers to
+// a key, for peers, for providers and for values are proxied, and so are
+// value puts.
+//
+// Defaults to running lookups locally.
+func Proxy(p peer.ID) Option {
+	return func(o *Options) error {
+		if p == "" {
+			return fmt.Errorf("proxy peer must not be empty")
+		}
+		o.Proxy = p
+		return nil
+	}
+}
+
+// ServeProxy configures whether the DHT runs lookups on behalf of the peers
+// that use it as their proxy, see Proxy. Every proxied lookup costs us a full
+// lookup, so only enable it on nodes that serve trusted clients.
+//
+// Defaults to false.
+func ServeProxy(serve bool) Option {
+	return func(o *Options) error {
+		o.ServeProxy = serve
+		return nil
+	}
+}
+
+// MaxRPCsPerPeer sets how many RPCs the queries of the DHT send to the same
+// peer at a time, all queries together. The queries that would exceed it wait
+// for the RPCs of the others to complete, so that a peer many queries go
+// through doesn't get a burst of streams from us.
+//
+// Defaults to dht.DefaultMaxRPCsPerPeer.
+func MaxRPCsPerPeer(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("max rpcs per peer must be at least 1; got %d", n)
+		}
+		o.MaxRPCsPerPeer = n
+		return nil
+	}
+}
+
+// MaxConcurrentQueries sets how many peers the queries of the DHT query at a
+// time, all queries together. Every query queries up to alpha peers at a time
+// on its own; this bounds them all, so that many concurrent lookups don't
+// open a connection per query and per peer at once.
+//
+// Defaults to 10 times the alpha value of the DHT.
+func MaxConcurrentQueries(n int) Option {
+	return func(o *Options) error {
+		if n < 1 {
+			return fmt.Errorf("max concurrent queries must be at least 1; got %d", n)
+		}
+		o.MaxConcurrentQueries = n
+		return nil
+	}
+}
+
+// DialBackoff configures how long the queries of the DHT wait before dialing
+// again a peer that failed to dial: base after its first failure, twice as
+// long after every next one, up to max. A successful dial clears the backoff
+// of a peer, and so does not failing for max after its backoff expired. The
+// backoffs of up to size peers are remembered.
+//
+// There is no dial backoff by default: every query dials the peers it needs
+// to, whether they failed to dial in other queries or not.
+// dht.DefaultDialBackoffBase, dht.DefaultDialBackoffMax and
+// dht.DefaultDialBackoffSize are suitable values.
+func DialBackoff(base, max time.Duration, size int) Option {
+	return func(o *Options) error {
+		if base <= 0 || max < base {
+			return fmt.Errorf("dial backoff must be positive and at most its max; got base=%s, max=%s", base, max)
+		}
+		if size < 1 {
+			return fmt.Errorf("dial backoff size must be at least 1; got %d", size)
+		}
+		o.DialBackoffBase = base
+		o.DialBackoffMax = max
+		o.DialBackoffSize = size
+		return nil
+	}
+}
+
+// DialTimeout sets how long the queries of the DHT wait for a dial to
+// complete, whatever the deadline of the query, so that a peer behind a
+// firewall that drops our packets doesn't hold a dial worker until the query
+// ends. The peers that don't answer in time fail with dht.ErrDialTimeout.
+//
+// Defaults to dht.DefaultDialTimeout.
+func DialTimeout(d time.Duration) Option {
+	return func(o *Options) error {
+		if d <= 0 {
+			return fmt.Errorf("dial timeout must be positive; got %s", d)
+		}
+		o.DialTimeout = d
+		return nil
+	}
+}
+
+// DialQueue configures the dial queues of queries, which dial the peers to
+// query ahead of time: they run between minParallelism and maxParallelism
+// dials at a time, shrink after a dial worker was idle for maxIdle, and
+// ignore further scaling events for mutePeriod after resizing. Constrained
+// devices may want fewer dials at a time than servers.
+//
+// Defaults to dht.DefaultDialQueueMinParallelism,
+// dht.DefaultDialQueueMaxParallelism, dht.DefaultDialQueueMaxIdle and
+// dht.DefaultDialQueueScalingMutePeriod.
+func DialQueue(minParallelism, maxParallelism int, maxIdle, mutePeriod time.Duration) Option {
+	return func(o *Options) error {
+		if minParallelism < 1 {
+			return fmt.Errorf("dial queue min parallelism must be at least 1; got %d", minParallelism)
+		}
+		if maxParallelism < minParallelism {
+			return fmt.Errorf("dial queue max parallelism must be at least its min parallelism; got min=%d, max=%d",
+				minParallelism, maxParallelism)
+		}
+		if maxIdle <= 0 || mutePeriod <= 0 {
+			return fmt.Errorf("dial queue periods must be positive; got max idle=%s, mute period=%s", maxIdle, mutePeriod)
+		}
+		o.DialQueueMinParallelism = minParallelism
+		o.DialQueueMaxParallelism = maxParallelism
+		o.DialQueueMaxIdle = maxIdle
+		o.DialQueueMutePeriod = mutePeriod
+		return nil
+	}
+}
+
+// DialQueueSuccessRate configures how the dial queues of queries scale on the
+// success rate of their last window dials: under low, they grow straight to
+// their max parallelism, and don't shrink, while there are peers left to dial,
+// as on networks where most peers are unreachable it takes more dials at a
+// time to find the few reachable ones. From high, they shrink without waiting
+// for their mute period.
+//
+// Defaults to dht.DefaultDialQueueSuccessWindow,
+// dht.DefaultDialQueueLowSuccessRate and dht.DefaultDialQueueHighSuccessRate.
+func DialQueueSuccessRate(window int, low, high float64) Option {
+	return func(o *Options) error {
+		if window < 1 {
+			return fmt.Errorf("dial queue success window must be at least 1; got %d", window)
+		}
+		if low < 0 || low > high || high > 1 {
+			return fmt.Errorf("dial queue success rates must be within [0, 1], low at most high; got low=%f, high=%f", low, high)
+		}
+		o.DialQueueSuccessWindow = window
+		o.DialQueueLowSuccessRate = low
+		o.DialQueueHighSuccessRate = high
+		return nil
+	}
+}
+
+// AutoRefresh makes the DHT check the size of its routing table every
+// interval and, if peers left or failed until it holds fewer than minPeers,
+// look itself up to repopulate it. A minPeers of zero means half the K value
+// of the DHT.
+//
+// Defaults to dht.DefaultAutoRefreshInterval and half the K value.
+func AutoRefresh(interval time.Duration, minPeers int) Option {
+	return func(o *Options) error {
+		if interval <= 0 {
+			return fmt.Errorf("auto refresh interval must be positive; got %s", interval)
+		}
+		if minPeers < 0 {
+			return fmt.Errorf("auto refresh min peers must not be negative; got %d", minPeers)
+		}
+		o.AutoRefreshInterval = interval
+		o.AutoRefreshMinPeers = minPeers
+		return nil
+	}
+}
+
 // Protocols sets the protocols for the DHT
 //
 // Defaults to dht.DefaultProtocols
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	peer "github.com/libp2p/go-libp2p-peer"
+	pset "github.com/libp2p/go-libp2p-peer/peerset"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// PeerFilter decides whether a query may contact a peer, given its ID and the
+// peerstore holding what we know about it. It allows for policies that a
+// simple blocklist can't express, e.g. only routing through peers in certain
+// networks. Filters can be combined with AndFilter, OrFilter and NotFilter.
+type PeerFilter interface {
+	Allow(p peer.ID, ps pstore.Peerstore) bool
+}
+
+// PeerFilterFunc adapts a function to the PeerFilter interface.
+type PeerFilterFunc func(p peer.ID, ps pstore.Peerstore) bool
+
+// Allow calls f(p, ps).
+func (f PeerFilterFunc) Allow(p peer.ID, ps pstore.Peerstore) bool {
+	return f(p, ps)
+}
+
+// AndFilter returns a filter that allows the peers all of filters allow. It
+// allows any peer if filters is empty.
+func AndFilter(filters ...PeerFilter) PeerFilter {
+	return PeerFilterFunc(func(p peer.ID, ps pstore.Peerstore) bool {
+		for _, f := range filters {
+			if !f.Allow(p, ps) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// OrFilter returns a filter that allows the peers any of filters allows. It
+// allows no peer if filters is empty.
+func OrFilter(filters ...PeerFilter) PeerFilter {
+	return PeerFilterFunc(func(p peer.ID, ps pstore.Peerstore) bool {
+		for _, f := range filters {
+			if f.Allow(p, ps) {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// NotFilter returns a filter that allows the peers f rejects.
+func NotFilter(f PeerFilter) PeerFilter {
+	return PeerFilterFunc(func(p peer.ID, ps pstore.Peerstore) bool {
+		return !f.Allow(p, ps)
+	})
+}
+
+// WithPeerFilter restricts the query to the peers f allows. Rejected peers are
+// silently dropped: they aren't queried and don't count as failures.
+func WithPeerFilter(f PeerFilter) QueryOption {
+	return func(q *dhtQuery) {
+		q.filter = f
+	}
+}
+
+// QueryPeerFilter tells the peers an application is interested in apart,
+// e.g. the ones that speak an additional protocol. It's called for every peer
+// a query learns of, so it must be cheap.
+type QueryPeerFilter func(peer.ID) bool
+
+// QueryPeerFilterMode selects what a QueryPeerFilter applies to.
+type QueryPeerFilterMode int
+
+const (
+	// FilterResults leaves the peers the filter rejects out of the results
+	// of the query. They're still queried, so they can route the query to
+	// the peers it accepts.
+	FilterResults QueryPeerFilterMode = 1 << iota
+	// FilterQueries doesn't query the peers the filter rejects at all.
+	FilterQueries
+)
+
+// WithQueryPeerFilter applies f to the peers of the query as per mode, which
+// may combine FilterResults and FilterQueries. Unlike the filter set with
+// WithPeerFilter, it can keep peers that are fine to route through out of
+// the results.
+func WithQueryPeerFilter(f QueryPeerFilter, mode QueryPeerFilterMode) QueryOption {
+	return func(q *dhtQuery) {
+		q.appFilter = f
+		q.appFilterMode = mode
+	}
+}
+
+// filterPeers leaves the peers f rejects out of the peer sets of r.
+func (r *dhtQueryResult) filterPeers(f QueryPeerFilter) {
+	r.finalSet = filterPeerSet(r.finalSet, f)
+	r.queriedSet = filterPeerSet(r.queriedSet, f)
+}
+
+func filterPeerSet(s *pset.PeerSet, f QueryPeerFilter) *pset.PeerSet {
+	if s == nil {
+		return nil
+	}
+	out := pset.New()
+	for _, p := range s.Peers() {
+		if f(p) {
+			out.Add(p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	routing "github.com/libp2p/go-libp2p-routing"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestPeerFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	banned := dhts[2].self
+
+	var mu sync.Mutex
+	var queried []peer.ID
+	var sawAddrs bool
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		queried = append(queried, p)
+		mu.Unlock()
+		return nil, routing.ErrNotFound
+	}, WithPeerFilter(PeerFilterFunc(func(p peer.ID, ps pstore.Peerstore) bool {
+		sawAddrs = sawAddrs || len(ps.Addrs(p)) > 0
+		return p != banned
+	})))
+
+	// the filtered peer doesn't count as failed, only the queried one does.
+	_, err := query.Run(ctx, []peer.ID{dhts[1].self, banned})
+	lookupErr, ok := err.(*ErrLookupFailure)
+	if !ok || len(lookupErr.Errs) != 1 {
+		t.Fatalf("expected a lookup failure for the one queried peer, got %v", err)
+	}
+	if len(queried) != 1 || queried[0] != dhts[1].self {
+		t.Fatalf("expected only %s to be queried, got %v", dhts[1].self, queried)
+	}
+	if !sawAddrs {
+		t.Fatal("expected the filter to be given the peer addresses")
+	}
+
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		WithDefaultPeerFilter(NotFilter(AndFilter())),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+	if q := d.newQuery("foo", nil); q.filter == nil || q.filter.Allow(banned, nil) {
+		t.Fatal("expected queries to use the default filter")
+	}
+	if q := d.newQuery("foo", nil, WithPeerFilter(nil)); q.filter != nil {
+		t.Fatal("expected the query filter to override the default one")
+	}
+}
+
+func TestPeerFilterCombinators(t *testing.T) {
+	ps := pstoremem.NewPeerstore()
+	withAddrs, without := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	ps.AddAddr(withAddrs, tu.RandLocalTCPAddress(), time.Hour)
+
+	hasAddrs := PeerFilterFunc(func(p peer.ID, ps pstore.Peerstore) bool {
+		return len(ps.Addrs(p)) > 0
+	})
+	is := func(want peer.ID) PeerFilter {
+		return PeerFilterFunc(func(p peer.ID, _ pstore.Peerstore) bool { return p == want })
+	}
+
+	for _, c := range []struct {
+		name   string
+		filter PeerFilter
+		allows map[peer.ID]bool
+	}{
+		{"and", AndFilter(hasAddrs, is(withAddrs)), map[peer.ID]bool{withAddrs: true, without: false}},
+		{"and none", AndFilter(), map[peer.ID]bool{withAddrs: true, without: true}},
+		{"or", OrFilter(hasAddrs, is(without)), map[peer.ID]bool{withAddrs: true, without: true}},
+		{"or none", OrFilter(), map[peer.ID]bool{withAddrs: false, without: false}},
+		{"not", NotFilter(hasAddrs), map[peer.ID]bool{withAddrs: false, without: true}},
+		{"nested", AndFilter(NotFilter(is(withAddrs)), OrFilter(hasAddrs, is(without))), map[peer.ID]bool{withAddrs: false, without: true}},
+	} {
+		for p, allowed := range c.allows {
+			if c.filter.Allow(p, ps) != allowed {
+				t.Errorf("%s: expected Allow(%s) to be %v", c.name, p, allowed)
+			}
+		}
+	}
+}
+
+func TestQueryPeerFilter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	// only dhts[1], which doesn't speak our application protocol, knows
+	// about dhts[2].
+	router, useful := dhts[1].self, dhts[2].self
+	filter := func(p peer.ID) bool { return p != router }
+
+	run := func(mode QueryPeerFilterMode) (*dhtQueryResult, map[peer.ID]bool, error) {
+		var mu sync.Mutex
+		queried := make(map[peer.ID]bool)
+		query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			mu.Lock()
+			queried[p] = true
+			mu.Unlock()
+			if p == router {
+				pi := dhts[2].peerstore.PeerInfo(useful)
+				return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{&pi}}, nil
+			}
+			return &dhtQueryResult{}, nil
+		}, WithQueryPeerFilter(filter, mode))
+		res, err := query.Run(ctx, []peer.ID{router})
+		return res, queried, err
+	}
+
+	res, queried, err := run(FilterResults)
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+	if !queried[router] || !queried[useful] {
+		t.Fatalf("expected the filtered peer to still route the query, queried %v", queried)
+	}
+	if res.queriedSet.Contains(router) || res.finalSet.Contains(router) {
+		t.Error("expected the filtered peer to be left out of the results")
+	}
+	if !res.queriedSet.Contains(useful) || !res.finalSet.Contains(useful) {
+		t.Error("expected the other peer in the results")
+	}
+
+	// without the filtered peer, the query has no one to ask.
+	_, queried, err = run(FilterQueries)
+	if err != routing.ErrNotFound {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if len(queried) != 0 {
+		t.Errorf("expected the filtered peer not to be queried, queried %v", queried)
+	}
+}
@@ -0,0 +1,146 @@
+package dht
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/binary"
+	"math"
+	"sync"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	queue "github.com/libp2p/go-libp2p-peerstore/queue"
+)
+
+// newPeerQueue returns the queue that orders the peers a query for key
+// contacts, closest first. id is the key converted to the XOR keyspace.
+func (dht *IpfsDHT) newPeerQueue(key string, id kb.ID) queue.PeerQueue {
+	if dht.queueFactory != nil {
+		return dht.queueFactory(key, dht.peerstore)
+	}
+	geo := dht.geo != nil && dht.geo.blend > 0
+	if !geo && dht.connectedBonus == 0 && dht.dialHistory == nil {
+		return queue.NewXORDistancePQ(key)
+	}
+
+	pq := &distancePQ{from: id}
+	if geo {
+		pq.blend = dht.geo.blend
+		pq.locate = dht.locate
+		pq.lat, pq.lon, pq.located = dht.locate(dht.self)
+	}
+	if dht.connectedBonus > 0 {
+		pq.bonus = math.Exp2(float64(dht.connectedBonus))
+		pq.connected = func(p peer.ID) bool {
+			return dht.host.Network().Connectedness(p) == inet.Connected
+		}
+	}
+	if dht.dialHistory != nil {
+		pq.penalty = dht.dialHistory.penalty
+	}
+	return pq
+}
+
+// distancePQ is a PeerQueue that orders peers by a blend of their XOR
+// distance to a key and their geographic distance to us, both normalized to
+// [0, 1]. The distance of the peers we're connected to is divided by a bonus,
+// so that they're queried before the slightly closer peers we'd have to dial,
+// and a penalty is added to the distance of the peers that keep failing to
+// dial.
+type distancePQ struct {
+	from  kb.ID
+	blend float64 // weight of the geographic distance
+
+	// our location, if known.
+	lat, lon float64
+	located  bool
+	locate   func(peer.ID) (lat, lon float64, ok bool)
+
+	bonus     float64
+	connected func(peer.ID) bool
+
+	penalty func(peer.ID) float64
+
+	heap peerMetricHeap
+	sync.Mutex
+}
+
+type peerMetric struct {
+	peer   peer.ID
+	metric float64
+	xor    []byte // breaks ties, e.g. between peers in the same place
+}
+
+type peerMetricHeap []*peerMetric
+
+func (h peerMetricHeap) Len() int { return len(h) }
+
+func (h peerMetricHeap) Less(i, j int) bool {
+	if h[i].metric != h[j].metric {
+		return h[i].metric < h[j].metric
+	}
+	return bytes.Compare(h[i].xor, h[j].xor) < 0
+}
+
+func (h peerMetricHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *peerMetricHeap) Push(x interface{}) { *h = append(*h, x.(*peerMetric)) }
+
+func (h *peerMetricHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (pq *distancePQ) Len() int {
+	pq.Lock()
+	defer pq.Unlock()
+	return len(pq.heap)
+}
+
+func (pq *distancePQ) Enqueue(p peer.ID) {
+	id := kb.ConvertPeerID(p)
+	xor := make([]byte, len(id))
+	for i := range id {
+		xor[i] = id[i] ^ pq.from[i]
+	}
+	metric := float64(binary.BigEndian.Uint64(xor)) / math.MaxUint64
+	if pq.blend > 0 {
+		metric = (1-pq.blend)*metric + pq.blend*pq.geoDistance(p)
+	}
+	if pq.connected != nil && pq.connected(p) {
+		metric /= pq.bonus
+	}
+	if pq.penalty != nil {
+		metric += pq.penalty(p)
+	}
+
+	pq.Lock()
+	defer pq.Unlock()
+	heap.Push(&pq.heap, &peerMetric{peer: p, metric: metric, xor: xor})
+}
+
+func (pq *distancePQ) Dequeue() peer.ID {
+	pq.Lock()
+	defer pq.Unlock()
+	if len(pq.heap) < 1 {
+		panic("called Dequeue on an empty PeerQueue")
+	}
+	return heap.Pop(&pq.heap).(*peerMetric).peer
+}
+
+// geoDistance returns the great-circle distance between p and us, as a
+// fraction of the largest possible one. Peers that can't be located are as
+// far as can be.
+func (pq *distancePQ) geoDistance(p peer.ID) float64 {
+	if !pq.located {
+		return 1
+	}
+	lat, lon, ok := pq.locate(p)
+	if !ok {
+		return 1
+	}
+	return haversine(pq.lat, pq.lon, lat, lon) / math.Pi
+}
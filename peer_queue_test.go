@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+func TestConnectedPeersFirst(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 7)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d := dhts[0]
+
+	// we're connected to half of the candidates, and only know the
+	// addresses of the others.
+	var connected, unconnected, all []peer.ID
+	for i, other := range dhts[1:] {
+		if i%2 == 0 {
+			connect(t, ctx, d, other)
+			connected = append(connected, other.self)
+		} else {
+			d.peerstore.AddAddrs(other.self, other.host.Addrs(), pstore.TempAddrTTL)
+			unconnected = append(unconnected, other.self)
+		}
+		all = append(all, other.self)
+	}
+
+	const key = "foo"
+	d.connectedBonus = 256 // always query connected peers first.
+	pq := d.newPeerQueue(key, kb.ConvertKey(key))
+	for _, p := range all {
+		pq.Enqueue(p)
+	}
+	expected := append(
+		kb.SortClosestPeers(connected, kb.ConvertKey(key)),
+		kb.SortClosestPeers(unconnected, kb.ConvertKey(key))...,
+	)
+	for i, p := range drainQueue(pq) {
+		if p != expected[i] {
+			t.Fatalf("expected the connected peers to be queried first, got %s at %d", p, i)
+		}
+	}
+
+	// without a bonus, the peers are ordered by distance alone.
+	d.connectedBonus = 0
+	pq = d.newPeerQueue(key, kb.ConvertKey(key))
+	for _, p := range all {
+		pq.Enqueue(p)
+	}
+	expected = kb.SortClosestPeers(all, kb.ConvertKey(key))
+	for i, p := range drainQueue(pq) {
+		if p != expected[i] {
+			t.Fatalf("expected the peers to be ordered by distance, got %s at %d", p, i)
+		}
+	}
+}
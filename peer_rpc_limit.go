@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// peerRPCLimiter bounds the RPCs the queries of a DHT have in flight to every
+// peer, all queries together.
+type peerRPCLimiter struct {
+	limit int
+
+	mu    sync.Mutex
+	slots map[peer.ID]*peerRPCSlots
+}
+
+type peerRPCSlots struct {
+	sem  chan struct{}
+	refs int // RPCs holding or waiting for a slot
+}
+
+func newPeerRPCLimiter(limit int) *peerRPCLimiter {
+	return &peerRPCLimiter{limit: limit, slots: make(map[peer.ID]*peerRPCSlots)}
+}
+
+// acquire waits for a free slot to send an RPC to p, or for ctx to be done.
+// Every successful acquire must be followed by a release.
+func (l *peerRPCLimiter) acquire(ctx context.Context, p peer.ID) error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	s, ok := l.slots[p]
+	if !ok {
+		s = &peerRPCSlots{sem: make(chan struct{}, l.limit)}
+		l.slots[p] = s
+	}
+	s.refs++
+	l.mu.Unlock()
+
+	select {
+	case s.sem <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		l.unref(p, s)
+		return ctx.Err()
+	}
+}
+
+// release frees the slot of an RPC to p.
+func (l *peerRPCLimiter) release(p peer.ID) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	s := l.slots[p]
+	l.mu.Unlock()
+	<-s.sem
+	l.unref(p, s)
+}
+
+// unref forgets the slots of p once no RPC needs them anymore.
+func (l *peerRPCLimiter) unref(p peer.ID, s *peerRPCSlots) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s.refs--
+	if s.refs == 0 {
+		delete(l.slots, p)
+	}
+}
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestPeerRPCLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const limit = 2
+	d.peerRPCs = newPeerRPCLimiter(limit)
+
+	// a fake peer all the queries go through.
+	p := tu.RandPeerIDFatal(t)
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+	qfunc := func(ctx context.Context, _ peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return &dhtQueryResult{}, nil
+	}
+	dial := WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.newQuery("foo", qfunc, dial).Run(ctx, []peer.ID{p})
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen != limit {
+		t.Errorf("expected at most %d RPCs in flight to the peer, got %d", limit, maxSeen)
+	}
+	if n := len(d.peerRPCs.slots); n != 0 {
+		t.Errorf("expected the slots of the peer to be released, got %d peers", n)
+	}
+}
+
+func TestPeerRPCLimitCancel(t *testing.T) {
+	l := newPeerRPCLimiter(1)
+	p := tu.RandPeerIDFatal(t)
+	if err := l.acquire(context.Background(), p); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := l.acquire(ctx, p); err != context.DeadlineExceeded {
+		t.Fatalf("expected the wait to time out, got %v", err)
+	}
+
+	l.release(p)
+	if n := len(l.slots); n != 0 {
+		t.Errorf("expected the slots of the peer to be released, got %d peers", n)
+	}
+}
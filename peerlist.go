@@ -0,0 +1,91 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ErrInvalidPeerList is returned when a compressed peer list can't be decoded.
+var ErrInvalidPeerList = errors.New("invalid compressed peer list")
+
+// CompressPeerList encodes peers relative to key: for every peer only the
+// bytes following the prefix it shares with key are written. This pays off
+// when the peers are close to the key in the identifier space, as they are in
+// FIND_NODE responses.
+//
+// The encoding is a varint count followed, for every peer, by the varint
+// length of the shared prefix, the varint length of the suffix, and the
+// suffix itself.
+func CompressPeerList(key string, peers []peer.ID) []byte {
+	buf := make([]byte, 0, len(peers)*(len(key)+2*binary.MaxVarintLen16))
+	buf = appendUvarint(buf, uint64(len(peers)))
+	for _, p := range peers {
+		id := string(p)
+		prefix := commonPrefixLen(key, id)
+		buf = appendUvarint(buf, uint64(prefix))
+		buf = appendUvarint(buf, uint64(len(id)-prefix))
+		buf = append(buf, id[prefix:]...)
+	}
+	return buf
+}
+
+// DecompressPeerList decodes a list of peers encoded with CompressPeerList
+// using the same key.
+func DecompressPeerList(key string, data []byte) ([]peer.ID, error) {
+	count, data, err := readUvarint(data)
+	if err != nil {
+		return nil, err
+	}
+	// every peer takes at least two bytes, don't trust larger counts.
+	if count > uint64(len(data)/2) {
+		return nil, fmt.Errorf("%s: %d peers can't fit in %d bytes", ErrInvalidPeerList, count, len(data))
+	}
+
+	peers := make([]peer.ID, 0, count)
+	for i := uint64(0); i < count; i++ {
+		var prefix, suffix uint64
+		if prefix, data, err = readUvarint(data); err != nil {
+			return nil, err
+		}
+		if suffix, data, err = readUvarint(data); err != nil {
+			return nil, err
+		}
+		if prefix > uint64(len(key)) {
+			return nil, fmt.Errorf("%s: prefix length %d exceeds key length %d", ErrInvalidPeerList, prefix, len(key))
+		}
+		if suffix > uint64(len(data)) {
+			return nil, fmt.Errorf("%s: truncated peer id", ErrInvalidPeerList)
+		}
+		peers = append(peers, peer.ID(key[:prefix]+string(data[:suffix])))
+		data = data[suffix:]
+	}
+	if len(data) != 0 {
+		return nil, fmt.Errorf("%s: %d trailing bytes", ErrInvalidPeerList, len(data))
+	}
+	return peers, nil
+}
+
+func commonPrefixLen(a, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
+
+func readUvarint(data []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(data)
+	if n <= 0 {
+		return 0, nil, fmt.Errorf("%s: bad varint", ErrInvalidPeerList)
+	}
+	return v, data[n:], nil
+}
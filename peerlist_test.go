@@ -0,0 +1,66 @@
+package dht
+
+import (
+	"testing"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestCompressPeerList(t *testing.T) {
+	key := string(tu.RandPeerIDFatal(t))
+	peers := []peer.ID{
+		peer.ID(key),                    // identical to the key
+		peer.ID(key[:len(key)-1] + "x"), // shares all but one byte
+		tu.RandPeerIDFatal(t),           // shares the multihash prefix
+		peer.ID("short"),                // shares nothing
+	}
+
+	data := CompressPeerList(key, peers)
+	var raw int
+	for _, p := range peers {
+		raw += len(p)
+	}
+	if len(data) >= raw {
+		t.Errorf("expected compression, got %d bytes for %d bytes of peer ids", len(data), raw)
+	}
+
+	out, err := DecompressPeerList(key, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(out) != len(peers) {
+		t.Fatalf("expected %d peers, got %d", len(peers), len(out))
+	}
+	for i := range peers {
+		if out[i] != peers[i] {
+			t.Errorf("peer %d: expected %s, got %s", i, peers[i], out[i])
+		}
+	}
+
+	empty, err := DecompressPeerList(key, CompressPeerList(key, nil))
+	if err != nil || len(empty) != 0 {
+		t.Errorf("expected an empty list to round trip, got %v, %v", empty, err)
+	}
+}
+
+func TestDecompressPeerListInvalid(t *testing.T) {
+	key := string(tu.RandPeerIDFatal(t))
+	data := CompressPeerList(key, []peer.ID{tu.RandPeerIDFatal(t)})
+
+	for name, bad := range map[string][]byte{
+		"empty":     nil,
+		"truncated": data[:len(data)-1],
+		"trailing":  append(append([]byte(nil), data...), 0),
+		"count":     {0xff, 0x01},
+	} {
+		if _, err := DecompressPeerList(key, bad); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	// the prefix can't be longer than the key it refers to.
+	if _, err := DecompressPeerList("ab", CompressPeerList("abc", []peer.ID{"abc"})); err == nil {
+		t.Error("expected an error for a prefix longer than the key")
+	}
+}
@@ -0,0 +1,46 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ProbeResult is the outcome of a Probe.
+type ProbeResult struct {
+	Target peer.ID
+	// Closest are the K closest peers to the target the lookup found,
+	// closest first.
+	Closest []peer.ID
+	// Found is whether the target is among Closest, i.e. whether the peers
+	// around its position in the keyspace know of it and it answered.
+	Found bool
+	// Elapsed is how long the lookup took.
+	Elapsed time.Duration
+}
+
+// Probe checks that target is properly integrated into the DHT: it looks up
+// the K closest peers to the ID of target, and reports whether target is one
+// of them, as it should be if it's reachable and its neighbors know of it.
+// It always runs a fresh lookup, bypassing the query cache.
+func (dht *IpfsDHT) Probe(ctx context.Context, target peer.ID) (*ProbeResult, error) {
+	key := string(target)
+	seeds := dht.LocalClosestPeers(key, dht.alpha)
+	if len(seeds) == 0 {
+		return nil, kb.ErrLookupFailure
+	}
+
+	start := time.Now()
+	res := &ProbeResult{Target: target}
+	for p := range dht.getClosestPeers(ctx, key, seeds) {
+		res.Closest = append(res.Closest, p)
+		res.Found = res.Found || p == target
+	}
+	res.Elapsed = time.Since(start)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
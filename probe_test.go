@@ -0,0 +1,53 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestProbe(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+
+	target := dhts[3].self
+	res, err := dhts[0].Probe(ctx, target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !res.Found || res.Target != target {
+		t.Errorf("expected %s to be found, got %+v", target, res)
+	}
+	if len(res.Closest) == 0 || res.Closest[0] != target {
+		t.Errorf("expected %s to be the closest peer to itself, got %v", target, res.Closest)
+	}
+	if res.Elapsed <= 0 {
+		t.Error("expected the elapsed time to be set")
+	}
+
+	// a peer that isn't part of the DHT.
+	stranger := tu.RandPeerIDFatal(t)
+	res, err = dhts[0].Probe(ctx, stranger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Found {
+		t.Errorf("expected %s not to be found, got %+v", stranger, res)
+	}
+	if len(res.Closest) != len(dhts)-1 {
+		t.Errorf("expected the other peers as the closest ones, got %v", res.Closest)
+	}
+}
@@ -0,0 +1,204 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	ggio "github.com/gogo/protobuf/io"
+	cid "github.com/ipfs/go-cid"
+	ctxio "github.com/jbenet/go-context/io"
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	protocol "github.com/libp2p/go-libp2p-protocol"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+// ProtocolDHTProxy is the protocol of the lookups a DHT node runs on behalf
+// of the peers that use it as their proxy, see the Proxy and ServeProxy DHT
+// options. Requests and responses are DHT messages: a request is the message
+// we'd have sent to the peers of the lookup, FIND_NODE, GET_PROVIDERS or
+// GET_VALUE, and its response carries the result of the whole lookup. A
+// PUT_VALUE request has the proxy put its record, and the response echoes
+// the record once it's put.
+var ProtocolDHTProxy protocol.ID = "/ipfs/kad/proxy/1.0.0"
+
+// proxyLookupTimeout bounds the lookups a proxy runs for another peer.
+var proxyLookupTimeout = time.Minute
+
+// proxyRequest has our proxy run the lookup of req and returns its result.
+func (dht *IpfsDHT) proxyRequest(ctx context.Context, req *pb.Message) (*pb.Message, error) {
+	s, err := dht.host.NewStream(ctx, dht.proxy, ProtocolDHTProxy)
+	if err != nil {
+		return nil, err
+	}
+
+	w := newBufferedDelimitedWriter(s)
+	if err = w.WriteMsg(req); err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		s.Reset()
+		return nil, err
+	}
+
+	r := ggio.NewDelimitedReader(ctxio.NewReader(ctx, s), inet.MessageSizeMax)
+	resp := new(pb.Message)
+	if err := r.ReadMsg(resp); err != nil {
+		s.Reset()
+		return nil, err
+	}
+	s.Close()
+	return resp, nil
+}
+
+// proxyClosestPeers has our proxy look up the closest peers to key.
+func (dht *IpfsDHT) proxyClosestPeers(ctx context.Context, key string) ([]*pstore.PeerInfo, error) {
+	resp, err := dht.proxyRequest(ctx, pb.NewMessage(pb.Message_FIND_NODE, []byte(key), 0))
+	if err != nil {
+		return nil, err
+	}
+	peers := pb.PBPeersToPeerInfos(resp.GetCloserPeers())
+	for _, pi := range peers {
+		if pi.ID != dht.self {
+			dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+		}
+	}
+	return peers, nil
+}
+
+// proxyFindProviders has our proxy look up the providers of key.
+func (dht *IpfsDHT) proxyFindProviders(ctx context.Context, key cid.Cid) ([]*pstore.PeerInfo, error) {
+	resp, err := dht.proxyRequest(ctx, pb.NewMessage(pb.Message_GET_PROVIDERS, key.Bytes(), 0))
+	if err != nil {
+		return nil, err
+	}
+	provs := pb.PBPeersToPeerInfos(resp.GetProviderPeers())
+	for _, pi := range provs {
+		if pi.ID != dht.self {
+			dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+		}
+	}
+	return provs, nil
+}
+
+// proxyGetValue has our proxy look up the value of key, and validates it.
+func (dht *IpfsDHT) proxyGetValue(ctx context.Context, key string) ([]byte, error) {
+	resp, err := dht.proxyRequest(ctx, pb.NewMessage(pb.Message_GET_VALUE, []byte(key), 0))
+	if err != nil {
+		return nil, err
+	}
+	rec := resp.GetRecord()
+	if rec == nil {
+		return nil, routing.ErrNotFound
+	}
+	if err := dht.Validator.Validate(key, rec.GetValue()); err != nil {
+		return nil, err
+	}
+	return rec.GetValue(), nil
+}
+
+// proxyPutValue has our proxy put rec, the record of key, to the peers
+// closest to key.
+func (dht *IpfsDHT) proxyPutValue(ctx context.Context, key string, rec *recpb.Record) error {
+	req := pb.NewMessage(pb.Message_PUT_VALUE, []byte(key), 0)
+	req.Record = rec
+	_, err := dht.proxyRequest(ctx, req)
+	return err
+}
+
+// handleProxyStream runs the lookup a peer that uses us as its proxy asked
+// for, and answers with its result.
+func (dht *IpfsDHT) handleProxyStream(s inet.Stream) {
+	if err := dht.serveProxyRequest(s); err != nil {
+		logger.Debugf("error serving proxy request of %s: %s", s.Conn().RemotePeer(), err)
+		s.Reset()
+		return
+	}
+	s.Close()
+}
+
+func (dht *IpfsDHT) serveProxyRequest(s inet.Stream) error {
+	ctx, cancel := context.WithTimeout(dht.Context(), proxyLookupTimeout)
+	defer cancel()
+
+	r := ggio.NewDelimitedReader(ctxio.NewReader(ctx, s), inet.MessageSizeMax)
+	var req pb.Message
+	if err := r.ReadMsg(&req); err != nil {
+		return err
+	}
+
+	resp, err := dht.runProxiedLookup(ctx, &req)
+	if err != nil {
+		return err
+	}
+
+	w := newBufferedDelimitedWriter(ctxio.NewWriter(ctx, s))
+	if err := w.WriteMsg(resp); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// runProxiedLookup runs the lookup of req and returns its result.
+func (dht *IpfsDHT) runProxiedLookup(ctx context.Context, req *pb.Message) (*pb.Message, error) {
+	resp := pb.NewMessage(req.GetType(), req.GetKey(), req.GetClusterLevel())
+	switch req.GetType() {
+	case pb.Message_FIND_NODE:
+		key := string(req.GetKey())
+		closest, err := dht.GetClosestPeers(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		var infos []pstore.PeerInfo
+		found := false
+		for p := range closest {
+			found = found || p == peer.ID(key)
+			infos = append(infos, dht.peerstore.PeerInfo(p))
+		}
+		// the key may be a peer the lookup connected to without it being
+		// among the closest ones, e.g. a client.
+		if pi := dht.FindLocal(peer.ID(key)); !found && pi.ID != "" {
+			infos = append(infos, pi)
+		}
+		resp.CloserPeers = pb.PeerInfosToPBPeers(dht.host.Network(), infos)
+
+	case pb.Message_GET_PROVIDERS:
+		c, err := cid.Cast(req.GetKey())
+		if err != nil {
+			return nil, err
+		}
+		provs, err := dht.FindProviders(ctx, c)
+		if err != nil {
+			return nil, err
+		}
+		resp.ProviderPeers = pb.PeerInfosToPBPeers(dht.host.Network(), provs)
+
+	case pb.Message_GET_VALUE:
+		val, err := dht.GetValue(ctx, string(req.GetKey()))
+		switch err {
+		case nil:
+			resp.Record = &recpb.Record{Key: req.GetKey(), Value: val}
+		case routing.ErrNotFound:
+		default:
+			return nil, err
+		}
+
+	case pb.Message_PUT_VALUE:
+		rec := req.GetRecord()
+		if rec == nil {
+			return nil, fmt.Errorf("nil record")
+		}
+		if err := dht.PutValue(ctx, string(req.GetKey()), rec.GetValue()); err != nil {
+			return nil, err
+		}
+		resp.Record = rec
+
+	default:
+		return nil, fmt.Errorf("can't proxy messages of type %v", req.GetType())
+	}
+	return resp, nil
+}
@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+func TestProxy(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	newDHT := func(options ...opts.Option) *IpfsDHT {
+		options = append(options, opts.NamespacedValidator("v", blankValidator{}))
+		d, err := New(ctx, bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)), options...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+
+	// a chain of DHTs, the first of which serves as a proxy.
+	dhts := setupDHTS(t, ctx, 3)
+	proxy := newDHT(opts.ServeProxy(true))
+	dhts = append([]*IpfsDHT{proxy}, dhts...)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for i := 1; i < len(dhts); i++ {
+		connect(t, ctx, dhts[i-1], dhts[i])
+	}
+	last := dhts[len(dhts)-1]
+	if err := last.PutValue(ctx, "/v/hello", []byte("world")); err != nil {
+		t.Fatal(err)
+	}
+	if err := last.Provide(ctx, testCaseCids[0], false); err != nil {
+		t.Fatal(err)
+	}
+
+	// the client only knows about the proxy.
+	client := newDHT(opts.Client(true), opts.Proxy(proxy.self))
+	defer client.Close()
+	defer client.host.Close()
+	client.peerstore.AddAddrs(proxy.self, proxy.host.Addrs(), pstore.PermanentAddrTTL)
+
+	closest, err := client.GetClosestPeers(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for range closest {
+		n++
+	}
+	if n == 0 {
+		t.Error("expected the proxy to find the closest peers")
+	}
+
+	pi, err := client.FindPeer(ctx, last.self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pi.Addrs) == 0 {
+		t.Error("expected the addresses of the peer found by the proxy")
+	}
+
+	provs, err := client.FindProviders(ctx, testCaseCids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 1 || provs[0].ID != last.self {
+		t.Errorf("expected the proxy to find %s as the provider, got %v", last.self, provs)
+	}
+
+	val, err := client.GetValue(ctx, "/v/hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "world" {
+		t.Errorf("expected the proxy to find the value, got %q", val)
+	}
+
+	// the client can't reach the closest peers to put a value, the proxy can.
+	if err := client.PutValue(ctx, "/v/proxied", []byte("value")); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range client.host.Network().Peers() {
+		if p != proxy.self {
+			t.Errorf("expected the client to only talk to the proxy, got connected to %s", p)
+		}
+	}
+	val, err = last.GetValue(ctx, "/v/proxied", Quorum(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val) != "value" {
+		t.Errorf("expected the value put through the proxy to be found, got %q", val)
+	}
+
+	// peers that don't serve as proxies don't run lookups for others.
+	client.proxy = dhts[1].self
+	client.peerstore.AddAddrs(dhts[1].self, dhts[1].host.Addrs(), pstore.PermanentAddrTTL)
+	if _, err := client.GetClosestPeers(ctx, "foo"); err == nil {
+		t.Error("expected a peer that doesn't serve as a proxy to refuse the lookup")
+	}
+}
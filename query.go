@@ -1,14 +1,21 @@
 package dht
 
 import (
+	"container/heap"
 	"context"
+	"errors"
+	"math/rand"
+	"runtime/pprof"
+	"sort"
 	"sync"
+	"time"
+
+	"golang.org/x/xerrors"
 
-	u "github.com/ipfs/go-ipfs-util"
-	logging "github.com/ipfs/go-log"
 	todoctr "github.com/ipfs/go-todocounter"
 	process "github.com/jbenet/goprocess"
 	ctxproc "github.com/jbenet/goprocess/context"
+	kb "github.com/libp2p/go-libp2p-kbucket"
 	inet "github.com/libp2p/go-libp2p-net"
 	peer "github.com/libp2p/go-libp2p-peer"
 	pset "github.com/libp2p/go-libp2p-peer/peerset"
@@ -18,13 +25,59 @@ import (
 	notif "github.com/libp2p/go-libp2p-routing/notifications"
 )
 
-var maxQueryConcurrency = AlphaValue
+// errNoAddresses is the error of the peers dialPeer skips because we don't
+// know any of their addresses.
+var errNoAddresses = errors.New("no known addresses")
+
+// errStale is the error of the peers dialPeer skips as the query moved past
+// them, see WithStaleDialPruning.
+var errStale = errors.New("peer farther than the closest peers found")
+
+// errMaxDialAttempts is the error of the peers the query gave up on as it
+// dialed them too many times already, see WithMaxDialAttempts.
+var errMaxDialAttempts = errors.New("max dial attempts exceeded")
+
+// DefaultMaxDialAttempts is how many times a query dials a peer at most,
+// unless configured otherwise with WithMaxDialAttempts: once to get ready to
+// query it, and once more if the connection dropped before the RPC.
+var DefaultMaxDialAttempts = 2
 
 type dhtQuery struct {
-	dht         *IpfsDHT
-	key         string    // the key we're querying for
-	qfunc       queryFunc // the function to execute per peer
-	concurrency int       // the concurrency parameter
+	deps            *queryDeps       // what the query needs of its DHT
+	host            dhtHost          // reaches the peers, the host of the DHT unless testing
+	key             string           // the key we're querying for
+	convertedKey    kb.ID            // the key in the XOR keyspace, hashed once for the whole query
+	qfunc           queryFunc        // the function to execute per peer
+	concurrency     int              // the concurrency parameter
+	kValue          int              // how many closest peers the query is after
+	timeout         time.Duration    // deadline for the whole query, if non-zero
+	perPeerTimeout  time.Duration    // deadline for each qfunc call, if non-zero
+	audit           *AuditLog        // records the steps of the query, if set
+	filter          PeerFilter       // peers it rejects aren't queried, if set
+	resume          *QueryCheckpoint // state of an interrupted query to pick up from, if set
+	speculative     float64          // hedge against slow peers by this factor, if greater than 1
+	onDialSuccess   DialSuccessHook  // called when a peer was dialed, if set
+	onDialFailure   DialFailureHook  // called when a peer couldn't be dialed, if set
+	dialFunc        DialFunc         // connects to peers instead of the host, if set
+	minSuccessful   int              // peers that must answer for the query to succeed, if non-zero
+	closerThanSelf  bool             // skip learned peers farther from the key than us
+	pruneStale      bool             // skip dialing peers K closer peers answered before
+	eventFilter     QueryEventFilter // drops the events it returns false for, if set
+	watchdogTimeout time.Duration    // warn about the query if it runs longer, if non-zero
+	rateLimitJitter time.Duration    // wait up to this long before each query, if non-zero
+	addrFamily      addrFamily       // the only IP version to dial peers over, if set
+	maxDialAttempts int              // times each peer may be dialed, if non-zero
+
+	appFilter     QueryPeerFilter     // application filter of the peers, if set
+	appFilterMode QueryPeerFilterMode // what appFilter applies to
+
+	logger Logger // logs the progress of the query, if set
+
+	mu       sync.Mutex
+	seeds    []peer.ID          // peers to query first, in addition to the ones passed to Run
+	runner   *dhtQueryRunner    // the active runner, if running
+	cancel   context.CancelFunc // cancels the context of the active runner
+	canceled bool               // whether Cancel was called
 }
 
 type dhtQueryResult struct {
@@ -33,19 +86,213 @@ type dhtQueryResult struct {
 	providerPeers []pstore.PeerInfo  // GetProviders
 	closerPeers   []*pstore.PeerInfo // *
 	success       bool
+	// final, with no closer peers, is a definitive "not found" from the peer:
+	// the query stops without asking anybody else, and fails with
+	// routing.ErrNotFound.
+	final bool
+
+	finalSet    *pset.PeerSet
+	queriedSet  *pset.PeerSet
+	failedPeers map[peer.ID]error
+	peerErrors  []PeerError
+	peerTimings []PeerTiming
+	unqueried   []UnqueriedPeer
+	hops        int
+	peersPerHop []int
+}
+
+// Hops returns the number of times the query found a peer closer to the key
+// than any it had seen before, i.e. the number of rounds it took to converge.
+func (r *dhtQueryResult) Hops() int {
+	return r.hops
+}
+
+// PeersPerHop returns the number of peers the query added during each hop,
+// starting with the seed peers at index 0. A hop starts with a peer closer to
+// the key than any before, and includes the peers added after it until the
+// next one. Few peers per hop suggest a sparse routing table.
+func (r *dhtQueryResult) PeersPerHop() []int {
+	return r.peersPerHop
+}
+
+// UnqueriedClosest returns the peers among the K closest to the key the query
+// knew of, including the ones it filtered out, that it didn't query, closest
+// first, with the reason each was skipped. They tell why the query settled on
+// the peers it did rather than on closer ones.
+func (r *dhtQueryResult) UnqueriedClosest() []UnqueriedPeer {
+	return r.unqueried
+}
+
+// PeerTimings returns the time the query spent dialing and querying each of
+// the peers it contacted, slowest first.
+func (r *dhtQueryResult) PeerTimings() []PeerTiming {
+	return r.peerTimings
+}
+
+// PeerErrors returns the errors the query got from the peers it dialed and
+// queried, in the order they happened.
+func (r *dhtQueryResult) PeerErrors() []PeerError {
+	return r.peerErrors
+}
+
+// QueryOption configures a single query.
+type QueryOption func(*dhtQuery)
 
-	finalSet   *pset.PeerSet
-	queriedSet *pset.PeerSet
+// WithOnlyCloserThanSelf makes the query skip the peers it learns of that are
+// farther from the key than we are, saving the dials in small networks where
+// the answers keep pointing back past us. The seed peers are always queried.
+//
+// This must not be used by lookups for the K closest peers to a key: when we
+// are among them, the others may well be farther from the key than us.
+func WithOnlyCloserThanSelf() QueryOption {
+	return func(q *dhtQuery) {
+		q.closerThanSelf = true
+	}
+}
+
+// WithStaleDialPruning makes the query drop, instead of dialing, the peers
+// that got their turn after K peers closer to the key than them answered:
+// they can't be among the K closest peers the query finds any more. The
+// dials in flight to such peers are aborted too, freeing their slots for
+// closer peers. It saves dials late in lookups for the K closest peers, the
+// peers are dialed closest first anyway.
+//
+// The dropped peers may know of closer peers the query would not find
+// otherwise, in sparse networks where peers don't know their neighbors in
+// the keyspace. This must not be used by queries looking for more than the
+// K closest peers, e.g. for every provider of a key.
+func WithStaleDialPruning() QueryOption {
+	return func(q *dhtQuery) {
+		q.pruneStale = true
+	}
+}
+
+// WithKValue makes the query look for the k closest peers to the key rather
+// than for the K closest, the bucket size of the DHT. It bounds the peers a
+// lookup returns, and the ones that must answer before the farther ones are
+// considered stale, see WithStaleDialPruning.
+func WithKValue(k int) QueryOption {
+	return func(q *dhtQuery) {
+		q.kValue = k
+	}
+}
+
+// WithInitialPeerInfos makes the query start with the given peers, e.g. a
+// list of bootstrap peers, whose addresses needn't be in the peerstore yet.
+// See AddPeerInfos.
+func WithInitialPeerInfos(infos []pstore.PeerInfo) QueryOption {
+	return func(q *dhtQuery) {
+		q.AddPeerInfos(infos)
+	}
+}
+
+// WithMinSuccessfulPeers makes the query fail with ErrInsufficientPeers if
+// fewer than n peers answered it by the time it ran out of peers to ask,
+// rather than returning whatever the few peers that answered knew. Writes can
+// use it for quorum-style guarantees, e.g. with n = K/2. Queries that end
+// early because a peer gave them what they were looking for aren't affected.
+//
+// By default, queries don't require any number of answers: those that ran
+// out of peers fail with routing.ErrNotFound, or with ErrLookupFailure if
+// every peer failed.
+func WithMinSuccessfulPeers(n int) QueryOption {
+	return func(q *dhtQuery) {
+		q.minSuccessful = n
+	}
+}
+
+// WithRateLimitJitter makes the query wait a random duration in [0, jitter)
+// before it queries each peer, so that nodes that all start at once, e.g.
+// after a deployment, don't hit the bootstrap peers in synchronized waves.
+//
+// Defaults to zero, i.e. no waiting.
+func WithRateLimitJitter(jitter time.Duration) QueryOption {
+	return func(q *dhtQuery) {
+		q.rateLimitJitter = jitter
+	}
+}
+
+// WithMaxDialAttempts makes the query dial each peer at most n times,
+// counting both the dial that gets it ready to be queried and the one the RPC
+// makes if the connection dropped in between, e.g. with a flapping peer. The
+// query then fails the peer with "max dial attempts exceeded". Zero means no
+// limit.
+//
+// Defaults to DefaultMaxDialAttempts.
+func WithMaxDialAttempts(n int) QueryOption {
+	return func(q *dhtQuery) {
+		q.maxDialAttempts = n
+	}
 }
 
 // constructs query
-func (dht *IpfsDHT) newQuery(k string, f queryFunc) *dhtQuery {
-	return &dhtQuery{
-		key:         k,
-		dht:         dht,
-		qfunc:       f,
-		concurrency: maxQueryConcurrency,
+func (dht *IpfsDHT) newQuery(k string, f queryFunc, options ...QueryOption) *dhtQuery {
+	return makeQuery(dht.queryDeps(), k, f, options...)
+}
+
+// makeQuery constructs a query out of its dependencies rather than a DHT.
+func makeQuery(deps *queryDeps, k string, f queryFunc, options ...QueryOption) *dhtQuery {
+	q := &dhtQuery{
+		key:             k,
+		convertedKey:    kb.ConvertKey(k),
+		deps:            deps,
+		host:            deps.host,
+		qfunc:           f,
+		concurrency:     deps.concurrency,
+		kValue:          deps.kValue,
+		perPeerTimeout:  deps.perPeerTimeout,
+		filter:          deps.filter,
+		speculative:     deps.speculative,
+		dialFunc:        deps.dialFunc,
+		watchdogTimeout: DefaultWatchdogTimeout,
+		maxDialAttempts: DefaultMaxDialAttempts,
+	}
+	for _, opt := range options {
+		opt(q)
+	}
+	return q
+}
+
+// closer reports whether a is closer to the key of the query than b.
+func (q *dhtQuery) closer(a, b peer.ID) bool {
+	return q.closerID(kb.ConvertPeerID(a), kb.ConvertPeerID(b))
+}
+
+// closerID is closer for peer IDs already converted to the XOR keyspace.
+func (q *dhtQuery) closerID(ida, idb kb.ID) bool {
+	for i := range q.convertedKey {
+		da, db := ida[i]^q.convertedKey[i], idb[i]^q.convertedKey[i]
+		if da != db {
+			return da < db
+		}
 	}
+	return false
+}
+
+// adaptiveTimeoutFactor is how many times its average latency a peer gets to
+// answer with adaptive peer timeouts.
+const adaptiveTimeoutFactor = 4
+
+// peerTimeout returns the deadline of the RPC to p: a multiple of its
+// average latency if adaptive timeouts are enabled and we know it, or the
+// query's per-peer timeout otherwise.
+func (q *dhtQuery) peerTimeout(p peer.ID) time.Duration {
+	d := q.deps
+	if d.maxPeerTimeout == 0 {
+		return q.perPeerTimeout
+	}
+	ewma := d.peerstore.LatencyEWMA(p)
+	if ewma == 0 {
+		return q.perPeerTimeout
+	}
+	timeout := adaptiveTimeoutFactor * ewma
+	if timeout < d.minPeerTimeout {
+		return d.minPeerTimeout
+	}
+	if timeout > d.maxPeerTimeout {
+		return d.maxPeerTimeout
+	}
+	return timeout
 }
 
 // QueryFunc is a function that runs a particular query with a given peer.
@@ -63,13 +310,101 @@ func (q *dhtQuery) Run(ctx context.Context, peers []peer.ID) (*dhtQueryResult, e
 	default:
 	}
 
-	ctx, cancel := context.WithCancel(ctx)
+	var cancel context.CancelFunc
+	if q.timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, q.timeout)
+	} else {
+		ctx, cancel = context.WithCancel(ctx)
+	}
 	defer cancel()
 
-	runner := newQueryRunner(q)
-	return runner.Run(ctx, peers)
+	if q.audit == nil {
+		q.audit = auditLogFromContext(ctx)
+	}
+
+	runner, err := newQueryRunner(q)
+	if err != nil {
+		return nil, err
+	}
+	q.mu.Lock()
+	if len(q.seeds) > 0 {
+		peers = append(append([]peer.ID(nil), q.seeds...), peers...)
+	}
+	if q.canceled {
+		q.mu.Unlock()
+		runner.proc.Close()
+		return nil, context.Canceled
+	}
+	if q.deps.dedup.duplicate(q.key, peers, q.qfunc) {
+		q.mu.Unlock()
+		runner.proc.Close()
+		return nil, ErrDuplicateQuery
+	}
+	q.runner, q.cancel = runner, cancel
+	q.mu.Unlock()
+	defer func() {
+		q.mu.Lock()
+		q.runner, q.cancel = nil, nil
+		q.mu.Unlock()
+	}()
+
+	res, err := runner.Run(ctx, peers)
+	if res != nil && q.appFilter != nil && q.appFilterMode&FilterResults != 0 {
+		res.filterPeers(q.appFilter)
+	}
+	return res, err
+}
+
+// AddPeerInfos adds the addresses in infos to the peerstore, and the peers to
+// the ones the query starts with. It must be called before Run.
+func (q *dhtQuery) AddPeerInfos(infos []pstore.PeerInfo) {
+	ids := make([]peer.ID, 0, len(infos))
+	for _, pi := range infos {
+		q.host.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+		ids = append(ids, pi.ID)
+	}
+	q.mu.Lock()
+	q.seeds = append(q.seeds, ids...)
+	q.mu.Unlock()
+}
+
+// Cancel stops the query, as if the context passed to Run had been
+// cancelled: Run returns context.Canceled. It waits for the in-flight RPCs to
+// be aborted, so it must not be called from the query function. Cancel may be
+// called from any goroutine, and before Run, in which case Run returns right
+// away.
+func (q *dhtQuery) Cancel() {
+	q.mu.Lock()
+	q.canceled = true
+	runner, cancel := q.runner, q.cancel
+	q.mu.Unlock()
+
+	if runner == nil {
+		return
+	}
+	// cancel first, so that Run reports the cancellation.
+	cancel()
+	runner.proc.Close()
 }
 
+// cancellationReason tells why ctx, the context of the query, was cancelled.
+func (q *dhtQuery) cancellationReason(ctx context.Context) CancellationReason {
+	q.mu.Lock()
+	canceled := q.canceled
+	q.mu.Unlock()
+	switch {
+	case canceled:
+		return ManualCancel
+	case ctx.Err() == context.DeadlineExceeded:
+		return ContextTimeout
+	default:
+		return ContextCanceled
+	}
+}
+
+// dhtQueryRunner is shared by the goroutines of a query: its sets of peers
+// lock themselves, everything else, like the failed peers the dial and query
+// workers record, is guarded by its lock.
 type dhtQueryRunner struct {
 	query          *dhtQuery        // query to run
 	peersSeen      *pset.PeerSet    // all peers queried. prevent querying same peer 2x
@@ -78,11 +413,30 @@ type dhtQueryRunner struct {
 	peersToQuery   *queue.ChanQueue // peers remaining to be queried
 	peersRemaining todoctr.Counter  // peersToQuery + currently processing
 
-	result *dhtQueryResult // query result
-	errs   u.MultiErr      // result errors. maybe should be a map[peer.ID]error
+	result     *dhtQueryResult   // query result
+	peerErrors []PeerError       // the errors of the failed peers, in order
+	failed     map[peer.ID]error // the error of every failed peer
+	succeeded  int               // peers that answered
+	noAddrs    int               // peers skipped as we knew no addresses for them
+	timings    map[peer.ID]*PeerTiming
+	dials      map[peer.ID]int           // times we dialed each peer
+	inFlight   map[peer.ID]*inFlightDial // dials we may abort, with WithStaleDialPruning
+	skipped    map[peer.ID]SkipReason    // why the peers we know of weren't queried, if known
+	waiting    map[peer.ID]struct{}      // peers in peersToQuery no dial worker took yet
+	waitingQ   waitingHeap               // the waiting peers, and some that aren't anymore
+
+	cancelReason CancellationReason // why the query was cancelled, if it was
+	notFound     bool               // whether a peer told us for sure there's nothing to find
+
+	closest     peer.ID // the closest peer to the key added so far
+	seeded      bool    // whether we're done adding the initial peers
+	hops        int     // peers added that were closer than any before, after seeding
+	peersPerHop []int   // peers added during each hop, the seeds during hop 0
+
+	hedge *hedge // the current group of speculative workers
 
 	rateLimit chan struct{} // processing semaphore
-	log       logging.EventLogger
+	log       Logger
 
 	runCtx context.Context
 
@@ -90,61 +444,139 @@ type dhtQueryRunner struct {
 	sync.RWMutex
 }
 
-func newQueryRunner(q *dhtQuery) *dhtQueryRunner {
+// newDialQueueFunc makes the dial queues of queries, tests replace it.
+var newDialQueueFunc = newDialQueue
+
+func newQueryRunner(q *dhtQuery) (*dhtQueryRunner, error) {
+	if err := q.deps.startRunner(); err != nil {
+		return nil, err
+	}
 	proc := process.WithParent(process.Background())
+	proc.SetTeardown(func() error {
+		q.deps.runnerDone()
+		return nil
+	})
 	ctx := ctxproc.OnClosingContext(proc)
-	peersToQuery := queue.NewChanQueue(ctx, queue.NewXORDistancePQ(string(q.key)))
+	peersToQuery := queue.NewChanQueue(ctx, q.deps.newPeerQueue(q.key, q.convertedKey))
 	r := &dhtQueryRunner{
 		query:          q,
 		peersRemaining: todoctr.NewSyncCounter(),
 		peersSeen:      pset.New(),
 		peersQueried:   pset.New(),
-		rateLimit:      make(chan struct{}, q.concurrency),
+		failed:         make(map[peer.ID]error),
+		timings:        make(map[peer.ID]*PeerTiming),
+		skipped:        make(map[peer.ID]SkipReason),
+		dials:          make(map[peer.ID]int),
+		inFlight:       make(map[peer.ID]*inFlightDial),
+		waiting:        make(map[peer.ID]struct{}),
+		waitingQ:       waitingHeap{closer: q.closerID},
+		rateLimit:      make(chan struct{}, q.workers()),
 		peersToQuery:   peersToQuery,
 		proc:           proc,
 	}
-	dq, err := newDialQueue(&dqParams{
-		ctx:    ctx,
-		target: q.key,
-		in:     peersToQuery,
-		dialFn: r.dialPeer,
-		config: dqDefaultConfig(),
+	dq, err := newDialQueueFunc(&dqParams{
+		ctx:     ctx,
+		target:  q.key,
+		in:      peersToQuery,
+		dialFn:  r.dialPeer,
+		config:  q.deps.dialQueueConfig,
+		metrics: q.deps.dialMetrics,
 	})
 	if err != nil {
-		panic(err)
+		proc.Close()
+		return nil, xerrors.Errorf("creating the dial queue: %w", err)
 	}
 	r.peersDialed = dq
-	return r
+	r.log = q.logger
+	if r.log == nil {
+		r.log = GoLogLogger(logger)
+	}
+	return r, nil
 }
 
-func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryResult, error) {
-	r.log = logger
+func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (res *dhtQueryResult, err error) {
 	r.runCtx = ctx
 
 	if len(peers) == 0 {
-		logger.Warning("Running query with no peers!")
+		r.log.Warn("running query with no peers", "key", loggableKey(r.query.key)["key"])
+		r.proc.Close()
 		return nil, nil
 	}
 
+	if g := r.query.deps.idleGC; g != nil {
+		g.queryStarted()
+		defer g.queryFinished()
+	}
+
+	start := time.Now()
+	tracer := r.query.deps.tracer
+	tracer.QueryStarted(r.query.key)
+	r.query.publish(ctx, &notif.QueryEvent{Type: QueryStarted})
+	// tell listeners right away when the query is cancelled from above, as
+	// it may take the workers a while to notice.
+	canceled := make(chan struct{})
+	stopCanceled := context.AfterFunc(ctx, func() {
+		defer close(canceled)
+		r.Lock()
+		r.cancelReason = r.query.cancellationReason(ctx)
+		r.Unlock()
+		r.query.publish(detachedContext{ctx}, &notif.QueryEvent{Type: QueryCanceled})
+	})
+	stopWatchdog := r.startWatchdog(start)
+	defer func() {
+		stopWatchdog()
+		elapsed := time.Since(start)
+		if !stopCanceled() {
+			<-canceled // publish the completion after it.
+		}
+		tracer.QueryFinished(r.query.key, err)
+		if slo := r.query.deps.slo; slo != nil {
+			slo.Observe(elapsed)
+		}
+
+		r.RLock()
+		failed, noAddrs, reason := len(r.peerErrors), r.noAddrs, r.cancelReason
+		r.RUnlock()
+		r.query.publishCompleted(ctx, &QueryStats{
+			PeersSeen:          r.peersSeen.Size(),
+			PeersQueried:       r.peersQueried.Size(),
+			PeersFailed:        failed,
+			PeersNoAddrs:       noAddrs,
+			Duration:           elapsed,
+			CancellationReason: reason,
+		})
+	}()
+
 	// setup concurrency rate limiting
-	for i := 0; i < r.query.concurrency; i++ {
+	for i := 0; i < r.query.workers(); i++ {
 		r.rateLimit <- struct{}{}
 	}
 
-	// add all the peers we got first.
+	if r.query.resume != nil {
+		r.resume(r.query.resume)
+	}
+
+	// add all the peers we got first. the dial queue starts working on them
+	// right away, so hold an extra count until we're done: otherwise an early
+	// dial failure could drop the counter to zero before the next seed is in.
+	r.peersRemaining.Increment(1)
 	for _, p := range peers {
 		r.addPeerToQuery(p)
 	}
+	r.Lock()
+	r.seeded = true
+	r.Unlock()
+	r.peersRemaining.Decrement(1)
 
 	// go do this thing.
 	// do it as a child proc to make sure Run exits
 	// ONLY AFTER spawn workers has exited.
-	r.proc.Go(r.spawnWorkers)
+	r.proc.Go(r.labeled(r.spawnWorkers))
 
 	// so workers are working.
 
 	// wait until they're done.
-	err := routing.ErrNotFound
+	err = routing.ErrNotFound
 
 	// now, if the context finishes, close the proc.
 	// we have to do it here because the logic before is setup, which
@@ -154,37 +586,102 @@ func (r *dhtQueryRunner) Run(ctx context.Context, peers []peer.ID) (*dhtQueryRes
 	select {
 	case <-r.peersRemaining.Done():
 		r.proc.Close()
+		r.peersDialed.Wait()
 		r.RLock()
 		defer r.RUnlock()
 
 		err = routing.ErrNotFound
 
-		// if every query to every peer failed, something must be very wrong.
-		if len(r.errs) > 0 && len(r.errs) == r.peersSeen.Size() {
-			logger.Debugf("query errs: %s", r.errs)
-			err = r.errs[0]
+		// if every query to every peer failed, something must be very wrong,
+		// unless they failed because the query was cancelled.
+		if ctxErr := r.runCtx.Err(); ctxErr != nil {
+			err = ctxErr
+		} else if len(r.peerErrors) > 0 && len(r.peerErrors) == r.peersSeen.Size() {
+			errs := make([]error, len(r.peerErrors))
+			for i, pe := range r.peerErrors {
+				errs[i] = pe.Err
+			}
+			r.log.Debug("all queried peers failed", "errors", errs)
+			err = &ErrLookupFailure{Errs: errs}
+		} else if r.query.minSuccessful > 0 && r.succeeded < r.query.minSuccessful && (r.result == nil || !r.result.success) {
+			err = &ErrInsufficientPeers{Succeeded: r.succeeded, Needed: r.query.minSuccessful}
 		}
 
 	case <-r.proc.Closed():
+		r.peersDialed.Wait()
 		r.RLock()
 		defer r.RUnlock()
 		err = r.runCtx.Err()
+		if err == nil && r.notFound {
+			err = routing.ErrNotFound
+		}
+	}
+
+	if cp := checkpointFromContext(ctx); cp != nil {
+		r.checkpoint(cp)
 	}
 
 	if r.result != nil && r.result.success {
+		r.result.hops = r.hops
+		r.result.peersPerHop = append([]int(nil), r.peersPerHop...)
+		r.result.peerTimings = r.peerTimings()
+		r.result.unqueried = r.unqueriedClosest()
 		return r.result, nil
 	}
 
 	return &dhtQueryResult{
-		finalSet:   r.peersSeen,
-		queriedSet: r.peersQueried,
+		finalSet:    r.peersSeen,
+		queriedSet:  r.peersQueried,
+		failedPeers: r.failedPeers(),
+		peerErrors:  append([]PeerError(nil), r.peerErrors...),
+		peerTimings: r.peerTimings(),
+		unqueried:   r.unqueriedClosest(),
+		hops:        r.hops,
+		peersPerHop: append([]int(nil), r.peersPerHop...),
 	}, err
 }
 
 func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 	// if new peer is ourselves...
-	if next == r.query.dht.self {
-		r.log.Debug("addPeerToQuery skip self")
+	if next == r.query.host.Self() {
+		r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "self")
+		return
+	}
+
+	if ts := r.query.deps.tombstones; ts != nil && ts.Banned(next) {
+		r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "banned")
+		r.skipFiltered(next)
+		return
+	}
+
+	// skip peers with a poor track record now and then, but never the first
+	// one so the query can always make progress.
+	if rep := r.query.deps.reputation; rep != nil && r.peersSeen.Size() > 0 && rep.shouldSkip(next) {
+		r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "poor reputation")
+		r.skipFiltered(next)
+		return
+	}
+
+	if r.query.closerThanSelf && !r.query.closer(next, r.query.host.Self()) {
+		r.RLock()
+		seeded := r.seeded
+		r.RUnlock()
+		if seeded {
+			r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "farther than self")
+			r.skipFiltered(next)
+			return
+		}
+	}
+
+	if f := r.query.filter; f != nil && !f.Allow(next, r.query.deps.peerstore) {
+		r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "filtered")
+		r.skipFiltered(next)
+		return
+	}
+
+	if f := r.query.appFilter; f != nil && r.query.appFilterMode&FilterQueries != 0 && !f(next) {
+		r.log.Debug("addPeerToQuery skip", "peer", next, "reason", "filtered by the application")
+		r.skipFiltered(next)
 		return
 	}
 
@@ -192,82 +689,489 @@ func (r *dhtQueryRunner) addPeerToQuery(next peer.ID) {
 		return
 	}
 
-	notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
+	r.query.deps.tracer.PeerAdded(r.query.key, next)
+
+	r.Lock()
+	delete(r.skipped, next)
+	r.countHop(next)
+	r.Unlock()
+	r.query.audit.record(AuditAdd, next, nil, 0)
+
+	r.query.publish(r.runCtx, &notif.QueryEvent{
 		Type: notif.AddingPeer,
 		ID:   next,
 	})
 
 	r.peersRemaining.Increment(1)
+
+	// peers we're connected to don't need a dial worker, so don't make them
+	// wait behind slow dials, as long as no closer peer is waiting for a dial
+	// worker. Otherwise they go through the peer queue like the others, which
+	// keeps them from getting ahead of closer peers.
+	id := kb.ConvertPeerID(next)
+	r.Lock()
+	ready := r.query.host.Connectedness(next) == inet.Connected && !r.closerWaiting(id)
+	if !ready {
+		r.waiting[next] = struct{}{}
+		heap.Push(&r.waitingQ, waitingPeer{p: next, id: id})
+	}
+	r.Unlock()
+	if ready {
+		r.peersDialed.Ready(next)
+		return
+	}
+	r.peersDialed.AddQueued(1)
 	select {
 	case r.peersToQuery.EnqChan <- next:
 	case <-r.proc.Closing():
+		r.peersDialed.AddQueued(-1)
+	}
+}
+
+// closerWaiting returns whether any of the peers waiting in peersToQuery is
+// closer to the key than the peer with the converted ID id. The caller must
+// hold the lock.
+func (r *dhtQueryRunner) closerWaiting(id kb.ID) bool {
+	// the peers a dial worker took are only dropped once they're the
+	// closest, so that dialPeer doesn't have to look them up in the heap.
+	for r.waitingQ.Len() > 0 {
+		w := r.waitingQ.peers[0]
+		if _, ok := r.waiting[w.p]; ok {
+			return r.query.closerID(w.id, id)
+		}
+		heap.Pop(&r.waitingQ)
+	}
+	return false
+}
+
+// waitingHeap orders the peers waiting for a dial worker, closest to the key
+// of the query first.
+type waitingHeap struct {
+	peers  []waitingPeer
+	closer func(a, b kb.ID) bool
+}
+
+type waitingPeer struct {
+	p  peer.ID
+	id kb.ID // p converted to the XOR keyspace
+}
+
+func (h waitingHeap) Len() int { return len(h.peers) }
+
+func (h waitingHeap) Less(i, j int) bool { return h.closer(h.peers[i].id, h.peers[j].id) }
+
+func (h waitingHeap) Swap(i, j int) { h.peers[i], h.peers[j] = h.peers[j], h.peers[i] }
+
+func (h *waitingHeap) Push(x interface{}) { h.peers = append(h.peers, x.(waitingPeer)) }
+
+func (h *waitingHeap) Pop() interface{} {
+	w := h.peers[len(h.peers)-1]
+	h.peers = h.peers[:len(h.peers)-1]
+	return w
+}
+
+// countHop counts a hop whenever an answer gets us closer to the key, and next
+// as a peer added during the current hop. The caller must hold the lock.
+func (r *dhtQueryRunner) countHop(next peer.ID) {
+	if r.closest == "" || r.query.closer(next, r.closest) {
+		r.closest = next
+		if r.seeded {
+			r.hops++
+		}
+	}
+	// hop 0 is empty if none of the seeds made it into the query.
+	for len(r.peersPerHop) <= r.hops {
+		r.peersPerHop = append(r.peersPerHop, 0)
+	}
+	r.peersPerHop[r.hops]++
+}
+
+// labeled wraps f to run with pprof labels naming the query, so that CPU
+// profiles of nodes running many queries at once tell them apart.
+func (r *dhtQueryRunner) labeled(f func(process.Process)) func(process.Process) {
+	return func(proc process.Process) {
+		labels := pprof.Labels("dht.key", r.query.key, "dht.phase", "query")
+		pprof.Do(r.runCtx, labels, func(context.Context) {
+			f(proc)
+		})
 	}
 }
 
 func (r *dhtQueryRunner) spawnWorkers(proc process.Process) {
 	for {
-		select {
-		case <-r.peersRemaining.Done():
+		if !r.waitJitter() {
 			return
-
-		case <-r.proc.Closing():
+		}
+		if !r.acquireQuerySlot() {
+			return
+		}
+		if !r.spawnWorker(proc) {
+			r.releaseQuerySlot()
 			return
+		}
+	}
+}
 
-		case <-r.rateLimit:
-			ch := r.peersDialed.Consume()
-			select {
-			case p, ok := <-ch:
-				if !ok {
-					// this signals context cancellation.
-					return
-				}
-				// do it as a child func to make sure Run exits
-				// ONLY AFTER spawn workers has exited.
-				proc.Go(func(proc process.Process) {
-					r.queryPeer(proc, p)
-				})
-			case <-r.proc.Closing():
-				return
-			case <-r.peersRemaining.Done():
-				return
+// spawnWorker waits for a worker of the query to be free and a dialed peer,
+// and has the worker query the peer. It returns false if the query ended
+// meanwhile.
+func (r *dhtQueryRunner) spawnWorker(proc process.Process) bool {
+	select {
+	case <-r.peersRemaining.Done():
+		return false
+
+	case <-r.proc.Closing():
+		return false
+
+	case <-r.rateLimit:
+		ch := r.peersDialed.Consume()
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				// this signals context cancellation.
+				return false
 			}
+			// do it as a child func to make sure Run exits
+			// ONLY AFTER spawn workers has exited.
+			proc.Go(r.labeled(func(proc process.Process) {
+				r.queryPeer(proc, p)
+			}))
+			return true
+		case <-r.proc.Closing():
+			return false
+		case <-r.peersRemaining.Done():
+			return false
 		}
 	}
 }
 
+// acquireQuerySlot waits for the DHT to query fewer peers than it may at a
+// time, all queries together, and takes a slot. It returns false if the
+// query ended meanwhile.
+func (r *dhtQueryRunner) acquireQuerySlot() bool {
+	sem := r.query.deps.querySemaphore
+	if sem == nil {
+		return true
+	}
+	select {
+	case sem <- struct{}{}:
+		return true
+	case <-r.proc.Closing():
+		return false
+	case <-r.peersRemaining.Done():
+		return false
+	}
+}
+
+// releaseQuerySlot frees a slot taken by acquireQuerySlot.
+func (r *dhtQueryRunner) releaseQuerySlot() {
+	if sem := r.query.deps.querySemaphore; sem != nil {
+		<-sem
+	}
+}
+
+// waitJitter waits a random duration up to the rate limit jitter of the
+// query, if any. It returns false if the query ended meanwhile.
+func (r *dhtQueryRunner) waitJitter() bool {
+	jitter := r.query.rateLimitJitter
+	if jitter <= 0 {
+		return true
+	}
+	t := time.NewTimer(time.Duration(rand.Int63n(int64(jitter))))
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.proc.Closing():
+		return false
+	case <-r.peersRemaining.Done():
+		return false
+	}
+}
+
 func (r *dhtQueryRunner) dialPeer(ctx context.Context, p peer.ID) error {
+	var err error
+	start := time.Now()
+
+	r.Lock()
+	delete(r.waiting, p)
+	r.Unlock()
+
+	if r.query.pruneStale && r.stale(p) {
+		r.log.Debug("skipping peer the query moved past", "peer", p)
+		r.skip(p, SkipStale)
+		r.peersRemaining.Decrement(1)
+		return skippedDial{errStale}
+	}
+
 	// short-circuit if we're already connected.
-	if r.query.dht.host.Network().Connectedness(p) == inet.Connected {
-		return nil
+	if r.query.host.Connectedness(p) == inet.Connected {
+		r.Lock()
+		r.timing(p).Connected = true
+		r.Unlock()
+	} else if r.query.deps.dialBackoff.backedOff(p) {
+		// don't dial again a peer that failed to dial just before.
+		r.log.Debug("skipping peer under dial backoff", "peer", p)
+		err = errDialBackoff
+	} else if err = r.countDial(p); err != nil {
+		r.log.Debug("skipping peer dialed too many times", "peer", p)
+	} else {
+		pi := r.query.host.PeerInfo(p)
+		pi.Addrs = r.query.filterAddrs(pi.Addrs)
+
+		// don't waste a dial on a peer we can't reach, it isn't its fault.
+		if len(pi.Addrs) == 0 && (r.query.dialFunc == nil || r.query.addrFamily != anyAddrFamily) {
+			r.log.Debug("skipping peer without known addresses", "peer", p)
+			r.Lock()
+			r.noAddrs++
+			r.skipped[p] = SkipNoAddrs
+			r.Unlock()
+			r.peersRemaining.Decrement(1)
+			return skippedDial{errNoAddresses}
+		}
+
+		r.log.Debug("not connected, dialing", "peer", p)
+		r.query.publish(r.runCtx, &notif.QueryEvent{
+			Type: notif.DialingPeer,
+			ID:   p,
+		})
+
+		dialStart := time.Now()
+		err = r.dialUnlessStale(ctx, pi)
+		r.Lock()
+		r.timing(p).Dial = time.Since(dialStart)
+		r.Unlock()
+		r.query.audit.record(AuditDial, p, err, 0)
+		if err == nil {
+			r.log.Debug("connected, dial success", "peer", p)
+			r.query.deps.tracer.PeerDialed(r.query.key, p)
+			r.query.deps.dialBackoff.succeeded(p)
+			r.query.deps.dialHistory.record(p, true)
+		} else {
+			// the context comes from the query's process, its Err is
+			// never nil.
+			select {
+			case <-ctx.Done():
+			default:
+				if err != errStale {
+					r.query.deps.dialBackoff.failed(p)
+					r.query.deps.dialHistory.record(p, false)
+				}
+			}
+		}
 	}
 
-	logger.Debug("not connected. dialing.")
-	notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
-		Type: notif.DialingPeer,
-		ID:   p,
-	})
+	if err == errStale {
+		r.log.Debug("aborted the dial of a peer the query moved past", "peer", p)
+		r.skip(p, SkipStale)
+		r.peersRemaining.Decrement(1)
+		return skippedDial{err}
+	}
 
-	pi := pstore.PeerInfo{ID: p}
-	if err := r.query.dht.host.Connect(ctx, pi); err != nil {
-		logger.Debugf("error connecting: %s", err)
-		notif.PublishQueryEvent(r.runCtx, &notif.QueryEvent{
+	if err == nil && r.query.dialFunc == nil {
+		// find out which version of the DHT protocol to speak with p.
+		err = r.query.deps.negotiate(ctx, p)
+	}
+
+	if err != nil {
+		r.log.Debug("error connecting", "peer", p, "error", err)
+		r.query.publish(r.runCtx, &notif.QueryEvent{
 			Type:  notif.QueryError,
 			Extra: err.Error(),
 			ID:    p,
 		})
 
-		r.Lock()
-		r.errs = append(r.errs, err)
-		r.Unlock()
+		r.recordError(p, err)
+		// the context comes from the query's process, its Err is never nil.
+		select {
+		case <-ctx.Done():
+			r.skip(p, SkipNotReached)
+		default:
+			r.skip(p, SkipDialFailed)
+			r.query.deps.peerFailed(p)
+		}
+		if f := r.query.onDialFailure; f != nil {
+			f(p, err)
+		}
 
 		// This peer is dropping out of the race.
 		r.peersRemaining.Decrement(1)
+		if err == errDialBackoff || err == errMaxDialAttempts {
+			return skippedDial{err}
+		}
 		return err
 	}
-	logger.Debugf("connected. dial success.")
+	if f := r.query.onDialSuccess; f != nil {
+		f(p, time.Since(start))
+	}
 	return nil
 }
 
+// dial connects to pi, giving up with ErrDialTimeout after the dial timeout
+// of the DHT, if any, unless ctx is done first.
+func (r *dhtQueryRunner) dial(ctx context.Context, pi pstore.PeerInfo) error {
+	dialCtx := ctx
+	if d := r.query.deps.dialTimeout; d > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+
+	err := r.query.deps.signal(dialCtx, pi.ID)
+	if err == nil {
+		if dial := r.query.dialFunc; dial != nil {
+			err = dial(dialCtx, pi)
+		} else {
+			err = r.query.host.Connect(dialCtx, pi)
+		}
+	}
+	if err != nil && dialCtx.Err() == context.DeadlineExceeded {
+		// the context comes from the query's process, its Err is never nil.
+		select {
+		case <-ctx.Done():
+		default:
+			err = ErrDialTimeout
+		}
+	}
+	return err
+}
+
+// countDial counts a dial to p, or returns errMaxDialAttempts if the query
+// dialed it too many times already.
+func (r *dhtQueryRunner) countDial(p peer.ID) error {
+	r.Lock()
+	defer r.Unlock()
+	if max := r.query.maxDialAttempts; max > 0 && r.dials[p] >= max {
+		return errMaxDialAttempts
+	}
+	r.dials[p]++
+	return nil
+}
+
+// countRedial counts the dial the RPC to p makes if the connection dropped
+// since we dialed it.
+func (r *dhtQueryRunner) countRedial(p peer.ID) error {
+	if r.query.dialFunc != nil || r.query.host.Connectedness(p) == inet.Connected {
+		return nil
+	}
+	return r.countDial(p)
+}
+
+// inFlightDial is a dial that's aborted if the query moves past its peer.
+type inFlightDial struct {
+	cancel context.CancelFunc
+	stale  bool // whether it was aborted as such
+}
+
+// dialUnlessStale dials pi, unless the query moves past it in the meantime,
+// with WithStaleDialPruning, in which case it aborts the dial to free the
+// slot for a closer peer and returns errStale.
+func (r *dhtQueryRunner) dialUnlessStale(ctx context.Context, pi pstore.PeerInfo) error {
+	if !r.query.pruneStale {
+		return r.dial(ctx, pi)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	d := &inFlightDial{cancel: cancel}
+	r.Lock()
+	r.inFlight[pi.ID] = d
+	r.Unlock()
+
+	err := r.dial(ctx, pi)
+
+	r.Lock()
+	defer r.Unlock()
+	delete(r.inFlight, pi.ID)
+	if d.stale {
+		return errStale
+	}
+	return err
+}
+
+// abortStaleDials aborts the dials in flight to the peers K closer peers
+// answered the query before.
+func (r *dhtQueryRunner) abortStaleDials() {
+	r.RLock()
+	dialing := make([]peer.ID, 0, len(r.inFlight))
+	for p := range r.inFlight {
+		dialing = append(dialing, p)
+	}
+	r.RUnlock()
+
+	for _, p := range dialing {
+		if !r.stale(p) {
+			continue
+		}
+		r.Lock()
+		if d, ok := r.inFlight[p]; ok && !d.stale {
+			d.stale = true
+			d.cancel()
+		}
+		r.Unlock()
+	}
+}
+
+// stale returns whether K peers closer to the key than p answered the query
+// already.
+func (r *dhtQueryRunner) stale(p peer.ID) bool {
+	r.RLock()
+	defer r.RUnlock()
+	closer := 0
+	for _, q := range r.peersQueried.Peers() {
+		if _, failed := r.failed[q]; failed || !r.query.closer(q, p) {
+			continue
+		}
+		if closer++; closer >= r.query.kValue {
+			return true
+		}
+	}
+	return false
+}
+
+// timing returns the timing of p, creating it if needed. The caller must hold
+// the lock.
+func (r *dhtQueryRunner) timing(p peer.ID) *PeerTiming {
+	t, ok := r.timings[p]
+	if !ok {
+		t = &PeerTiming{Peer: p}
+		r.timings[p] = t
+	}
+	return t
+}
+
+// peerTimings returns a copy of the timings, slowest peer first. The caller
+// must hold the lock.
+func (r *dhtQueryRunner) peerTimings() []PeerTiming {
+	out := make([]PeerTiming, 0, len(r.timings))
+	for _, t := range r.timings {
+		out = append(out, *t)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Dial+out[i].RPC > out[j].Dial+out[j].RPC
+	})
+	return out
+}
+
+// failedPeers returns a copy of the failed peers, as the dial queue may still
+// be failing peers after the query is done. The caller must hold the lock.
+func (r *dhtQueryRunner) failedPeers() map[peer.ID]error {
+	failed := make(map[peer.ID]error, len(r.failed))
+	for p, err := range r.failed {
+		failed[p] = err
+	}
+	return failed
+}
+
+// recordError records that p failed with err.
+func (r *dhtQueryRunner) recordError(p peer.ID, err error) {
+	r.Lock()
+	r.peerErrors = append(r.peerErrors, PeerError{Peer: p, Err: err, At: time.Now()})
+	r.failed[p] = err
+	r.timing(p).Err = err
+	r.Unlock()
+	r.query.deps.tracer.PeerFailed(r.query.key, p, err)
+}
+
 func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 	// ok let's do this!
 
@@ -279,44 +1183,114 @@ func (r *dhtQueryRunner) queryPeer(proc process.Process, p peer.ID) {
 		// signal we're done processing peer p
 		r.peersRemaining.Decrement(1)
 		r.rateLimit <- struct{}{}
+		r.releaseQuerySlot()
 	}()
 
-	// finally, run the query against this peer
-	res, err := r.query.qfunc(ctx, p)
+	// give this peer its own deadline so a slow peer only fails itself.
+	if timeout := r.query.peerTimeout(p); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	var h *hedge
+	if r.query.workers() > r.query.concurrency {
+		if ctx, h = r.joinHedge(ctx, p); h == nil {
+			r.log.Debug("speculative query not needed", "peer", p)
+			return
+		}
+	}
+
+	// finally, run the query against this peer, once the other queries
+	// leave us room to.
+	var res *dhtQueryResult
+	err := r.countRedial(p)
+	if err == nil {
+		err = r.query.deps.peerRPCs.acquire(ctx, p)
+	}
+	start := time.Now()
+	if err == nil {
+		res, err = r.query.qfunc(ctx, p)
+		r.query.deps.peerRPCs.release(p)
+	}
+
+	if h != nil && r.leaveHedge(h, p, err) {
+		r.log.Debug("speculative query cancelled", "peer", p)
+		return
+	}
 
 	r.peersQueried.Add(p)
+	r.Lock()
+	r.timing(p).RPC = time.Since(start)
+	r.Unlock()
+
+	var closer int
+	if res != nil {
+		closer = len(res.closerPeers)
+	}
+	r.query.audit.record(AuditQuery, p, err, closer)
+
+	select {
+	case <-r.proc.Closing():
+		// don't hold it against the peer if the whole query was stopped.
+	default:
+		if rep := r.query.deps.reputation; rep != nil {
+			rep.Record(p, err == nil, time.Since(start))
+		}
+		if err != nil {
+			r.query.deps.peerFailed(p)
+		} else {
+			r.query.deps.peerSucceeded(p)
+		}
+	}
 
 	if err != nil {
-		logger.Debugf("ERROR worker for: %v %v", p, err)
-		r.Lock()
-		r.errs = append(r.errs, err)
-		r.Unlock()
+		r.log.Debug("query worker failed", "peer", p, "error", err)
+		r.recordError(p, err)
+		return
+	}
 
-	} else if res.success {
-		logger.Debugf("SUCCESS worker for: %v %s", p, res)
+	r.query.deps.peerVerified(p)
+	r.query.deps.tracer.PeerQueried(r.query.key, p)
+	r.Lock()
+	r.succeeded++
+	r.Unlock()
+	if r.query.pruneStale {
+		// the closest peers that answered changed, some dials in flight
+		// may not matter any more.
+		r.abortStaleDials()
+	}
+	if res.success {
+		r.log.Debug("query worker succeeded", "peer", p)
 		r.Lock()
 		r.result = res
 		r.Unlock()
 		if res.peer != nil {
-			r.query.dht.peerstore.AddAddrs(res.peer.ID, res.peer.Addrs, pstore.TempAddrTTL)
+			r.query.host.AddAddrs(res.peer.ID, res.peer.Addrs, pstore.TempAddrTTL)
 		}
 		go r.proc.Close() // signal to everyone that we're done.
 		// must be async, as we're one of the children, and Close blocks.
 
+	} else if res.final && len(res.closerPeers) == 0 {
+		r.log.Debug("query worker got a definitive not found", "peer", p)
+		r.Lock()
+		r.notFound = true
+		r.Unlock()
+		go r.proc.Close() // no need to ask anybody else.
 	} else if len(res.closerPeers) > 0 {
-		logger.Debugf("PEERS CLOSER -- worker for: %v (%d closer peers)", p, len(res.closerPeers))
+		r.log.Debug("query worker got closer peers", "peer", p, "closer", len(res.closerPeers))
 		for _, next := range res.closerPeers {
-			if next.ID == r.query.dht.self { // don't add self.
-				logger.Debugf("PEERS CLOSER -- worker for: %v found self", p)
+			if next.ID == r.query.host.Self() { // don't add self.
+				r.log.Debug("query worker found self", "peer", p)
 				continue
 			}
 
 			// add their addresses to the dialer's peerstore
-			r.query.dht.peerstore.AddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
+			r.query.host.AddAddrs(next.ID, next.Addrs, pstore.TempAddrTTL)
 			r.addPeerToQuery(next.ID)
-			logger.Debugf("PEERS CLOSER -- worker for: %v added %v (%v)", p, next.ID, next.Addrs)
+			r.log.Debug("query worker added closer peer", "peer", p, "closer", next.ID, "addrs", next.Addrs)
 		}
 	} else {
-		logger.Debugf("QUERY worker for: %v - not found, and no closer peers.", p)
+		r.log.Debug("query worker found nothing and no closer peers", "peer", p)
 	}
 }
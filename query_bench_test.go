@@ -0,0 +1,309 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	ci "github.com/libp2p/go-libp2p-crypto"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	mocknet "github.com/libp2p/go-libp2p/p2p/net/mock"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+const (
+	// baselineLatencyFile holds the ratio of the median lookup latency to the
+	// median latency of a single RPC, as measured by
+	// BenchmarkQueryLatencyRegression. Both are measured in the same run, so
+	// the ratio doesn't depend on the speed of the machine running it. It
+	// still varies by a few percent from run to run, so the baseline is the
+	// highest ratio logged over a few runs. Update it by hand when lookups get
+	// faster.
+	baselineLatencyFile = "testdata/baseline_latency_ratio.txt"
+
+	// maxLatencyRegression is how much slower than the baseline lookups may
+	// get before the benchmark fails.
+	maxLatencyRegression = 0.10
+)
+
+// BenchmarkQueryLatencyRegression measures the median latency of lookups in a
+// fixed network of 100 DHTs connected in a ring, relative to the median
+// latency of a single RPC between neighbours of that network, and fails if
+// the ratio is more than 10% worse than the committed baseline.
+func BenchmarkQueryLatencyRegression(b *testing.B) {
+	const (
+		nDHTs   = 100
+		lookups = 1000
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	baseline, err := readBaselineLatencyRatio()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	// the same IDs, and so the same lookups, every run.
+	rng := rand.New(rand.NewSource(1))
+	mn := mocknet.New(ctx)
+	dhts := make([]*IpfsDHT, nDHTs)
+	for i := range dhts {
+		sk, _, err := ci.GenerateEd25519Key(rng)
+		if err != nil {
+			b.Fatal(err)
+		}
+		h, err := mn.AddPeer(sk, ma.StringCast(fmt.Sprintf("/ip4/127.0.0.1/tcp/%d", 4001+i)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		if dhts[i], err = New(ctx, h); err != nil {
+			b.Fatal(err)
+		}
+	}
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// every peer can reach every other one, but only knows its neighbours.
+	if err := mn.LinkAll(); err != nil {
+		b.Fatal(err)
+	}
+	for i := range dhts {
+		next := dhts[(i+1)%nDHTs]
+		if _, err := mn.ConnectPeers(dhts[i].self, next.self); err != nil {
+			b.Fatal(err)
+		}
+	}
+	for i := range dhts {
+		for dhts[i].routingTable.Size() < 2 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// interleave the lookups with the RPCs they're compared to, so that both
+	// see the same load.
+	latencies := make([]time.Duration, 0, b.N*lookups)
+	rpcLatencies := make([]time.Duration, 0, b.N*lookups)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i := 0; i < lookups; i++ {
+			d, next := dhts[i%nDHTs], dhts[(i+1)%nDHTs]
+			key := fmt.Sprintf("/bench/%d", i)
+
+			start := time.Now()
+			if _, err := d.findPeerSingle(ctx, next.self, peer.ID(key)); err != nil {
+				b.Fatal(err)
+			}
+			rpcLatencies = append(rpcLatencies, time.Since(start))
+
+			start = time.Now()
+			peers, err := d.GetClosestPeers(ctx, key)
+			if err != nil {
+				b.Fatal(err)
+			}
+			for range peers {
+			}
+			latencies = append(latencies, time.Since(start))
+		}
+	}
+	b.StopTimer()
+
+	median, rpcMedian := medianLatency(latencies), medianLatency(rpcLatencies)
+	ratio := float64(median) / float64(rpcMedian)
+	b.Logf("median lookup latency: %s, %.2f times the median RPC latency of %s (baseline %.2f)",
+		median, ratio, rpcMedian, baseline)
+
+	if limit := baseline * (1 + maxLatencyRegression); ratio > limit {
+		b.Fatalf("median lookup latency regressed to %.2f times the RPC latency, more than %.0f%% over the %.2f baseline",
+			ratio, maxLatencyRegression*100, baseline)
+	}
+}
+
+func medianLatency(latencies []time.Duration) time.Duration {
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[len(latencies)/2]
+}
+
+func readBaselineLatencyRatio() (float64, error) {
+	data, err := ioutil.ReadFile(baselineLatencyFile)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+}
+
+// BenchmarkQueryCloser compares the distance comparisons a query makes as it
+// adds peers, hashing the key every time as kb.Closer does, and with the key
+// hashed once per query. Each comparison saves one SHA256 of the key.
+func BenchmarkQueryCloser(b *testing.B) {
+	const key = "/v/some-key"
+	peers := make([]peer.ID, 64)
+	for i := range peers {
+		peers[i] = tu.RandPeerIDFatal(b)
+	}
+	q := &dhtQuery{key: key, convertedKey: kb.ConvertKey(key)}
+
+	b.Run("ConvertEachTime", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			kb.Closer(peers[i%len(peers)], peers[(i+1)%len(peers)], key)
+		}
+	})
+	b.Run("Precomputed", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			q.closer(peers[i%len(peers)], peers[(i+1)%len(peers)])
+		}
+	})
+}
+
+// BenchmarkQueryCountHop measures the bookkeeping a query does for every peer
+// it adds to count its hops and the peers added per hop.
+func BenchmarkQueryCountHop(b *testing.B) {
+	const key = "/v/some-key"
+	peers := make([]peer.ID, 1024)
+	for i := range peers {
+		peers[i] = tu.RandPeerIDFatal(b)
+	}
+	q := &dhtQuery{key: key, convertedKey: kb.ConvertKey(key)}
+
+	var r *dhtQueryRunner
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		// start over with a new query once all the peers were added.
+		if i%len(peers) == 0 {
+			r = &dhtQueryRunner{query: q, seeded: true}
+		}
+		r.countHop(peers[i%len(peers)])
+	}
+}
+
+// BenchmarkMockDHTLookup measures lookups for the closest peers to random keys
+// in a simulated network, and the hops they take to converge.
+func BenchmarkMockDHTLookup(b *testing.B) {
+	d := NewMockDHT(1, 2000)
+	defer d.Close()
+	defer d.host.Close()
+
+	ctx := context.Background()
+	hops := 0
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		key := fmt.Sprintf("/v/key-%d", i)
+		q := d.newQuery(key, d.closerPeersFunc(ctx, key))
+		res, _ := q.Run(ctx, d.LocalClosestPeers(key, d.alpha))
+		hops += res.Hops()
+	}
+	b.ReportMetric(float64(hops)/float64(b.N), "hops/op")
+}
+
+// BenchmarkQueryFailures runs queries whose every dial and RPC fails, with
+// workers recording failures concurrently as the result is read. Run it with
+// -race to check the failures are recorded safely.
+func BenchmarkQueryFailures(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := mocknet.New(ctx).GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	d, err := New(ctx, h)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+	defer h.Close()
+
+	// half the peers fail to dial, the other half to answer.
+	peers := make([]peer.ID, 50)
+	undialable := make(map[peer.ID]bool)
+	for i := range peers {
+		if peers[i], err = tu.RandPeerID(); err != nil {
+			b.Fatal(err)
+		}
+		undialable[peers[i]] = i%2 == 0
+	}
+	errUnreachable := errors.New("unreachable")
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			return nil, errUnreachable
+		}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+			if undialable[pi.ID] {
+				return errUnreachable
+			}
+			return nil
+		}))
+		res, _ := query.Run(ctx, peers)
+		if failed := len(res.failedPeers); failed != len(peers) {
+			b.Fatalf("expected all %d peers to fail, got %d", len(peers), failed)
+		}
+	}
+}
+
+// BenchmarkQueryEventFilter compares the throughput of queries publishing all
+// their events to a listener with the one of queries that suppress the dial
+// events.
+func BenchmarkQueryEventFilter(b *testing.B) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	h, err := mocknet.New(ctx).GenPeer()
+	if err != nil {
+		b.Fatal(err)
+	}
+	d, err := New(ctx, h)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer d.Close()
+	defer h.Close()
+
+	peers := make([]peer.ID, 50)
+	for i := range peers {
+		if peers[i], err = tu.RandPeerID(); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	ctx, events := notif.RegisterForQueryEvents(ctx)
+	go func() {
+		for range events {
+		}
+	}()
+
+	for _, bc := range []struct {
+		name    string
+		options []QueryOption
+	}{
+		{"all events", nil},
+		{"no dial events", []QueryOption{WithQueryEventFilter(SuppressDialEvents())}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			options := append([]QueryOption{
+				WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil }),
+			}, bc.options...)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+					return &dhtQueryResult{}, nil
+				}, options...).Run(ctx, peers)
+			}
+		})
+	}
+}
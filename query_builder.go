@@ -0,0 +1,113 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+)
+
+// queryBuilder configures a query step by step, and checks the whole
+// configuration at once when building it, so that a misconfigured query is
+// rejected rather than run with whatever defaults fill the gaps. Get one with
+// newQueryBuilder. The settings left out default to the ones of the DHT.
+type queryBuilder struct {
+	dht     *IpfsDHT
+	key     string
+	keySet  bool
+	qfunc   queryFunc
+	options []QueryOption
+	err     error // the first invalid setting
+}
+
+// newQueryBuilder returns a builder for a query of the DHT.
+func (dht *IpfsDHT) newQueryBuilder() *queryBuilder {
+	return &queryBuilder{dht: dht}
+}
+
+// Key sets the key the query is for. It's required.
+func (b *queryBuilder) Key(key string) *queryBuilder {
+	b.key = key
+	b.keySet = true
+	return b
+}
+
+// Concurrency sets how many peers the query queries at a time, alpha.
+func (b *queryBuilder) Concurrency(n int) *queryBuilder {
+	if n < 1 {
+		b.invalid(fmt.Errorf("concurrency must be at least 1; got %d", n))
+	}
+	return b.with(func(q *dhtQuery) { q.concurrency = n })
+}
+
+// KValue sets how many closest peers the query is after, K.
+func (b *queryBuilder) KValue(k int) *queryBuilder {
+	if k < 1 {
+		b.invalid(fmt.Errorf("k value must be at least 1; got %d", k))
+	}
+	return b.with(WithKValue(k))
+}
+
+// PeerFilter restricts the query to the peers f allows, on top of the
+// default peer filter of the DHT. Rejected peers are silently dropped, see
+// WithPeerFilter.
+func (b *queryBuilder) PeerFilter(f func(peer.ID) bool) *queryBuilder {
+	if f == nil {
+		b.invalid(fmt.Errorf("peer filter must not be nil"))
+	}
+	return b.with(func(q *dhtQuery) {
+		filter := PeerFilter(PeerFilterFunc(func(p peer.ID, _ pstore.Peerstore) bool { return f(p) }))
+		if q.filter != nil {
+			filter = AndFilter(q.filter, filter)
+		}
+		q.filter = filter
+	})
+}
+
+// Timeout sets how long the query may run, on top of the deadline of the
+// context it's run with.
+func (b *queryBuilder) Timeout(d time.Duration) *queryBuilder {
+	if d <= 0 {
+		b.invalid(fmt.Errorf("timeout must be positive; got %s", d))
+	}
+	return b.with(func(q *dhtQuery) { q.timeout = d })
+}
+
+// Options adds query options, for the settings the builder has no method for.
+func (b *queryBuilder) Options(options ...QueryOption) *queryBuilder {
+	b.options = append(b.options, options...)
+	return b
+}
+
+// QueryFunc sets the function run against every peer. It's required.
+func (b *queryBuilder) QueryFunc(f queryFunc) *queryBuilder {
+	b.qfunc = f
+	return b
+}
+
+// Build returns the query, or an error if a required setting is missing or
+// one is invalid.
+func (b *queryBuilder) Build() (*dhtQuery, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if !b.keySet {
+		return nil, fmt.Errorf("query has no key")
+	}
+	if b.qfunc == nil {
+		return nil, fmt.Errorf("query has no query function")
+	}
+	return b.dht.newQuery(b.key, b.qfunc, b.options...), nil
+}
+
+func (b *queryBuilder) with(o QueryOption) *queryBuilder {
+	b.options = append(b.options, o)
+	return b
+}
+
+func (b *queryBuilder) invalid(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
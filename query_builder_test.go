@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestQueryBuilder(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	qfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	for name, b := range map[string]*queryBuilder{
+		"no key":         d.newQueryBuilder().QueryFunc(qfunc),
+		"no function":    d.newQueryBuilder().Key("foo"),
+		"no concurrency": d.newQueryBuilder().Key("foo").QueryFunc(qfunc).Concurrency(0),
+		"negative k":     d.newQueryBuilder().Key("foo").QueryFunc(qfunc).KValue(-1),
+		"no peer filter": d.newQueryBuilder().Key("foo").QueryFunc(qfunc).PeerFilter(nil),
+		"no time to run": d.newQueryBuilder().Key("foo").QueryFunc(qfunc).Timeout(0),
+	} {
+		if _, err := b.Build(); err == nil {
+			t.Errorf("%s: expected the query to be rejected", name)
+		}
+	}
+
+	rejected, allowed := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	var dialed []peer.ID
+	q, err := d.newQueryBuilder().
+		Key("foo").
+		QueryFunc(qfunc).
+		Concurrency(1).
+		KValue(2).
+		PeerFilter(func(p peer.ID) bool { return p != rejected }).
+		Timeout(50 * time.Millisecond).
+		Options(WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+			dialed = append(dialed, pi.ID)
+			return nil
+		})).
+		Build()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q.concurrency != 1 || q.kValue != 2 {
+		t.Errorf("expected a concurrency of 1 and a k value of 2, got %d and %d", q.concurrency, q.kValue)
+	}
+
+	start := time.Now()
+	if _, err := q.Run(ctx, []peer.ID{rejected, allowed}); err != context.DeadlineExceeded {
+		t.Errorf("expected the query to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to time out after 50ms, it took %s", elapsed)
+	}
+	if len(dialed) != 1 || dialed[0] != allowed {
+		t.Errorf("expected only the allowed peer to be dialed, got %v", dialed)
+	}
+}
@@ -0,0 +1,62 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// QueryCache remembers the closest peers lookups found for their keys, so
+// that the hot keys of e.g. a gateway aren't looked up again and again.
+type QueryCache struct {
+	ttl   time.Duration
+	cache *lru.Cache // key -> *queryCacheEntry
+}
+
+type queryCacheEntry struct {
+	peers   []peer.ID
+	expires time.Time
+}
+
+// NewQueryCache returns a QueryCache that remembers the results of up to
+// maxEntries keys for ttl each.
+func NewQueryCache(maxEntries int, ttl time.Duration) (*QueryCache, error) {
+	if ttl <= 0 {
+		return nil, fmt.Errorf("query cache ttl must be positive; actual value: %s", ttl)
+	}
+	cache, err := lru.New(maxEntries)
+	if err != nil {
+		return nil, err
+	}
+	return &QueryCache{ttl: ttl, cache: cache}, nil
+}
+
+// get returns the closest peers to key found less than the TTL ago, if any.
+func (c *QueryCache) get(key string) ([]peer.ID, bool) {
+	if c == nil {
+		return nil, false
+	}
+	v, ok := c.cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+	e := v.(*queryCacheEntry)
+	if time.Now().After(e.expires) {
+		c.cache.Remove(key)
+		return nil, false
+	}
+	return e.peers, true
+}
+
+// add remembers peers as the closest peers to key.
+func (c *QueryCache) add(key string, peers []peer.ID) {
+	if c == nil {
+		return
+	}
+	c.cache.Add(key, &queryCacheEntry{
+		peers:   append([]peer.ID(nil), peers...),
+		expires: time.Now().Add(c.ttl),
+	})
+}
@@ -0,0 +1,78 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestQueryCache(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[1], dhts[2])
+
+	ttl := 300 * time.Millisecond
+	c, err := NewQueryCache(10, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dhts[0].queryCache = c
+
+	var (
+		mu      sync.Mutex
+		queried int
+	)
+	dhts[0].tracer = queriedTracer{onQueried: func(peer.ID) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried++
+	}}
+	lookup := func() ([]peer.ID, int) {
+		mu.Lock()
+		queried = 0
+		mu.Unlock()
+
+		ch, err := dhts[0].GetClosestPeers(ctx, "foo")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var peers []peer.ID
+		for p := range ch {
+			peers = append(peers, p)
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		return peers, queried
+	}
+
+	first, n := lookup()
+	if len(first) == 0 || n == 0 {
+		t.Fatalf("expected the first lookup to query peers, got %v after %d queries", first, n)
+	}
+	second, n := lookup()
+	if n != 0 {
+		t.Errorf("expected the second lookup to be answered from the cache, got %d queries", n)
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("expected the cached result %v, got %v", first, second)
+	}
+
+	time.Sleep(ttl)
+	if _, n := lookup(); n == 0 {
+		t.Error("expected the lookup to run again once the result expired")
+	}
+}
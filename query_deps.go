@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	pstoremem "github.com/libp2p/go-libp2p-peerstore/pstoremem"
+	queue "github.com/libp2p/go-libp2p-peerstore/queue"
+)
+
+// queryDeps is what queries need of their DHT: the defaults of their
+// settings, the state they share with the other queries of the DHT, and the
+// hooks through which the DHT learns from them. It lets tests run queries
+// without a DHT, see newQueryDeps. The pointers may be nil, for none.
+type queryDeps struct {
+	host      dhtHost
+	peerstore pstore.Peerstore // what peer filters and adaptive timeouts look at
+
+	// the defaults of the settings of queries.
+	concurrency    int
+	kValue         int
+	perPeerTimeout time.Duration
+	filter         PeerFilter
+	speculative    float64
+	dialFunc       DialFunc
+
+	// bounds of the RPC deadlines derived from peer latencies, if
+	// maxPeerTimeout is non-zero.
+	minPeerTimeout time.Duration
+	maxPeerTimeout time.Duration
+
+	newPeerQueue    func(key string, id kb.ID) queue.PeerQueue
+	dialQueueConfig dqConfig
+	dialMetrics     *dialQueueMetrics
+	dialTimeout     time.Duration // bounds every dial, if non-zero
+
+	dedup          *QueryDeduplicator
+	querySemaphore chan struct{} // bounds the peers queried at a time by all queries
+	peerRPCs       *peerRPCLimiter
+	tombstones     *TombstoneStore
+	reputation     *PeerReputationCache
+	dialBackoff    *dialBackoff
+	dialHistory    *DialHistory
+	slo            *SLOEnforcer
+	idleGC         *idleGC
+	tracer         QueryTracer
+
+	// startRunner is called before every run of a query, and runnerDone
+	// after the run if startRunner didn't fail.
+	startRunner func() error
+	runnerDone  func()
+	// signal gets a peer ready to be dialed, and negotiate gets it ready to
+	// be queried once connected.
+	signal    func(ctx context.Context, p peer.ID) error
+	negotiate func(ctx context.Context, p peer.ID) error
+	// peerFailed, peerSucceeded and peerVerified tell how a peer did.
+	peerFailed    func(p peer.ID)
+	peerSucceeded func(p peer.ID)
+	peerVerified  func(p peer.ID)
+}
+
+// newQueryDeps returns the dependencies of queries that reach peers through
+// h, with the package defaults, and nothing shared with other queries.
+func newQueryDeps(h dhtHost) *queryDeps {
+	noop := func(peer.ID) {}
+	ready := func(context.Context, peer.ID) error { return nil }
+	return &queryDeps{
+		host:        h,
+		peerstore:   pstoremem.NewPeerstore(),
+		concurrency: AlphaValue,
+		kValue:      KValue,
+		newPeerQueue: func(key string, _ kb.ID) queue.PeerQueue {
+			return queue.NewXORDistancePQ(key)
+		},
+		dialQueueConfig: dqDefaultConfig(),
+		tracer:          NoopTracer{},
+		startRunner:     func() error { return nil },
+		runnerDone:      func() {},
+		signal:          ready,
+		negotiate:       ready,
+		peerFailed:      noop,
+		peerSucceeded:   noop,
+		peerVerified:    noop,
+	}
+}
+
+// queryDeps returns the dependencies of the queries of the DHT.
+func (dht *IpfsDHT) queryDeps() *queryDeps {
+	d := &queryDeps{
+		host:            libp2pHost{dht.host},
+		peerstore:       dht.peerstore,
+		concurrency:     dht.queryConcurrency(),
+		kValue:          dht.bucketSize,
+		perPeerTimeout:  dht.perPeerTimeout,
+		filter:          dht.peerFilter,
+		speculative:     dht.speculative,
+		minPeerTimeout:  dht.minPeerTimeout,
+		maxPeerTimeout:  dht.maxPeerTimeout,
+		newPeerQueue:    dht.newPeerQueue,
+		dialQueueConfig: dht.dialQueueConfig,
+		dialMetrics:     dht.dialMetrics,
+		dialTimeout:     dht.dialTimeout,
+		dedup:           dht.dedup,
+		querySemaphore:  dht.globalQuerySemaphore,
+		peerRPCs:        dht.peerRPCs,
+		tombstones:      dht.tombstones,
+		reputation:      dht.reputation,
+		dialBackoff:     dht.dialBackoff,
+		dialHistory:     dht.dialHistory,
+		slo:             dht.slo,
+		idleGC:          dht.idleGC,
+		tracer:          dht.tracer,
+		startRunner:     dht.startRunner,
+		runnerDone:      dht.runners.Done,
+		signal:          dht.signalWebRTC,
+		negotiate:       dht.negotiateUnknownProtocol,
+		peerFailed:      dht.peerFailed,
+		peerSucceeded:   dht.peerSucceeded,
+		peerVerified:    dht.peerVerified,
+	}
+	if dht.sim != nil {
+		d.dialFunc = dht.sim.dial
+	}
+	return d
+}
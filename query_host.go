@@ -0,0 +1,54 @@
+package dht
+
+import (
+	"context"
+	"time"
+
+	host "github.com/libp2p/go-libp2p-host"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// dhtHost is what queries need of the host of the DHT to reach peers. It
+// lets tests run queries against fake peers, and see how they're dialed,
+// without any networking.
+type dhtHost interface {
+	// Self is our own ID.
+	Self() peer.ID
+	// Connect connects to the peer of pi, trying the addresses in pi and the
+	// ones we know of.
+	Connect(ctx context.Context, pi pstore.PeerInfo) error
+	// Connectedness tells whether we're connected to p.
+	Connectedness(p peer.ID) inet.Connectedness
+	// AddAddrs remembers addrs as the addresses of p for ttl.
+	AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration)
+	// PeerInfo returns the addresses we know of p.
+	PeerInfo(p peer.ID) pstore.PeerInfo
+}
+
+// libp2pHost is the dhtHost of a DHT running on a libp2p host.
+type libp2pHost struct {
+	h host.Host
+}
+
+func (h libp2pHost) Self() peer.ID {
+	return h.h.ID()
+}
+
+func (h libp2pHost) Connect(ctx context.Context, pi pstore.PeerInfo) error {
+	return h.h.Connect(ctx, pi)
+}
+
+func (h libp2pHost) Connectedness(p peer.ID) inet.Connectedness {
+	return h.h.Network().Connectedness(p)
+}
+
+func (h libp2pHost) AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	h.h.Peerstore().AddAddrs(p, addrs, ttl)
+}
+
+func (h libp2pHost) PeerInfo(p peer.ID) pstore.PeerInfo {
+	return h.h.Peerstore().PeerInfo(p)
+}
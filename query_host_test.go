@@ -0,0 +1,125 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// mockDHTHost is a dhtHost that connects to the peers it's told are
+// reachable, without any networking.
+type mockDHTHost struct {
+	self      peer.ID
+	reachable map[peer.ID]bool
+
+	mu        sync.Mutex
+	connected map[peer.ID]bool
+	connects  map[peer.ID]int
+	addrs     map[peer.ID][]ma.Multiaddr
+}
+
+func newMockDHTHost(self peer.ID, reachable ...peer.ID) *mockDHTHost {
+	h := &mockDHTHost{
+		self:      self,
+		reachable: make(map[peer.ID]bool),
+		connected: make(map[peer.ID]bool),
+		connects:  make(map[peer.ID]int),
+		addrs:     make(map[peer.ID][]ma.Multiaddr),
+	}
+	for _, p := range reachable {
+		h.reachable[p] = true
+	}
+	return h
+}
+
+func (h *mockDHTHost) Self() peer.ID {
+	return h.self
+}
+
+func (h *mockDHTHost) Connect(ctx context.Context, pi pstore.PeerInfo) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.connects[pi.ID]++
+	if !h.reachable[pi.ID] {
+		return errors.New("unreachable")
+	}
+	h.connected[pi.ID] = true
+	return nil
+}
+
+func (h *mockDHTHost) Connectedness(p peer.ID) inet.Connectedness {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.connected[p] {
+		return inet.Connected
+	}
+	return inet.NotConnected
+}
+
+func (h *mockDHTHost) AddAddrs(p peer.ID, addrs []ma.Multiaddr, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.addrs[p] = append(h.addrs[p], addrs...)
+}
+
+func (h *mockDHTHost) PeerInfo(p peer.ID) pstore.PeerInfo {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return pstore.PeerInfo{ID: p, Addrs: h.addrs[p]}
+}
+
+func TestQueryMockHost(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// a seed pointing to a reachable peer, an unreachable one, and what it
+	// thinks is us.
+	self, seed, reachable, unreachable := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	addr := ma.StringCast("/ip4/1.2.3.4/tcp/4001")
+	h := newMockDHTHost(self, seed, reachable)
+	for _, p := range []peer.ID{seed, reachable, unreachable} {
+		h.addrs[p] = []ma.Multiaddr{addr}
+	}
+
+	query := makeQuery(newQueryDeps(h), "foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == seed {
+			return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{
+				{ID: reachable, Addrs: []ma.Multiaddr{addr}},
+				{ID: unreachable},
+				{ID: self},
+			}}, nil
+		}
+		return &dhtQueryResult{}, nil
+	})
+	res, err := query.Run(ctx, []peer.ID{seed})
+	if err != nil && err != routing.ErrNotFound {
+		t.Fatal(err)
+	}
+
+	if !res.queriedSet.Contains(reachable) || res.queriedSet.Contains(unreachable) {
+		t.Errorf("expected only the reachable peer to be queried, got %v", res.queriedSet.Peers())
+	}
+	if _, ok := res.failedPeers[unreachable]; !ok {
+		t.Error("expected the unreachable peer to fail")
+	}
+	if res.finalSet.Contains(self) || h.connects[self] != 0 {
+		t.Error("expected the query to skip the peer that is us")
+	}
+	for _, p := range []peer.ID{seed, reachable, unreachable} {
+		if h.connects[p] != 1 {
+			t.Errorf("expected 1 connection to %s, got %d", p, h.connects[p])
+		}
+	}
+	if len(h.addrs[reachable]) != 2 {
+		t.Errorf("expected the addresses learned of the reachable peer to be added, got %v", h.addrs[reachable])
+	}
+}
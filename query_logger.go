@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"fmt"
+	"strings"
+
+	logging "github.com/ipfs/go-log"
+)
+
+// Logger is a structured logger queries log to, see WithLogger. keyvals
+// alternate keys and values, as with zap's SugaredLogger or go-kit's log, and
+// an adapter for zerolog or zap is a few lines long.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// WithLogger makes the query log to l rather than to the go-log logger of the
+// package.
+func WithLogger(l Logger) QueryOption {
+	return func(q *dhtQuery) {
+		q.logger = l
+	}
+}
+
+// GoLogLogger adapts a go-log logger to Logger. Messages are logged as the
+// message followed by key=value pairs.
+func GoLogLogger(l logging.EventLogger) Logger {
+	return goLogLogger{l}
+}
+
+type goLogLogger struct {
+	l logging.EventLogger
+}
+
+func (g goLogLogger) Debug(msg string, keyvals ...interface{}) {
+	g.l.Debug(keyvalsMessage{msg, keyvals})
+}
+
+func (g goLogLogger) Info(msg string, keyvals ...interface{}) {
+	g.l.Info(keyvalsMessage{msg, keyvals})
+}
+
+func (g goLogLogger) Warn(msg string, keyvals ...interface{}) {
+	g.l.Warning(keyvalsMessage{msg, keyvals})
+}
+
+func (g goLogLogger) Error(msg string, keyvals ...interface{}) {
+	g.l.Error(keyvalsMessage{msg, keyvals})
+}
+
+// keyvalsMessage formats a message and its key-value pairs only if it's
+// actually logged.
+type keyvalsMessage struct {
+	msg     string
+	keyvals []interface{}
+}
+
+func (m keyvalsMessage) String() string {
+	var b strings.Builder
+	b.WriteString(m.msg)
+	for i := 0; i < len(m.keyvals); i += 2 {
+		var v interface{} = "MISSING"
+		if i+1 < len(m.keyvals) {
+			v = m.keyvals[i+1]
+		}
+		fmt.Fprintf(&b, " %v=%v", m.keyvals[i], v)
+	}
+	return b.String()
+}
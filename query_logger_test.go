@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	tu "github.com/libp2p/go-testutil"
+)
+
+// recordingLogger keeps every message logged to it.
+type recordingLogger struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+type logEntry struct {
+	level   string
+	msg     string
+	keyvals []interface{}
+}
+
+func (l *recordingLogger) log(level, msg string, keyvals []interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, logEntry{level, msg, keyvals})
+}
+
+func (l *recordingLogger) Debug(msg string, kv ...interface{}) { l.log("debug", msg, kv) }
+func (l *recordingLogger) Info(msg string, kv ...interface{})  { l.log("info", msg, kv) }
+func (l *recordingLogger) Warn(msg string, kv ...interface{})  { l.log("warn", msg, kv) }
+func (l *recordingLogger) Error(msg string, kv ...interface{}) { l.log("error", msg, kv) }
+
+func TestQueryLogger(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	var log recordingLogger
+	p := tu.RandPeerIDFatal(t)
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, nil
+	}, WithLogger(&log), WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil }))
+	query.Run(ctx, []peer.ID{d.self, p})
+
+	log.mu.Lock()
+	defer log.mu.Unlock()
+	var skippedSelf bool
+	for _, e := range log.entries {
+		if len(e.keyvals)%2 != 0 {
+			t.Errorf("expected key-value pairs, got %v", e.keyvals)
+		}
+		if e.msg == "addPeerToQuery skip" && e.keyvals[1] == d.self && e.keyvals[3] == "self" {
+			skippedSelf = true
+		}
+	}
+	if !skippedSelf {
+		t.Errorf("expected skipping ourselves to be logged, got %v", log.entries)
+	}
+}
+
+func TestKeyvalsMessage(t *testing.T) {
+	for _, tc := range []struct {
+		keyvals []interface{}
+		want    string
+	}{
+		{nil, "msg"},
+		{[]interface{}{"peer", "a", "n", 2}, "msg peer=a n=2"},
+		{[]interface{}{"peer"}, "msg peer=MISSING"},
+	} {
+		if got := fmt.Sprint(keyvalsMessage{"msg", tc.keyvals}); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,1064 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math"
+	"net"
+	"reflect"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/xerrors"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	inet "github.com/libp2p/go-libp2p-net"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+	manet "github.com/multiformats/go-multiaddr-net"
+)
+
+func TestQueryHopCounting(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const key = "foo"
+	peers := make([]peer.ID, 11)
+	for i := range peers {
+		peers[i] = tu.RandPeerIDFatal(t)
+	}
+	// farthest first, so that every peer is closer than the ones before.
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey(key))
+	for i, j := 0, len(sorted)-1; i < j; i, j = i+1, j-1 {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	}
+
+	far, sorted := sorted[0], sorted[1:]
+
+	r, err := newQueryRunner(d.newQuery(key, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	// keep the counter from reaching zero as the fake peers fail to dial.
+	r.peersRemaining.Increment(1)
+
+	// seeds don't count as hops.
+	r.addPeerToQuery(sorted[0])
+	r.addPeerToQuery(sorted[1])
+	r.seeded = true
+
+	for _, p := range sorted[2:] {
+		r.addPeerToQuery(p)
+	}
+	// neither does a peer that doesn't get us any closer.
+	r.addPeerToQuery(far)
+
+	r.Lock()
+	defer r.Unlock()
+	if expected := len(sorted) - 2; r.hops != expected {
+		t.Fatalf("expected %d hops, got %d", expected, r.hops)
+	}
+
+	// the seeds, one peer per hop, and the far peer during the last hop.
+	expected := []int{2}
+	for range sorted[2:] {
+		expected = append(expected, 1)
+	}
+	expected[len(expected)-1]++
+	if !reflect.DeepEqual(r.peersPerHop, expected) {
+		t.Fatalf("expected %v peers per hop, got %v", expected, r.peersPerHop)
+	}
+}
+
+func TestQueryHopsLogarithmic(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	const n = 32
+	dhts := setupDHTS(t, ctx, n)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// a chord-like topology: every peer knows the peers 1, 2, 4, ... away.
+	for i := range dhts {
+		for step := 1; step < n; step *= 2 {
+			connectNoSync(t, ctx, dhts[i], dhts[(i+step)%n])
+		}
+	}
+	for _, d := range dhts {
+		for d.routingTable.Size() == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	logN := int(math.Ceil(math.Log2(n)))
+	for i, d := range dhts[:4] {
+		d := d
+		key := string(dhts[n-1-i].self)
+		query := d.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			pmes, err := d.findPeerSingle(ctx, p, peer.ID(key))
+			if err != nil {
+				return nil, err
+			}
+			return &dhtQueryResult{closerPeers: pb.PBPeersToPeerInfos(pmes.GetCloserPeers())}, nil
+		})
+		res, err := query.Run(ctx, d.routingTable.NearestPeers(kb.ConvertKey(key), AlphaValue))
+		if err != nil && err != routing.ErrNotFound {
+			t.Fatal(err)
+		}
+		if hops := res.Hops(); hops > logN {
+			t.Errorf("expected at most log2(%d) = %d hops, got %d", n, logN, hops)
+		}
+	}
+}
+
+func TestQueryCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+	seeds := []peer.ID{dhts[1].self, dhts[2].self}
+
+	started := make(chan struct{}, len(seeds))
+	aborted := make(chan struct{}, len(seeds))
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		aborted <- struct{}{}
+		return nil, ctx.Err()
+	})
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := query.Run(ctx, seeds)
+		errc <- err
+	}()
+	<-started
+	query.Cancel()
+	select {
+	case <-aborted:
+	default:
+		t.Fatal("expected Cancel to wait for the in-flight RPCs to be aborted")
+	}
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected the query to be cancelled, got %v", err)
+	}
+
+	// cancelling a query that isn't running yet makes it return right away.
+	query = dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		t.Error("expected no peer to be queried")
+		return nil, nil
+	})
+	query.Cancel()
+	if _, err := query.Run(ctx, seeds); err != context.Canceled {
+		t.Fatalf("expected the query to be cancelled, got %v", err)
+	}
+}
+
+func TestQueryMinSuccessfulPeers(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+	seeds := []peer.ID{dhts[1].self, dhts[2].self, dhts[3].self}
+
+	// only one of the peers answers.
+	qfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p != dhts[1].self {
+			return nil, routing.ErrNotFound
+		}
+		return &dhtQueryResult{}, nil
+	}
+
+	if _, err := dhts[0].newQuery("foo", qfunc).Run(ctx, seeds); err != routing.ErrNotFound {
+		t.Fatalf("expected a single answer to be enough by default, got %v", err)
+	}
+
+	_, err := dhts[0].newQuery("foo", qfunc, WithMinSuccessfulPeers(2)).Run(ctx, seeds)
+	insufficient, ok := err.(*ErrInsufficientPeers)
+	if !ok {
+		t.Fatalf("expected ErrInsufficientPeers, got %v", err)
+	}
+	if insufficient.Succeeded != 1 || insufficient.Needed != 2 {
+		t.Fatalf("unexpected error %+v", insufficient)
+	}
+
+	// without answers, default queries keep failing the way they did before
+	// requiring answers, here with a peer we can't dial for lack of addresses.
+	unreachable := []peer.ID{tu.RandPeerIDFatal(t)}
+	if _, err := dhts[0].newQuery("foo", qfunc).Run(ctx, unreachable); err != routing.ErrNotFound {
+		t.Fatalf("expected not found without answers by default, got %v", err)
+	}
+	_, err = dhts[0].newQuery("foo", qfunc, WithMinSuccessfulPeers(1)).Run(ctx, unreachable)
+	if insufficient, ok := err.(*ErrInsufficientPeers); !ok || insufficient.Succeeded != 0 || insufficient.Needed != 1 {
+		t.Fatalf("expected ErrInsufficientPeers when requiring an answer, got %v", err)
+	}
+}
+
+func TestQueryOnlyCloserThanSelf(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const key = "foo"
+	var closer, farther []peer.ID
+	for len(closer) < 3 || len(farther) < 3 {
+		p := tu.RandPeerIDFatal(t)
+		if kb.Closer(p, d.self, key) {
+			closer = append(closer, p)
+		} else {
+			farther = append(farther, p)
+		}
+	}
+
+	r, err := newQueryRunner(d.newQuery(key, nil, WithOnlyCloserThanSelf()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	// keep the counter from reaching zero as the fake peers fail to dial.
+	r.peersRemaining.Increment(1)
+
+	// seeds are queried wherever they are.
+	r.addPeerToQuery(farther[0])
+	r.seeded = true
+
+	for _, p := range append(closer, farther[1:]...) {
+		r.addPeerToQuery(p)
+	}
+	if !r.peersSeen.Contains(farther[0]) {
+		t.Error("expected the seed to be queried")
+	}
+	for _, p := range closer {
+		if !r.peersSeen.Contains(p) {
+			t.Errorf("expected %s, closer than us, to be queried", p)
+		}
+	}
+	for _, p := range farther[1:] {
+		if r.peersSeen.Contains(p) {
+			t.Errorf("expected %s, farther than us, to be skipped", p)
+		}
+	}
+}
+
+func TestQueryCloser(t *testing.T) {
+	const key = "foo"
+	q := &dhtQuery{key: key, convertedKey: kb.ConvertKey(key)}
+	for i := 0; i < 100; i++ {
+		a, b := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+		if q.closer(a, b) != kb.Closer(a, b, key) {
+			t.Fatalf("expected closer(%s, %s) to agree with kb.Closer", a, b)
+		}
+	}
+	if p := tu.RandPeerIDFatal(t); q.closer(p, p) {
+		t.Fatal("expected a peer not to be closer than itself")
+	}
+}
+
+func TestQueryInitialPeerInfos(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// dhts[0] has never heard of the others.
+	d := dhts[0]
+	infos := make([]pstore.PeerInfo, 0, 2)
+	for _, other := range dhts[1:] {
+		infos = append(infos, pstore.PeerInfo{ID: other.self, Addrs: other.host.Addrs()})
+	}
+
+	var mu sync.Mutex
+	queried := make(map[peer.ID]bool)
+	qfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried[p] = true
+		return &dhtQueryResult{}, nil
+	}
+
+	query := d.newQuery("foo", qfunc, WithInitialPeerInfos(infos[:1]))
+	query.AddPeerInfos(infos[1:])
+	if _, err := query.Run(ctx, nil); err != routing.ErrNotFound {
+		t.Fatal(err)
+	}
+	for _, pi := range infos {
+		if !queried[pi.ID] {
+			t.Errorf("expected %s to be queried", pi.ID)
+		}
+	}
+}
+
+func TestQueryConnectedPeersDontWaitForDials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d := dhts[0]
+	var fast []peer.ID
+	for _, other := range dhts[1:] {
+		connect(t, ctx, d, other)
+		fast = append(fast, other.self)
+	}
+
+	addr, stop := hangingListener(t)
+	defer stop()
+
+	// more slow peers than there are dial workers, all farther from the key
+	// than the connected ones.
+	const key = "foo"
+	var slow []peer.ID
+	for len(slow) < 2*DefaultDialQueueMinParallelism {
+		p := tu.RandPeerIDFatal(t)
+		farthest := true
+		for _, f := range fast {
+			farthest = farthest && kb.Closer(f, p, key)
+		}
+		if farthest {
+			d.peerstore.AddAddr(p, addr, time.Hour)
+			slow = append(slow, p)
+		}
+	}
+
+	var (
+		mu      sync.Mutex
+		queried = make(map[peer.ID]bool)
+		done    = make(chan struct{})
+	)
+	query := d.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		queried[p] = true
+		if len(queried) == len(fast) {
+			close(done)
+		}
+		return &dhtQueryResult{}, nil
+	})
+	go query.Run(ctx, append(slow, fast...))
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the connected peers to be queried without waiting for the slow dials")
+	}
+	query.Cancel()
+}
+
+func TestQueryConnectedPeersKeepTheirPlace(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d, far := dhts[0], dhts[1]
+	connect(t, ctx, d, far)
+
+	addr, stop := hangingListener(t)
+	defer stop()
+
+	// more slow peers than there can be dial workers, all closer to the key
+	// than the connected one, so some are still waiting to be dialed when
+	// it's added.
+	const key = "foo"
+	var slow []peer.ID
+	for len(slow) < 2*DefaultDialQueueMaxParallelism {
+		p := tu.RandPeerIDFatal(t)
+		if kb.Closer(p, far.self, key) {
+			d.peerstore.AddAddr(p, addr, time.Hour)
+			slow = append(slow, p)
+		}
+	}
+
+	queried := make(chan peer.ID, 1)
+	query := d.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		queried <- p
+		return &dhtQueryResult{}, nil
+	})
+	defer query.Cancel()
+	go query.Run(ctx, append(slow, far.self))
+
+	select {
+	case p := <-queried:
+		t.Fatalf("expected the connected peer to wait for the closer ones, got %s queried", p)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+func TestQueryProfilerLabels(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	var profile bytes.Buffer
+	query := dhts[0].newQuery("profiled-key", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, pprof.Lookup("goroutine").WriteTo(&profile, 1)
+	})
+	if _, err := query.Run(ctx, []peer.ID{dhts[1].self}); err != nil && err != routing.ErrNotFound {
+		t.Fatal(err)
+	}
+	for _, label := range []string{`"dht.key":"profiled-key"`, `"dht.phase":"query"`} {
+		if !strings.Contains(profile.String(), label) {
+			t.Errorf("expected the query goroutines to be labeled with %s", label)
+		}
+	}
+}
+
+func TestQueryKeepsVerifiedAddrs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d, other := dhts[0], dhts[1]
+	connect(t, ctx, d, other)
+
+	// an address we only heard of, and a peer that won't answer.
+	stale, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	silent := tu.RandPeerIDFatal(t)
+	d.peerstore.AddAddr(other.self, stale, pstore.TempAddrTTL)
+	d.peerstore.AddAddr(silent, stale, pstore.TempAddrTTL)
+
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == silent {
+			return nil, errors.New("no answer")
+		}
+		return &dhtQueryResult{}, nil
+	})
+	if _, err := query.Run(ctx, []peer.ID{other.self, silent}); err != nil && err != routing.ErrNotFound {
+		t.Fatal(err)
+	}
+
+	// expire whatever is still temporary.
+	d.peerstore.UpdateAddrs(other.self, pstore.TempAddrTTL, 0)
+	d.peerstore.UpdateAddrs(silent, pstore.TempAddrTTL, 0)
+	if !hasAddr(d.peerstore.Addrs(other.self), stale) {
+		t.Error("expected the addresses of the peer that answered to be kept longer")
+	}
+	if hasAddr(d.peerstore.Addrs(silent), stale) {
+		t.Error("expected the addresses of the peer that didn't answer to stay temporary")
+	}
+
+	// the address we're connected on outlives the others.
+	d.peerstore.UpdateAddrs(other.self, DefaultVerifiedAddrTTL, 0)
+	conns := d.host.Network().ConnsToPeer(other.self)
+	if len(conns) == 0 || !hasAddr(d.peerstore.Addrs(other.self), conns[0].RemoteMultiaddr()) {
+		t.Error("expected the address that worked to be kept while connected")
+	}
+}
+
+func hasAddr(addrs []ma.Multiaddr, a ma.Multiaddr) bool {
+	for _, b := range addrs {
+		if a.Equal(b) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestQueryAdaptivePeerTimeout(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	d.perPeerTimeout = 10 * time.Second
+
+	near, mid, far, unknown := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	d.peerstore.RecordLatency(near, time.Millisecond)
+	d.peerstore.RecordLatency(mid, 100*time.Millisecond)
+	d.peerstore.RecordLatency(far, time.Second)
+
+	q := d.newQuery("foo", nil)
+	if to := q.peerTimeout(mid); to != d.perPeerTimeout {
+		t.Errorf("expected the fixed timeout without adaptive timeouts, got %s", to)
+	}
+
+	d.minPeerTimeout, d.maxPeerTimeout = 50*time.Millisecond, 2*time.Second
+	q = d.newQuery("foo", nil)
+	for _, c := range []struct {
+		p       peer.ID
+		timeout time.Duration
+	}{
+		{near, 50 * time.Millisecond},
+		{mid, 400 * time.Millisecond},
+		{far, 2 * time.Second},
+		{unknown, 10 * time.Second},
+	} {
+		if to := q.peerTimeout(c.p); to != c.timeout {
+			t.Errorf("expected a timeout of %s, got %s", c.timeout, to)
+		}
+	}
+}
+
+// hangingListener returns the address of a listener that accepts connections
+// but never completes a handshake, so that dialing the peers behind it takes
+// forever, and a function that stops it.
+func hangingListener(t *testing.T) (ma.Multiaddr, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		var conns []net.Conn
+		defer func() {
+			for _, c := range conns {
+				c.Close()
+			}
+		}()
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, c)
+		}
+	}()
+	addr, err := manet.FromNetAddr(l.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr, func() { l.Close() }
+}
+
+func TestQueryNoDialsAfterReturn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d, good := dhts[0], dhts[1]
+	connect(t, ctx, d, good)
+
+	// peers whose dials take a while to notice they were cancelled.
+	d.webrtc = slowSignaler(100 * time.Millisecond)
+	webrtc, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/9090/http/p2p-webrtc-direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var seeds []peer.ID
+	for i := 0; i < 2*DefaultDialQueueMinParallelism; i++ {
+		p := tu.RandPeerIDFatal(t)
+		d.peerstore.AddAddr(p, webrtc, time.Hour)
+		seeds = append(seeds, p)
+	}
+
+	var dials int32
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{success: true}, nil
+	}, WithDialFailureHook(func(peer.ID, error) {
+		atomic.AddInt32(&dials, 1)
+	}))
+	if _, err := query.Run(ctx, append(seeds, good.self)); err != nil {
+		t.Fatal(err)
+	}
+	// the dials that were in progress when the query found its answer are
+	// done with before it returns.
+	n := atomic.LoadInt32(&dials)
+	if n == 0 {
+		t.Fatal("expected the query to have been dialing peers")
+	}
+	time.Sleep(200 * time.Millisecond)
+	if m := atomic.LoadInt32(&dials); m != n {
+		t.Fatalf("expected no dials after the query returned, got %d", m-n)
+	}
+}
+
+type slowSignaler time.Duration
+
+func (s slowSignaler) Signal(context.Context, peer.ID, []ma.Multiaddr) error {
+	time.Sleep(time.Duration(s))
+	return errors.New("signaling failed")
+}
+
+func TestQuerySkipsPeersWithoutAddrs(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	// dhts[1] points at a peer nobody knows the addresses of.
+	ghost := tu.RandPeerIDFatal(t)
+	log := NewAuditLog()
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == dhts[1].self {
+			return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{{ID: ghost}}}, nil
+		}
+		t.Errorf("didn't expect %s to be queried", p)
+		return &dhtQueryResult{}, nil
+	}, WithAuditLog(log))
+
+	evctx, evcancel := context.WithCancel(ctx)
+	evctx, events := notif.RegisterForQueryEvents(evctx)
+	done := make(chan *QueryStats)
+	go func() {
+		var stats *QueryStats
+		for ev := range events {
+			if ev.Type == QueryCompleted {
+				stats, _ = ParseQueryStats(ev)
+			}
+		}
+		done <- stats
+	}()
+	res, err := query.Run(evctx, []peer.ID{dhts[1].self})
+	evcancel()
+	stats := <-done
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	for _, e := range log.Entries() {
+		if e.Op == AuditDial && e.Peer == ghost {
+			t.Error("expected no dial of the peer without addresses")
+		}
+	}
+	if n := len(res.PeerErrors()); n != 0 {
+		t.Errorf("expected no peer errors, got %d", n)
+	}
+	if stats == nil || stats.PeersNoAddrs != 1 || stats.PeersFailed != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestQueryRateLimitJitter(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	connect(t, ctx, dhts[0], dhts[1])
+
+	var queried int32
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		atomic.AddInt32(&queried, 1)
+		return &dhtQueryResult{}, nil
+	}, WithRateLimitJitter(time.Hour))
+
+	// the query almost certainly waits longer than we do, and must give up
+	// waiting when it's cancelled.
+	qctx, qcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer qcancel()
+	start := time.Now()
+	if _, err := query.Run(qctx, []peer.ID{dhts[1].self}); err != context.DeadlineExceeded {
+		t.Fatalf("expected the query to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to stop waiting when cancelled, took %s", elapsed)
+	}
+	if atomic.LoadInt32(&queried) != 0 {
+		t.Error("expected no peer to be queried before the jitter elapsed")
+	}
+}
+
+func TestQueryGlobalConcurrencyLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const limit = 2
+	d.globalQuerySemaphore = make(chan struct{}, limit)
+
+	var (
+		mu                sync.Mutex
+		inFlight, maxSeen int
+	)
+	qfunc := func(ctx context.Context, _ peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxSeen {
+			maxSeen = inFlight
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		return &dhtQueryResult{}, nil
+	}
+	dial := WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil })
+
+	// queries that could each query all their fake peers at once.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		peers := []peer.ID{tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.newQuery("foo", qfunc, dial).Run(ctx, peers)
+		}()
+	}
+	wg.Wait()
+
+	if maxSeen != limit {
+		t.Errorf("expected at most %d peers queried at a time, got %d", limit, maxSeen)
+	}
+	if n := len(d.globalQuerySemaphore); n != 0 {
+		t.Errorf("expected every slot to be released, got %d taken", n)
+	}
+}
+
+func TestQueryDialTimeout(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const timeout = 50 * time.Millisecond
+	d.dialTimeout = timeout
+
+	// fake peers, one behind a black hole and one refusing connections.
+	unresponsive, refusing := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	errRefused := errors.New("connection refused")
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, nil
+	}, WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		if pi.ID == refusing {
+			return errRefused
+		}
+		<-ctx.Done()
+		return ctx.Err()
+	}))
+
+	start := time.Now()
+	res, _ := query.Run(ctx, []peer.ID{unresponsive, refusing})
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the unresponsive peer to give up after %s, the query took %s", timeout, elapsed)
+	}
+	if err := res.failedPeers[unresponsive]; err != ErrDialTimeout {
+		t.Errorf("expected the unresponsive peer to time out, got %v", err)
+	}
+	if err := res.failedPeers[refusing]; err != errRefused {
+		t.Errorf("expected the refusing peer to refuse the connection, got %v", err)
+	}
+	for _, pt := range res.PeerTimings() {
+		if pt.Peer == unresponsive && (pt.Dial < timeout || pt.Dial > time.Second) {
+			t.Errorf("expected the dial of the unresponsive peer to take %s, got %s", timeout, pt.Dial)
+		}
+	}
+}
+
+func TestQueryDialQueueError(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	errNoDialQueue := errors.New("no dial queue")
+	defer func(f func(*dqParams) (*dialQueue, error)) { newDialQueueFunc = f }(newDialQueueFunc)
+	newDialQueueFunc = func(*dqParams) (*dialQueue, error) {
+		return nil, errNoDialQueue
+	}
+
+	_, err := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		return &dhtQueryResult{}, nil
+	}).Run(ctx, []peer.ID{tu.RandPeerIDFatal(t)})
+	if !xerrors.Is(err, errNoDialQueue) {
+		t.Fatalf("expected the query to fail on the dial queue, got %v", err)
+	}
+}
+
+func TestQueryMaxDialAttempts(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 2)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	d, flapping := dhts[0], dhts[1].self
+	d.peerstore.AddAddrs(flapping, dhts[1].host.Addrs(), pstore.TempAddrTTL)
+
+	var connects int32
+	d.host.Network().Notify(&inet.NotifyBundle{
+		ConnectedF: func(_ inet.Network, c inet.Conn) {
+			if c.RemotePeer() == flapping {
+				atomic.AddInt32(&connects, 1)
+			}
+		},
+	})
+
+	// the connection drops as soon as it's up, so that the RPC dials again.
+	run := func(max int) (*dhtQueryResult, int) {
+		atomic.StoreInt32(&connects, 0)
+		res, _ := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			_, err := d.sendRequest(ctx, p, pb.NewMessage(pb.Message_PING, nil, 0))
+			return &dhtQueryResult{}, err
+		}, WithMaxDialAttempts(max), WithDialSuccessHook(func(p peer.ID, _ time.Duration) {
+			d.host.Network().ClosePeer(p)
+		})).Run(ctx, []peer.ID{flapping})
+		d.host.Network().ClosePeer(flapping)
+		return res, int(atomic.LoadInt32(&connects))
+	}
+
+	res, n := run(1)
+	if n > 1 {
+		t.Errorf("expected at most 1 connection to the flapping peer, got %d", n)
+	}
+	if err := res.failedPeers[flapping]; err != errMaxDialAttempts {
+		t.Errorf("expected the flapping peer to fail with %q, got %v", errMaxDialAttempts, err)
+	}
+
+	res, n = run(2)
+	if n > 2 {
+		t.Errorf("expected at most 2 connections to the flapping peer, got %d", n)
+	}
+	if err := res.failedPeers[flapping]; err != nil {
+		t.Errorf("expected the flapping peer to answer once dialed again, got %v", err)
+	}
+}
+
+func TestQueryStaleDialPruning(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	d.bucketSize = 2
+
+	// two fake peers closest to the key, the second of which only points to
+	// farther peers.
+	var peers []peer.ID
+	for i := 0; i < 10; i++ {
+		peers = append(peers, tu.RandPeerIDFatal(t))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey("foo"))
+	seed, next, far := sorted[0], sorted[1], sorted[2:]
+	var farInfos []*pstore.PeerInfo
+	for _, p := range far {
+		farInfos = append(farInfos, &pstore.PeerInfo{ID: p})
+	}
+
+	var dialed int32
+	for _, prune := range []bool{false, true} {
+		atomic.StoreInt32(&dialed, 0)
+		options := []QueryOption{WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+			atomic.AddInt32(&dialed, 1)
+			return nil
+		})}
+		if prune {
+			options = append(options, WithStaleDialPruning())
+		}
+		query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			switch p {
+			case seed:
+				return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{{ID: next}}}, nil
+			case next:
+				return &dhtQueryResult{closerPeers: farInfos}, nil
+			}
+			return &dhtQueryResult{}, nil
+		}, options...)
+		res, _ := query.Run(ctx, []peer.ID{seed})
+
+		want := int32(len(sorted))
+		if prune {
+			want = 2
+		}
+		if n := atomic.LoadInt32(&dialed); n != want {
+			t.Errorf("expected %d dials with pruning %v, got %d", want, prune, n)
+		}
+		if n := res.finalSet.Size(); n != len(sorted) {
+			t.Errorf("expected the query to see all %d peers, got %d", len(sorted), n)
+		}
+	}
+}
+
+func TestQueryFinalNotFound(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	// fake peers: one knows for sure there's nothing to find, one never
+	// answers, and one knows for sure but still has closer peers to offer.
+	definitive, hanging, pointing, closer := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	var queriedCloser int32
+	run := func(seeds ...peer.ID) error {
+		_, err := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+			switch p {
+			case definitive:
+				return &dhtQueryResult{final: true}, nil
+			case hanging:
+				<-ctx.Done()
+				return nil, ctx.Err()
+			case pointing:
+				return &dhtQueryResult{final: true, closerPeers: []*pstore.PeerInfo{{ID: closer}}}, nil
+			case closer:
+				atomic.AddInt32(&queriedCloser, 1)
+			}
+			return &dhtQueryResult{}, nil
+		}, WithDialFunc(func(context.Context, pstore.PeerInfo) error { return nil })).Run(ctx, seeds)
+		return err
+	}
+
+	start := time.Now()
+	if err := run(definitive, hanging); err != routing.ErrNotFound {
+		t.Errorf("expected a definitive not found, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to stop on the definitive answer, it took %s", elapsed)
+	}
+
+	if err := run(pointing); err != routing.ErrNotFound {
+		t.Errorf("expected the query to find nothing, got %v", err)
+	}
+	if atomic.LoadInt32(&queriedCloser) != 1 {
+		t.Error("expected the closer peers of a definitive answer to be queried anyway")
+	}
+}
+
+func TestQueryAbortsStaleDials(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	d.bucketSize = 2
+
+	// the seeds are a peer pointing to the two closest peers, and the
+	// farthest peer, which takes forever to dial.
+	var peers []peer.ID
+	for i := 0; i < 4; i++ {
+		peers = append(peers, tu.RandPeerIDFatal(t))
+	}
+	sorted := kb.SortClosestPeers(peers, kb.ConvertKey("foo"))
+	closest, seed, far := sorted[:2], sorted[2], sorted[3]
+
+	aborted := make(chan struct{})
+	start := time.Now()
+	res, err := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == seed {
+			return &dhtQueryResult{closerPeers: []*pstore.PeerInfo{{ID: closest[0]}, {ID: closest[1]}}}, nil
+		}
+		return &dhtQueryResult{}, nil
+	}, WithStaleDialPruning(), WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		if pi.ID == far {
+			<-ctx.Done()
+			close(aborted)
+			return ctx.Err()
+		}
+		return nil
+	})).Run(ctx, []peer.ID{seed, far})
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected the query to find nothing, got %v", err)
+	}
+
+	select {
+	case <-aborted:
+	default:
+		t.Fatal("expected the dial of the far peer to be aborted")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the query to end once the closest peers answered, it took %s", elapsed)
+	}
+	if err, ok := res.failedPeers[far]; ok {
+		t.Errorf("didn't expect the far peer to count as failed, got %v", err)
+	}
+	if n := res.queriedSet.Size(); n != 3 {
+		t.Errorf("expected the seed and the closest peers to be queried, got %d peers", n)
+	}
+}
@@ -0,0 +1,145 @@
+package dht
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// QueryTreeNode is a peer in a QueryTree.
+type QueryTreeNode struct {
+	Peer peer.ID
+	// State is the furthest the query got with the peer: "added",
+	// "dialing", "queried", "responded" or "failed".
+	State string
+	// Children are the peers this peer was the first to return as closer
+	// peers.
+	Children []*QueryTreeNode
+}
+
+// QueryTree is the recursion tree of a query: every node is a peer, and the
+// children of a node are the closer peers it returned that no other peer had
+// returned before. The roots are the peers the query started with.
+//
+// Build one from the query events of a lookup, as they happen or after the
+// fact, e.g. with the events received on a context registered with
+// notif.RegisterForQueryEvents.
+type QueryTree struct {
+	mu    sync.Mutex
+	roots []*QueryTreeNode
+	nodes map[peer.ID]*QueryTreeNode
+}
+
+// NewQueryTree returns an empty QueryTree.
+func NewQueryTree() *QueryTree {
+	return &QueryTree{nodes: make(map[peer.ID]*QueryTreeNode)}
+}
+
+// QueryTreeFromEvents returns the QueryTree of the given query events.
+func QueryTreeFromEvents(events []*notif.QueryEvent) *QueryTree {
+	t := NewQueryTree()
+	for _, ev := range events {
+		t.Add(ev)
+	}
+	return t
+}
+
+// Add updates the tree with a query event. Events that don't concern a
+// particular peer are ignored.
+func (t *QueryTree) Add(ev *notif.QueryEvent) {
+	if ev.ID == "" {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	n := t.node(ev.ID, nil)
+	switch ev.Type {
+	case notif.DialingPeer:
+		n.advance("dialing")
+	case notif.SendingQuery:
+		n.advance("queried")
+	case notif.PeerResponse:
+		n.advance("responded")
+		for _, pi := range ev.Responses {
+			t.node(pi.ID, n)
+		}
+	case notif.QueryError:
+		n.State = "failed"
+	}
+}
+
+// node returns the node of p, creating it as a child of parent, or as a root
+// if parent is nil, if it doesn't exist yet.
+func (t *QueryTree) node(p peer.ID, parent *QueryTreeNode) *QueryTreeNode {
+	if n, ok := t.nodes[p]; ok {
+		return n
+	}
+	n := &QueryTreeNode{Peer: p, State: "added"}
+	t.nodes[p] = n
+	if parent != nil {
+		parent.Children = append(parent.Children, n)
+	} else {
+		t.roots = append(t.roots, n)
+	}
+	return n
+}
+
+var queryTreeStates = map[string]int{"added": 0, "dialing": 1, "queried": 2, "responded": 3}
+
+// advance moves n to state, unless it's already further along or failed.
+func (n *QueryTreeNode) advance(state string) {
+	if cur, ok := queryTreeStates[n.State]; ok && cur < queryTreeStates[state] {
+		n.State = state
+	}
+}
+
+// Roots returns the peers the query started with. The nodes are shared with
+// the tree, don't walk them while events are still being added.
+func (t *QueryTree) Roots() []*QueryTreeNode {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]*QueryTreeNode(nil), t.roots...)
+}
+
+// Len returns the number of peers in the tree.
+func (t *QueryTree) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.nodes)
+}
+
+// queryTreeJSON is the nested format d3.hierarchy understands.
+type queryTreeJSON struct {
+	Name     string           `json:"name"`
+	State    string           `json:"state,omitempty"`
+	Children []*queryTreeJSON `json:"children,omitempty"`
+}
+
+// RenderQueryTreeJSON writes tree to w as nested JSON objects with "name",
+// "state" and "children" fields, ready for d3.hierarchy. The root object
+// stands for the query itself, its children are the roots of tree.
+func RenderQueryTreeJSON(tree *QueryTree, w io.Writer) error {
+	tree.mu.Lock()
+	root := &queryTreeJSON{Name: "query"}
+	for _, n := range tree.roots {
+		root.Children = append(root.Children, n.toJSON())
+	}
+	tree.mu.Unlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(root)
+}
+
+func (n *QueryTreeNode) toJSON() *queryTreeJSON {
+	out := &queryTreeJSON{Name: n.Peer.Pretty(), State: n.State}
+	for _, c := range n.Children {
+		out.Children = append(out.Children, c.toJSON())
+	}
+	return out
+}
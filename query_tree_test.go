@@ -0,0 +1,108 @@
+package dht
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestQueryTree(t *testing.T) {
+	a, b, c, d := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	tree := QueryTreeFromEvents([]*notif.QueryEvent{
+		{Type: notif.SendingQuery, ID: a},
+		{Type: notif.PeerResponse, ID: a, Responses: []*pstore.PeerInfo{{ID: b}, {ID: c}}},
+		{Type: notif.DialingPeer, ID: b},
+		{Type: notif.SendingQuery, ID: b},
+		// c was returned by a first, so it stays a's child.
+		{Type: notif.PeerResponse, ID: b, Responses: []*pstore.PeerInfo{{ID: c}, {ID: d}}},
+		{Type: notif.QueryError, ID: c},
+		// a late dial event doesn't undo the response.
+		{Type: notif.DialingPeer, ID: b},
+		{Type: QueryCompleted},
+	})
+
+	if n := tree.Len(); n != 4 {
+		t.Fatalf("expected 4 peers in the tree, got %d", n)
+	}
+	roots := tree.Roots()
+	if len(roots) != 1 || roots[0].Peer != a {
+		t.Fatalf("expected a single root, the seed")
+	}
+	root := roots[0]
+	if len(root.Children) != 2 || root.Children[0].Peer != b || root.Children[1].Peer != c {
+		t.Fatalf("expected the seed to have returned b and c first")
+	}
+	nb, nc := root.Children[0], root.Children[1]
+	if len(nb.Children) != 1 || nb.Children[0].Peer != d {
+		t.Fatalf("expected b to have returned d first")
+	}
+	for _, c := range []struct {
+		node  *QueryTreeNode
+		state string
+	}{{root, "responded"}, {nb, "responded"}, {nc, "failed"}, {nb.Children[0], "added"}} {
+		if c.node.State != c.state {
+			t.Errorf("expected %s to be %s, got %s", c.node.Peer, c.state, c.node.State)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := RenderQueryTreeJSON(tree, &buf); err != nil {
+		t.Fatal(err)
+	}
+	var out queryTreeJSON
+	if err := json.Unmarshal(buf.Bytes(), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Name != "query" || len(out.Children) != 1 {
+		t.Fatalf("expected the query to be the root of the JSON tree, got %s", buf.String())
+	}
+	if n := out.Children[0]; n.Name != a.Pretty() || len(n.Children) != 2 || n.Children[0].Children[0].Name != d.Pretty() {
+		t.Fatalf("unexpected JSON tree: %s", buf.String())
+	}
+}
+
+func TestSpanningTreeQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// a chain, every peer only knows its neighbors.
+	for i := 0; i < len(dhts)-1; i++ {
+		connect(t, ctx, dhts[i], dhts[i+1])
+	}
+
+	tree, err := dhts[0].SpanningTreeQuery(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Root() != dhts[0].self {
+		t.Errorf("expected us at the root, got %s", tree.Root())
+	}
+	// the referrals follow the chain.
+	p := tree.Root()
+	for _, d := range dhts[1:] {
+		children := tree.Children(p)
+		if len(children) != 1 || children[0] != d.self {
+			t.Fatalf("expected %s to refer to %s only, got %v", p, d.self, children)
+		}
+		p = d.self
+	}
+	if children := tree.Children(p); len(children) != 0 {
+		t.Errorf("expected the end of the chain to be a leaf, got %v", children)
+	}
+	if d := tree.Depth(); d != len(dhts)-1 {
+		t.Errorf("expected a depth of %d, got %d", len(dhts)-1, d)
+	}
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"math/bits"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+// RandomWalk refreshes the routing table the way Kademlia does: it looks up a
+// random key in the bucket that was least recently covered by a lookup, and
+// adds every peer the lookup discovered to the routing table, not just the K
+// closest to the key.
+//
+// Buckets are identified by the length of the prefix their keys share with
+// our ID, so finding a key in a deep bucket takes about 2^depth hashes. With
+// routing tables rarely deeper than log2 of the network size, that's cheap
+// compared to the lookup itself.
+func (dht *IpfsDHT) RandomWalk(ctx context.Context) error {
+	cpl, last := dht.staleBucket()
+	key, err := randomKeyInBucket(kb.ConvertPeerID(dht.self), cpl, last)
+	if err != nil {
+		return err
+	}
+
+	seeds := dht.routingTable.NearestPeers(kb.ConvertKey(key), dht.alpha)
+	if len(seeds) == 0 {
+		return kb.ErrLookupFailure
+	}
+	logger.Debugf("random walk in bucket %d", cpl)
+
+	res, err := dht.newQuery(key, dht.closerPeersFunc(ctx, key)).Run(ctx, seeds)
+	dht.bucketRefreshed(key)
+	if res != nil && res.finalSet != nil {
+		for _, p := range res.finalSet.Peers() {
+			if res.failedPeers[p] == nil {
+				dht.Update(ctx, p)
+			}
+		}
+	}
+	if err == routing.ErrNotFound {
+		return nil
+	}
+	return err
+}
+
+// bucketRefreshed records that a lookup for key just covered its bucket.
+func (dht *IpfsDHT) bucketRefreshed(key string) {
+	cpl := bitPrefixLen(kb.ConvertKey(key), kb.ConvertPeerID(dht.self))
+	dht.rflk.Lock()
+	dht.refreshed[cpl] = time.Now()
+	dht.rflk.Unlock()
+}
+
+// staleBucket returns the bucket least recently covered by a lookup, and
+// whether it's the last one, which also holds all the deeper peers.
+func (dht *IpfsDHT) staleBucket() (cpl int, last bool) {
+	self := kb.ConvertPeerID(dht.self)
+	depth := 0
+	for _, p := range dht.routingTable.ListPeers() {
+		if c := bitPrefixLen(kb.ConvertPeerID(p), self); c > depth {
+			depth = c
+		}
+	}
+
+	dht.rflk.Lock()
+	defer dht.rflk.Unlock()
+	for i := 1; i <= depth; i++ {
+		if dht.refreshed[i].Before(dht.refreshed[cpl]) {
+			cpl = i
+		}
+	}
+	return cpl, cpl == depth
+}
+
+// randomKeyInBucket returns a random key whose hash shares exactly cpl bits of
+// prefix with self, or at least cpl if orDeeper is set.
+func randomKeyInBucket(self kb.ID, cpl int, orDeeper bool) (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	for n := uint64(0); ; n++ {
+		binary.BigEndian.PutUint64(buf[len(buf)-8:], n)
+		key := string(buf)
+		c := bitPrefixLen(kb.ConvertKey(key), self)
+		if c == cpl || (orDeeper && c > cpl) {
+			return key, nil
+		}
+	}
+}
+
+// bitPrefixLen returns the number of leading bits a and b have in common.
+func bitPrefixLen(a, b kb.ID) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return len(a) * 8
+}
@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestRandomKeyInBucket(t *testing.T) {
+	self := kb.ConvertPeerID(tu.RandPeerIDFatal(t))
+	for cpl := 0; cpl < 8; cpl++ {
+		key, err := randomKeyInBucket(self, cpl, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := bitPrefixLen(kb.ConvertKey(key), self); c != cpl {
+			t.Errorf("expected a key in bucket %d, got one in bucket %d", cpl, c)
+		}
+		key, err = randomKeyInBucket(self, cpl, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c := bitPrefixLen(kb.ConvertKey(key), self); c < cpl {
+			t.Errorf("expected a key in bucket %d or deeper, got one in bucket %d", cpl, c)
+		}
+	}
+}
+
+func TestRandomWalk(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 5)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	// dhts[0] only knows dhts[1], which knows everyone.
+	connect(t, ctx, dhts[0], dhts[1])
+	for _, d := range dhts[2:] {
+		connect(t, ctx, dhts[1], d)
+	}
+	d := dhts[0]
+
+	if cpl, _ := d.staleBucket(); cpl != 0 {
+		t.Fatalf("expected the first bucket to be the stalest, got %d", cpl)
+	}
+	if err := d.RandomWalk(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if size := d.routingTable.Size(); size != len(dhts)-1 {
+		t.Fatalf("expected the random walk to find all %d peers, found %d", len(dhts)-1, size)
+	}
+
+	d.rflk.Lock()
+	var walked []int
+	for cpl := range d.refreshed {
+		walked = append(walked, cpl)
+	}
+	d.rflk.Unlock()
+	if len(walked) != 1 {
+		t.Fatalf("expected one bucket to be refreshed, got %v", walked)
+	}
+	// the next walk goes elsewhere, if there's anywhere else to go.
+	if cpl, last := d.staleBucket(); cpl == walked[0] && !(cpl == 0 && last) {
+		t.Fatalf("expected the next walk to pick another bucket than %d", cpl)
+	}
+}
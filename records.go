@@ -104,7 +104,7 @@ func (dht *IpfsDHT) getPublicKeyFromNode(ctx context.Context, p peer.ID) (ci.Pub
 
 	// Get the key from the node itself
 	pkkey := routing.KeyForPublicKey(p)
-	pmes, err := dht.getValueSingle(ctx, p, pkkey)
+	pmes, err := dht.getValueSingle(ctx, p, dht.transformKey(pkkey))
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,164 @@
+package dht
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	process "github.com/jbenet/goprocess"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// ReputationConfig configures a PeerReputationCache.
+type ReputationConfig struct {
+	// Decay is the weight given to the newest observation in the moving
+	// averages, in (0, 1]. Higher values forget history faster.
+	Decay float64
+	// SlowLatency is the RPC latency above which a peer's reputation starts
+	// to suffer.
+	SlowLatency time.Duration
+	// Sensitivity scales the probability of skipping a peer with a poor
+	// reputation, in [0, 1]. Zero never skips anyone.
+	Sensitivity float64
+	// TTL is how long a peer's reputation is kept after its last RPC.
+	TTL time.Duration
+}
+
+// DefaultReputationConfig is a reasonable starting point for most networks.
+var DefaultReputationConfig = ReputationConfig{
+	Decay:       0.2,
+	SlowLatency: time.Second,
+	Sensitivity: 0.5,
+	TTL:         30 * time.Minute,
+}
+
+func (c *ReputationConfig) validate() error {
+	if c.Decay <= 0 || c.Decay > 1 {
+		return fmt.Errorf("decay must be in (0, 1]; actual value: %f", c.Decay)
+	}
+	if c.SlowLatency <= 0 {
+		return fmt.Errorf("slow latency must be positive; actual value: %s", c.SlowLatency)
+	}
+	if c.Sensitivity < 0 || c.Sensitivity > 1 {
+		return fmt.Errorf("sensitivity must be in [0, 1]; actual value: %f", c.Sensitivity)
+	}
+	if c.TTL <= 0 {
+		return fmt.Errorf("ttl must be positive; actual value: %s", c.TTL)
+	}
+	return nil
+}
+
+type peerReputation struct {
+	successRate float64       // moving average of RPC successes, in [0, 1]
+	latency     time.Duration // moving average of RPC latency
+	lastSeen    time.Time
+}
+
+// PeerReputationCache tracks how well peers have been answering our query
+// RPCs so that queries can avoid wasting their concurrency on peers that are
+// slow or keep failing.
+type PeerReputationCache struct {
+	cfg ReputationConfig
+
+	mu    sync.Mutex
+	peers map[peer.ID]*peerReputation
+}
+
+// NewPeerReputationCache returns an empty PeerReputationCache.
+func NewPeerReputationCache(cfg ReputationConfig) (*PeerReputationCache, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &PeerReputationCache{
+		cfg:   cfg,
+		peers: make(map[peer.ID]*peerReputation),
+	}, nil
+}
+
+// Record updates the reputation of p with the outcome of an RPC.
+func (c *PeerReputationCache) Record(p peer.ID, success bool, latency time.Duration) {
+	var outcome float64
+	if success {
+		outcome = 1
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.peers[p]
+	if !ok {
+		c.peers[p] = &peerReputation{
+			successRate: outcome,
+			latency:     latency,
+			lastSeen:    time.Now(),
+		}
+		return
+	}
+	w := c.cfg.Decay
+	r.successRate = w*outcome + (1-w)*r.successRate
+	r.latency = time.Duration(w*float64(latency) + (1-w)*float64(r.latency))
+	r.lastSeen = time.Now()
+}
+
+// Reputation returns the reputation of p, from 0 (worst) to 1 (best). Peers
+// we know nothing about have a perfect reputation.
+func (c *PeerReputationCache) Reputation(p peer.ID) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.peers[p]
+	if !ok {
+		return 1
+	}
+	score := r.successRate
+	if r.latency > c.cfg.SlowLatency {
+		score *= float64(c.cfg.SlowLatency) / float64(r.latency)
+	}
+	return score
+}
+
+// shouldSkip randomly decides whether a query should pass over p, with a
+// probability that grows as its reputation worsens.
+func (c *PeerReputationCache) shouldSkip(p peer.ID) bool {
+	if c.cfg.Sensitivity == 0 {
+		return false
+	}
+	return rand.Float64() < c.cfg.Sensitivity*(1-c.Reputation(p))
+}
+
+// flush forgets the peers we haven't heard from since before cutoff.
+func (c *PeerReputationCache) flush(cutoff time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for p, r := range c.peers {
+		if r.lastSeen.Before(cutoff) {
+			delete(c.peers, p)
+		}
+	}
+}
+
+// flushLoop periodically forgets stale reputations until proc closes.
+func (c *PeerReputationCache) flushLoop(proc process.Process) {
+	tick := time.NewTicker(c.cfg.TTL / 2)
+	defer tick.Stop()
+	for {
+		select {
+		case now := <-tick.C:
+			c.flush(now.Add(-c.cfg.TTL))
+		case <-proc.Closing():
+			return
+		}
+	}
+}
+
+// PeerReputation returns the reputation of p, from 0 (worst) to 1 (best), as
+// seen by this DHT's queries. It's always 1 unless the DHT was constructed
+// with the WithPeerReputation option.
+func (dht *IpfsDHT) PeerReputation(p peer.ID) float64 {
+	if dht.reputation == nil {
+		return 1
+	}
+	return dht.reputation.Reputation(p)
+}
@@ -0,0 +1,93 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+func TestPeerReputationCache(t *testing.T) {
+	cfg := DefaultReputationConfig
+	cfg.Sensitivity = 1
+	c, err := NewPeerReputationCache(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	good, slow, failing := peer.ID("good"), peer.ID("slow"), peer.ID("failing")
+
+	for i := 0; i < 20; i++ {
+		c.Record(good, true, 10*time.Millisecond)
+		c.Record(slow, true, 4*cfg.SlowLatency)
+		c.Record(failing, false, 10*time.Millisecond)
+	}
+
+	if r := c.Reputation(good); r != 1 {
+		t.Errorf("expected a perfect reputation for the good peer, got %f", r)
+	}
+	if r := c.Reputation(slow); r > 0.3 {
+		t.Errorf("expected a poor reputation for the slow peer, got %f", r)
+	}
+	if r := c.Reputation(failing); r != 0 {
+		t.Errorf("expected the worst reputation for the failing peer, got %f", r)
+	}
+	if r := c.Reputation(peer.ID("unknown")); r != 1 {
+		t.Errorf("expected unknown peers to have a perfect reputation, got %f", r)
+	}
+	if c.shouldSkip(good) {
+		t.Error("didn't expect to skip the good peer")
+	}
+	if !c.shouldSkip(failing) {
+		t.Error("expected to always skip the failing peer at full sensitivity")
+	}
+
+	// a success starts to restore the failing peer's reputation.
+	c.Record(failing, true, 10*time.Millisecond)
+	if r := c.Reputation(failing); r <= 0 {
+		t.Errorf("expected the reputation to recover, got %f", r)
+	}
+
+	c.flush(time.Now().Add(time.Minute))
+	if r := c.Reputation(failing); r != 1 {
+		t.Errorf("expected flushed peers to be forgotten, got %f", r)
+	}
+}
+
+func TestPeerReputationQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 3)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	rep, err := NewPeerReputationCache(DefaultReputationConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dhts[0].reputation = rep
+	connect(t, ctx, dhts[0], dhts[1])
+	connect(t, ctx, dhts[0], dhts[2])
+
+	query := dhts[0].newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == dhts[2].self {
+			return nil, routing.ErrNotFound
+		}
+		return &dhtQueryResult{}, nil
+	})
+	if _, err := query.Run(ctx, []peer.ID{dhts[1].self, dhts[2].self}); err != routing.ErrNotFound {
+		t.Fatalf("expected not found, got %v", err)
+	}
+
+	if r := dhts[0].PeerReputation(dhts[1].self); r != 1 {
+		t.Errorf("expected a perfect reputation for the responsive peer, got %f", r)
+	}
+	if r := dhts[0].PeerReputation(dhts[2].self); r >= 1 {
+		t.Errorf("expected the failing peer's reputation to drop, got %f", r)
+	}
+}
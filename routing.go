@@ -46,6 +46,11 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 	}()
 	logger.Debugf("PutValue %s", key)
 
+	var cfg ropts.Options
+	if err := cfg.Apply(opts...); err != nil {
+		return err
+	}
+
 	// don't even allow local users to put bad values.
 	if err := dht.Validator.Validate(key, value); err != nil {
 		return err
@@ -76,11 +81,17 @@ func (dht *IpfsDHT) PutValue(ctx context.Context, key string, value []byte, opts
 		return err
 	}
 
-	pchan, err := dht.GetClosestPeers(ctx, key)
-	if err != nil {
-		return err
+	if dht.proxy != "" {
+		return dht.proxyPutValue(ctx, key, rec)
 	}
 
+	wireKey := dht.transformKey(key)
+	seeds := dht.routingTable.NearestPeers(kb.ConvertKey(wireKey), dht.alpha)
+	if len(seeds) == 0 {
+		return kb.ErrLookupFailure
+	}
+	pchan := dht.getClosestPeers(ctx, wireKey, seeds, withRoutingOptions(&cfg))
+
 	wg := sync.WaitGroup{}
 	for p := range pchan {
 		wg.Add(1)
@@ -159,7 +170,7 @@ func (dht *IpfsDHT) SearchValue(ctx context.Context, key string, opts ...ropts.O
 		responsesNeeded = getQuorum(&cfg, -1)
 	}
 
-	valCh, err := dht.getValues(ctx, key, responsesNeeded)
+	valCh, err := dht.getValues(ctx, key, responsesNeeded, withRoutingOptions(&cfg))
 	if err != nil {
 		return nil, err
 	}
@@ -270,7 +281,7 @@ func (dht *IpfsDHT) GetValues(ctx context.Context, key string, nvals int) (_ []R
 	return out, ctx.Err()
 }
 
-func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-chan RecvdVal, error) {
+func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int, options ...QueryOption) (<-chan RecvdVal, error) {
 	vals := make(chan RecvdVal, 1)
 
 	done := func(err error) (<-chan RecvdVal, error) {
@@ -302,8 +313,24 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 		return done(routing.ErrNotFound)
 	}
 
+	if dht.proxy != "" {
+		go func() {
+			val, err := dht.proxyGetValue(ctx, key)
+			if err == nil {
+				select {
+				case vals <- RecvdVal{Val: val, From: dht.proxy}:
+				case <-ctx.Done():
+					err = ctx.Err()
+				}
+			}
+			done(err)
+		}()
+		return vals, nil
+	}
+
 	// get closest peers in the routing table
-	rtp := dht.routingTable.NearestPeers(kb.ConvertKey(key), AlphaValue)
+	wireKey := dht.transformKey(key)
+	rtp := dht.routingTable.NearestPeers(kb.ConvertKey(wireKey), dht.alpha)
 	logger.Debugf("peers in rt: %d %s", len(rtp), rtp)
 	if len(rtp) == 0 {
 		logger.Warning("No peers from routing table!")
@@ -315,13 +342,13 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 
 	// setup the Query
 	parent := ctx
-	query := dht.newQuery(key, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+	query := dht.newQuery(wireKey, func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
 		notif.PublishQueryEvent(parent, &notif.QueryEvent{
 			Type: notif.SendingQuery,
 			ID:   p,
 		})
 
-		rec, peers, err := dht.getValueOrPeers(ctx, p, key)
+		rec, peers, err := dht.getValueOrPeers(ctx, p, wireKey)
 		switch err {
 		case routing.ErrNotFound:
 			// in this case, they responded with nothing,
@@ -369,7 +396,7 @@ func (dht *IpfsDHT) getValues(ctx context.Context, key string, nvals int) (<-cha
 		})
 
 		return res, nil
-	})
+	}, options...)
 
 	go func() {
 		reqCtx, cancel := context.WithTimeout(ctx, time.Minute)
@@ -455,7 +482,7 @@ func (dht *IpfsDHT) makeProvRecord(skey cid.Cid) (*pb.Message, error) {
 // FindProviders searches until the context expires.
 func (dht *IpfsDHT) FindProviders(ctx context.Context, c cid.Cid) ([]pstore.PeerInfo, error) {
 	var providers []pstore.PeerInfo
-	for p := range dht.FindProvidersAsync(ctx, c, KValue) {
+	for p := range dht.FindProvidersAsync(ctx, c, dht.bucketSize) {
 		providers = append(providers, p)
 	}
 	return providers, nil
@@ -495,6 +522,55 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 		}
 	}
 
+	// Hand the lookup off to a delegated router if one is registered for
+	// this key, merging its answers with what we found locally.
+	if router, ok := dht.delegatedRouterFor(key.KeyString()); ok {
+		delegated, err := router.FindProviders(ctx, key.KeyString())
+		if err != nil {
+			logger.Debugf("delegated provider lookup failed: %s", err)
+			return
+		}
+		for _, pi := range delegated {
+			if pi.ID != dht.self {
+				dht.peerstore.AddAddrs(pi.ID, pi.Addrs, pstore.TempAddrTTL)
+			}
+			if !ps.TryAdd(pi.ID) {
+				continue
+			}
+			select {
+			case peerOut <- pi:
+			case <-ctx.Done():
+				return
+			}
+			if ps.Size() >= count {
+				return
+			}
+		}
+		return
+	}
+
+	if dht.proxy != "" {
+		provs, err := dht.proxyFindProviders(ctx, key)
+		if err != nil {
+			logger.Debugf("proxied provider lookup failed: %s", err)
+			return
+		}
+		for _, pi := range provs {
+			if !ps.TryAdd(pi.ID) {
+				continue
+			}
+			select {
+			case peerOut <- *pi:
+			case <-ctx.Done():
+				return
+			}
+			if ps.Size() >= count {
+				return
+			}
+		}
+		return
+	}
+
 	// setup the Query
 	parent := ctx
 	query := dht.newQuery(key.KeyString(), func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
@@ -545,7 +621,7 @@ func (dht *IpfsDHT) findProvidersAsyncRoutine(ctx context.Context, key cid.Cid,
 		return &dhtQueryResult{closerPeers: clpeers}, nil
 	})
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertKey(key.KeyString()), AlphaValue)
+	peers := dht.routingTable.NearestPeers(kb.ConvertKey(key.KeyString()), dht.alpha)
 	_, err := query.Run(ctx, peers)
 	if err != nil {
 		logger.Debugf("Query error: %s", err)
@@ -581,7 +657,20 @@ func (dht *IpfsDHT) FindPeer(ctx context.Context, id peer.ID) (_ pstore.PeerInfo
 		return pi, nil
 	}
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), AlphaValue)
+	if dht.proxy != "" {
+		peers, err := dht.proxyClosestPeers(ctx, string(id))
+		if err != nil {
+			return pstore.PeerInfo{}, err
+		}
+		for _, pi := range peers {
+			if pi.ID == id && len(pi.Addrs) > 0 {
+				return *pi, nil
+			}
+		}
+		return pstore.PeerInfo{}, routing.ErrNotFound
+	}
+
+	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), dht.alpha)
 	if len(peers) == 0 {
 		return pstore.PeerInfo{}, kb.ErrLookupFailure
 	}
@@ -650,7 +739,7 @@ func (dht *IpfsDHT) FindPeersConnectedToPeer(ctx context.Context, id peer.ID) (<
 	peersSeen := make(map[peer.ID]struct{})
 	var peersSeenMx sync.Mutex
 
-	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), AlphaValue)
+	peers := dht.routingTable.NearestPeers(kb.ConvertPeerID(id), dht.alpha)
 	if len(peers) == 0 {
 		return nil, kb.ErrLookupFailure
 	}
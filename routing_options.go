@@ -1,6 +1,9 @@
 package dht
 
 import (
+	"fmt"
+	"time"
+
 	ropts "github.com/libp2p/go-libp2p-routing/options"
 )
 
@@ -22,6 +25,54 @@ func Quorum(n int) ropts.Option {
 	}
 }
 
+type concurrencyOptionKey struct{}
+
+// Concurrency is a DHT option that sets the number of peers the queries of a
+// single call contact at a time, overriding the concurrency of the DHT.
+func Concurrency(n int) ropts.Option {
+	return func(opts *ropts.Options) error {
+		if n < 1 {
+			return fmt.Errorf("concurrency must be at least 1; got %d", n)
+		}
+		setRoutingOption(opts, concurrencyOptionKey{}, n)
+		return nil
+	}
+}
+
+type peerTimeoutOptionKey struct{}
+
+// PeerTimeout is a DHT option that bounds every peer RPC the queries of a
+// single call make, overriding the per-peer timeout of the DHT. Zero removes
+// the bound.
+func PeerTimeout(d time.Duration) ropts.Option {
+	return func(opts *ropts.Options) error {
+		if d < 0 {
+			return fmt.Errorf("peer timeout must not be negative; got %s", d)
+		}
+		setRoutingOption(opts, peerTimeoutOptionKey{}, d)
+		return nil
+	}
+}
+
+func setRoutingOption(opts *ropts.Options, key, value interface{}) {
+	if opts.Other == nil {
+		opts.Other = make(map[interface{}]interface{}, 1)
+	}
+	opts.Other[key] = value
+}
+
+// withRoutingOptions applies the per-call options in opts to a query.
+func withRoutingOptions(opts *ropts.Options) QueryOption {
+	return func(q *dhtQuery) {
+		if n, ok := opts.Other[concurrencyOptionKey{}].(int); ok {
+			q.concurrency = n
+		}
+		if d, ok := opts.Other[peerTimeoutOptionKey{}].(time.Duration); ok {
+			q.perPeerTimeout = d
+		}
+	}
+}
+
 func getQuorum(opts *ropts.Options, ndefault int) int {
 	responsesNeeded, ok := opts.Other[quorumOptionKey{}].(int)
 	if !ok {
@@ -0,0 +1,56 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	ropts "github.com/libp2p/go-libp2p-routing/options"
+)
+
+func TestRoutingOptionsReachRunner(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	d.perPeerTimeout = time.Minute
+
+	for _, c := range []struct {
+		name        string
+		opts        []ropts.Option
+		concurrency int
+		timeout     time.Duration
+	}{
+		{"defaults", nil, d.alpha, time.Minute},
+		{"quorum only", []ropts.Option{Quorum(2)}, d.alpha, time.Minute},
+		{"concurrency", []ropts.Option{Concurrency(7)}, 7, time.Minute},
+		{"peer timeout", []ropts.Option{PeerTimeout(time.Second)}, d.alpha, time.Second},
+		{"no peer timeout", []ropts.Option{PeerTimeout(0)}, d.alpha, 0},
+		{"all", []ropts.Option{Concurrency(1), PeerTimeout(time.Second), Quorum(2)}, 1, time.Second},
+	} {
+		var cfg ropts.Options
+		if err := cfg.Apply(c.opts...); err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		r, err := newQueryRunner(d.newQuery("foo", nil, withRoutingOptions(&cfg)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.proc.Close()
+		if n := cap(r.rateLimit); n != c.concurrency {
+			t.Errorf("%s: expected a concurrency of %d, got %d", c.name, c.concurrency, n)
+		}
+		if to := r.query.perPeerTimeout; to != c.timeout {
+			t.Errorf("%s: expected a peer timeout of %s, got %s", c.name, c.timeout, to)
+		}
+	}
+
+	for _, opt := range []ropts.Option{Concurrency(0), PeerTimeout(-time.Second)} {
+		var cfg ropts.Options
+		if err := cfg.Apply(opt); err == nil {
+			t.Error("expected an invalid option to be rejected")
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package dht
+
+import (
+	"encoding/json"
+	"sort"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// RoutingTableSnapshot is a copy of the routing table of a DHT at some point
+// in time, for monitoring.
+type RoutingTableSnapshot struct {
+	Buckets []BucketSnapshot // the non-empty buckets, by increasing index
+}
+
+// BucketSnapshot is a copy of a k-bucket of a routing table.
+type BucketSnapshot struct {
+	// Index is the common prefix length of the IDs of the peers of the
+	// bucket and ours: the peers of bucket i are at XOR distances in
+	// [2^(255-i), 2^(256-i)) from us.
+	Index int
+	Count int
+	Peers []peer.ID
+}
+
+// Size returns the number of peers in the routing table.
+func (s RoutingTableSnapshot) Size() int {
+	n := 0
+	for _, b := range s.Buckets {
+		n += b.Count
+	}
+	return n
+}
+
+type routingTableSnapshotJSON struct {
+	Size    int                  `json:"size"`
+	Buckets []bucketSnapshotJSON `json:"buckets"`
+}
+
+type bucketSnapshotJSON struct {
+	Index int      `json:"index"`
+	Count int      `json:"count"`
+	Peers []string `json:"peers"`
+}
+
+// MarshalJSON encodes the snapshot as an object with the size of the table
+// and its buckets, every bucket an object with its index, count and peers,
+// the peers as base58 strings.
+func (s RoutingTableSnapshot) MarshalJSON() ([]byte, error) {
+	out := routingTableSnapshotJSON{Size: s.Size(), Buckets: make([]bucketSnapshotJSON, len(s.Buckets))}
+	for i, b := range s.Buckets {
+		peers := make([]string, len(b.Peers))
+		for j, p := range b.Peers {
+			peers[j] = p.Pretty()
+		}
+		out.Buckets[i] = bucketSnapshotJSON{Index: b.Index, Count: b.Count, Peers: peers}
+	}
+	return json.Marshal(out)
+}
+
+// GetRoutingTableSnapshot returns a copy of the routing table, its peers
+// grouped by k-bucket, without changing it.
+//
+// The peers are listed under the lock of the table, so the snapshot is
+// consistent. A bucket is identified by its common prefix length with our
+// ID: the last bucket of the table, which holds all the peers closer to us
+// until it's split, is reported as one bucket per common prefix length.
+func (dht *IpfsDHT) GetRoutingTableSnapshot() RoutingTableSnapshot {
+	self := kb.ConvertPeerID(dht.self)
+	byIndex := make(map[int][]peer.ID)
+	for _, p := range dht.routingTable.ListPeers() {
+		cpl := bitPrefixLen(self, kb.ConvertPeerID(p))
+		byIndex[cpl] = append(byIndex[cpl], p)
+	}
+
+	var s RoutingTableSnapshot
+	for cpl, peers := range byIndex {
+		s.Buckets = append(s.Buckets, BucketSnapshot{Index: cpl, Count: len(peers), Peers: peers})
+	}
+	sort.Slice(s.Buckets, func(i, j int) bool { return s.Buckets[i].Index < s.Buckets[j].Index })
+	return s
+}
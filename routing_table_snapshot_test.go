@@ -0,0 +1,72 @@
+package dht
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestGetRoutingTableSnapshot(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	for i := 0; i < 10; i++ {
+		d.routingTable.Update(tu.RandPeerIDFatal(t))
+	}
+
+	s := d.GetRoutingTableSnapshot()
+	if s.Size() != d.routingTable.Size() {
+		t.Fatalf("expected %d peers in the snapshot, got %d", d.routingTable.Size(), s.Size())
+	}
+	self := kb.ConvertPeerID(d.self)
+	for i, b := range s.Buckets {
+		if i > 0 && b.Index <= s.Buckets[i-1].Index {
+			t.Errorf("expected the buckets by increasing index, got %d after %d", b.Index, s.Buckets[i-1].Index)
+		}
+		if b.Count != len(b.Peers) || b.Count == 0 {
+			t.Errorf("expected bucket %d to count its %d peers, got %d", b.Index, len(b.Peers), b.Count)
+		}
+		for _, p := range b.Peers {
+			if cpl := bitPrefixLen(self, kb.ConvertPeerID(p)); cpl != b.Index {
+				t.Errorf("expected %s in bucket %d, got it in bucket %d", p, cpl, b.Index)
+			}
+		}
+	}
+
+	// the snapshot is a copy.
+	d.routingTable.Update(tu.RandPeerIDFatal(t))
+	if s.Size() == d.routingTable.Size() {
+		t.Error("expected the snapshot not to change with the routing table")
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Size    int
+		Buckets []struct {
+			Index, Count int
+			Peers        []string
+		}
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Size != s.Size() || len(decoded.Buckets) != len(s.Buckets) {
+		t.Fatalf("expected %d peers in %d buckets, got %s", s.Size(), len(s.Buckets), data)
+	}
+	for i, b := range decoded.Buckets {
+		want := s.Buckets[i]
+		if b.Index != want.Index || b.Count != want.Count || b.Peers[0] != want.Peers[0].Pretty() {
+			t.Errorf("expected bucket %+v, got %+v", want, b)
+		}
+	}
+}
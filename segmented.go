@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// SegmentedLookup looks up the K closest peers to each of segments, e.g. the
+// segments of a hierarchical key such as /namespace/collection/item, so that
+// every segment is routed to its own neighborhood of the keyspace. Like any
+// key, a segment is located by its SHA256 hash. The segments are looked up in
+// parallel, up to the SegmentConcurrency DHT option at a time.
+//
+// It returns the closest peers to each segment, closest first.
+func (dht *IpfsDHT) SegmentedLookup(ctx context.Context, segments []string) (map[string][]peer.ID, error) {
+	limit := dht.segmentConcurrency
+	if limit < 1 {
+		limit = DefaultSegmentConcurrency
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		out  = make(map[string][]peer.ID, len(segments))
+		seen = make(map[string]bool, len(segments))
+		sem  = make(chan struct{}, limit)
+	)
+loop:
+	for _, seg := range segments {
+		if seen[seg] {
+			continue
+		}
+		seen[seg] = true
+		seeds := dht.LocalClosestPeers(seg, dht.alpha)
+		if len(seeds) == 0 {
+			// the routing table is empty, no segment can be looked up.
+			wg.Wait()
+			return nil, kb.ErrLookupFailure
+		}
+
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			break loop
+		}
+		wg.Add(1)
+		go func(seg string, seeds []peer.ID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			var closest []peer.ID
+			for p := range dht.getClosestPeers(ctx, seg, seeds) {
+				closest = append(closest, p)
+			}
+			mu.Lock()
+			out[seg] = closest
+			mu.Unlock()
+		}(seg, seeds)
+	}
+	wg.Wait()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
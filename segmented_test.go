@@ -0,0 +1,64 @@
+package dht
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+func TestSegmentedLookup(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 6)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+	dhts[0].segmentConcurrency = 2
+
+	segments := []string{"/namespace", "/namespace/collection", "/namespace/collection/item", "/namespace"}
+	res, err := dhts[0].SegmentedLookup(ctx, segments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Fatalf("expected results for 3 distinct segments, got %d", len(res))
+	}
+	for _, seg := range segments {
+		// the same as looking the segments up one by one.
+		ch, err := dhts[0].GetClosestPeers(ctx, seg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var expected []peer.ID
+		for p := range ch {
+			expected = append(expected, p)
+		}
+		if len(expected) == 0 || !reflect.DeepEqual(res[seg], expected) {
+			t.Errorf("expected the closest peers to %s to be %v, got %v", seg, expected, res[seg])
+		}
+	}
+
+	empty := setupDHT(ctx, t, false)
+	defer empty.Close()
+	defer empty.host.Close()
+	if _, err := empty.SegmentedLookup(ctx, segments); err != kb.ErrLookupFailure {
+		t.Errorf("expected a lookup failure without peers, got %v", err)
+	}
+
+	cctx, ccancel := context.WithCancel(ctx)
+	ccancel()
+	if _, err := dhts[0].SegmentedLookup(cctx, segments); err != context.Canceled {
+		t.Errorf("expected the lookup to be cancelled, got %v", err)
+	}
+}
@@ -0,0 +1,134 @@
+package dht
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// SLOConfig describes a query latency objective and the bounds within which
+// an SLOEnforcer may tune the query concurrency to meet it.
+type SLOConfig struct {
+	// Percentile of query latencies that must stay below Target, e.g. 0.99.
+	Percentile float64
+	// Target is the latency objective.
+	Target time.Duration
+	// Window is the number of queries observed before each adjustment.
+	Window int
+	// Headroom is the fraction of Target below which the SLO is considered
+	// comfortably met, allowing the concurrency to be raised again.
+	Headroom float64
+	// MinAlpha and MaxAlpha bound the adjusted query concurrency.
+	MinAlpha int
+	MaxAlpha int
+}
+
+// DefaultSLOConfig is a p99 < 500ms objective over windows of 100 queries.
+var DefaultSLOConfig = SLOConfig{
+	Percentile: 0.99,
+	Target:     500 * time.Millisecond,
+	Window:     100,
+	Headroom:   0.5,
+	MinAlpha:   1,
+	MaxAlpha:   10,
+}
+
+func (c *SLOConfig) validate() error {
+	if c.Percentile <= 0 || c.Percentile > 1 {
+		return fmt.Errorf("percentile must be in (0, 1]; actual value: %f", c.Percentile)
+	}
+	if c.Target <= 0 {
+		return fmt.Errorf("target latency must be positive; actual value: %s", c.Target)
+	}
+	if c.Window <= 0 {
+		return fmt.Errorf("window must be positive; actual value: %d", c.Window)
+	}
+	if c.Headroom <= 0 || c.Headroom >= 1 {
+		return fmt.Errorf("headroom must be in (0, 1); actual value: %f", c.Headroom)
+	}
+	if c.MinAlpha <= 0 || c.MinAlpha > c.MaxAlpha {
+		return fmt.Errorf("need 0 < MinAlpha <= MaxAlpha; actual values: min=%d, max=%d", c.MinAlpha, c.MaxAlpha)
+	}
+	return nil
+}
+
+// SLOEnforcer watches the latency of the queries a DHT runs and tunes the
+// query concurrency (alpha) to keep them within an SLO: when the SLO is
+// violated alpha is lowered to reduce the work done per query, and when it is
+// comfortably met alpha is raised again to improve result quality.
+type SLOEnforcer struct {
+	cfg SLOConfig
+
+	mu      sync.Mutex
+	samples []time.Duration
+	alpha   int
+}
+
+// NewSLOEnforcer returns an SLOEnforcer for the given objective.
+func NewSLOEnforcer(cfg SLOConfig) (*SLOEnforcer, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return &SLOEnforcer{
+		cfg:     cfg,
+		samples: make([]time.Duration, 0, cfg.Window),
+		alpha:   cfg.MaxAlpha,
+	}, nil
+}
+
+// Alpha returns the query concurrency currently in effect.
+func (s *SLOEnforcer) Alpha() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.alpha
+}
+
+// setAlpha sets the starting concurrency, clamped to the configured bounds.
+func (s *SLOEnforcer) setAlpha(alpha int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.alpha = s.clamp(alpha)
+}
+
+func (s *SLOEnforcer) clamp(alpha int) int {
+	if alpha < s.cfg.MinAlpha {
+		return s.cfg.MinAlpha
+	}
+	if alpha > s.cfg.MaxAlpha {
+		return s.cfg.MaxAlpha
+	}
+	return alpha
+}
+
+// Observe records the latency of a finished query, adjusting alpha once a
+// full window of samples has been collected.
+func (s *SLOEnforcer) Observe(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.samples = append(s.samples, latency)
+	if len(s.samples) < s.cfg.Window {
+		return
+	}
+
+	sort.Slice(s.samples, func(i, j int) bool { return s.samples[i] < s.samples[j] })
+	idx := int(float64(len(s.samples))*s.cfg.Percentile+0.5) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	observed := s.samples[idx]
+	s.samples = s.samples[:0]
+
+	prev := s.alpha
+	switch {
+	case observed > s.cfg.Target:
+		s.alpha = s.clamp(s.alpha - 1)
+	case observed < time.Duration(float64(s.cfg.Target)*s.cfg.Headroom):
+		s.alpha = s.clamp(s.alpha + 1)
+	}
+	if s.alpha != prev {
+		logger.Infof("query latency p%g is %s (target %s): adjusted alpha %d => %d",
+			s.cfg.Percentile*100, observed, s.cfg.Target, prev, s.alpha)
+	}
+}
@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSLOEnforcer(t *testing.T) {
+	cfg := SLOConfig{
+		Percentile: 0.9,
+		Target:     100 * time.Millisecond,
+		Window:     10,
+		Headroom:   0.5,
+		MinAlpha:   2,
+		MaxAlpha:   4,
+	}
+	s, err := NewSLOEnforcer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.setAlpha(3)
+
+	observe := func(d time.Duration) {
+		for i := 0; i < cfg.Window; i++ {
+			s.Observe(d)
+		}
+	}
+
+	// violated: alpha drops, but never below MinAlpha.
+	observe(time.Second)
+	if a := s.Alpha(); a != 2 {
+		t.Fatalf("expected alpha to drop to 2, got %d", a)
+	}
+	observe(time.Second)
+	if a := s.Alpha(); a != 2 {
+		t.Fatalf("expected alpha to stay at the minimum, got %d", a)
+	}
+
+	// met, but without headroom: alpha stays put.
+	observe(75 * time.Millisecond)
+	if a := s.Alpha(); a != 2 {
+		t.Fatalf("expected alpha to stay at 2, got %d", a)
+	}
+
+	// comfortably met: alpha grows, but never above MaxAlpha.
+	for i := 0; i < 3; i++ {
+		observe(10 * time.Millisecond)
+	}
+	if a := s.Alpha(); a != 4 {
+		t.Fatalf("expected alpha to grow to the maximum, got %d", a)
+	}
+
+	// a partial window doesn't trigger an adjustment.
+	s.Observe(time.Second)
+	if a := s.Alpha(); a != 4 {
+		t.Fatalf("expected no adjustment before a full window, got %d", a)
+	}
+}
+
+func TestSLOConfigValidate(t *testing.T) {
+	bad := DefaultSLOConfig
+	bad.MinAlpha = bad.MaxAlpha + 1
+	if _, err := NewSLOEnforcer(bad); err == nil {
+		t.Fatal("expected MinAlpha > MaxAlpha to be rejected")
+	}
+	if _, err := NewSLOEnforcer(DefaultSLOConfig); err != nil {
+		t.Fatal(err)
+	}
+}
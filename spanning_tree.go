@@ -0,0 +1,103 @@
+package dht
+
+import (
+	"context"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	notif "github.com/libp2p/go-libp2p-routing/notifications"
+)
+
+// SpanningTree is the tree of the referrals that led a lookup to the K
+// closest peers to a key: its root is us, and the children of a peer are the
+// peers it was the first to refer the lookup to. Only the peers that
+// answered, and are among the K closest or referred the lookup toward one of
+// them, are in the tree.
+type SpanningTree struct {
+	root     peer.ID
+	children map[peer.ID][]peer.ID
+}
+
+// Root returns the root of the tree, our own ID.
+func (t *SpanningTree) Root() peer.ID {
+	return t.root
+}
+
+// Children returns the peers p referred the lookup to, in the order it
+// returned them.
+func (t *SpanningTree) Children(p peer.ID) []peer.ID {
+	return append([]peer.ID(nil), t.children[p]...)
+}
+
+// Depth returns the number of edges on the longest path from the root: the
+// most referrals it took the lookup to reach one of the closest peers.
+func (t *SpanningTree) Depth() int {
+	var depth func(p peer.ID) int
+	depth = func(p peer.ID) int {
+		d := 0
+		for _, c := range t.children[p] {
+			if cd := depth(c) + 1; cd > d {
+				d = cd
+			}
+		}
+		return d
+	}
+	return depth(t.root)
+}
+
+// SpanningTreeQuery looks up the K closest peers to key, like
+// GetClosestPeers, and returns the tree of the referrals that led to them,
+// e.g. to bootstrap a gossip overlay along them. It always runs a lookup,
+// bypassing the query cache.
+func (dht *IpfsDHT) SpanningTreeQuery(ctx context.Context, key string) (*SpanningTree, error) {
+	seeds := dht.LocalClosestPeers(key, dht.alpha)
+	if len(seeds) == 0 {
+		return nil, kb.ErrLookupFailure
+	}
+
+	// follow the referrals through the events of the lookup.
+	evctx, cancel := context.WithCancel(ctx)
+	evctx, events := notif.RegisterForQueryEvents(evctx)
+	tree := NewQueryTree()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for ev := range events {
+			tree.Add(ev)
+		}
+	}()
+
+	closest := make(map[peer.ID]bool)
+	for p := range dht.getClosestPeers(evctx, key, seeds) {
+		closest[p] = true
+	}
+	cancel()
+	<-done
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	st := &SpanningTree{root: dht.self, children: make(map[peer.ID][]peer.ID)}
+	// keep returns whether n, or any of its descendants, is one of the
+	// closest peers, recording the edges toward them.
+	var keep func(n *QueryTreeNode) bool
+	keep = func(n *QueryTreeNode) bool {
+		if n.State != "responded" {
+			return false
+		}
+		kept := closest[n.Peer]
+		for _, c := range n.Children {
+			if keep(c) {
+				st.children[n.Peer] = append(st.children[n.Peer], c.Peer)
+				kept = true
+			}
+		}
+		return kept
+	}
+	for _, n := range tree.Roots() {
+		if keep(n) {
+			st.children[st.root] = append(st.children[st.root], n.Peer)
+		}
+	}
+	return st, nil
+}
@@ -0,0 +1,90 @@
+package dht
+
+import (
+	"context"
+	"math"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// WithSpeculativeFactor makes the query hedge against slow peers, as in the
+// "hedged requests" of The Tail at Scale: it queries ceil(f * concurrency)
+// peers at a time instead of concurrency. Workers are launched in groups of
+// that size, and as soon as concurrency of the workers in a group got an
+// answer, whichever they are, the RPCs of the others are cancelled. Cancelled
+// peers don't count as failures.
+//
+// A factor of 1 or less disables speculation.
+func WithSpeculativeFactor(f float64) QueryOption {
+	return func(q *dhtQuery) {
+		q.speculative = f
+	}
+}
+
+// workers returns the number of peers the query may query at a time.
+func (q *dhtQuery) workers() int {
+	if q.speculative <= 1 {
+		return q.concurrency
+	}
+	return int(math.Ceil(q.speculative * float64(q.concurrency)))
+}
+
+// hedge is a group of speculative workers: once needed of them got an
+// answer, the others are cancelled.
+type hedge struct {
+	size     int // the number of workers in the group
+	needed   int
+	launched int
+	answered int
+	cancels  map[peer.ID]context.CancelFunc // the workers still running
+}
+
+// joinHedge adds a worker querying p to the current group of speculative
+// workers, starting a new group if it's full. It returns the context the
+// worker should query p with, and its group. The caller must call leaveHedge
+// when done. If the group already got the answers it needed, the worker is
+// one of the extra ones and isn't needed anymore: joinHedge then returns a nil
+// group, and p must not be queried.
+func (r *dhtQueryRunner) joinHedge(ctx context.Context, p peer.ID) (context.Context, *hedge) {
+	r.Lock()
+	defer r.Unlock()
+	h := r.hedge
+	if h == nil || h.launched == h.size {
+		h = &hedge{
+			size:    r.query.workers(),
+			needed:  r.query.concurrency,
+			cancels: make(map[peer.ID]context.CancelFunc),
+		}
+		r.hedge = h
+	}
+	if h.answered >= h.needed {
+		h.launched++
+		return ctx, nil
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	h.cancels[p] = cancel
+	h.launched++
+	return ctx, h
+}
+
+// leaveHedge removes the worker querying p from its group, cancelling the
+// other workers if its answer was the last one needed. It returns whether
+// the worker failed because the group had enough answers already.
+func (r *dhtQueryRunner) leaveHedge(h *hedge, p peer.ID, err error) (cancelled bool) {
+	r.Lock()
+	defer r.Unlock()
+	h.cancels[p]()
+	delete(h.cancels, p)
+
+	if err != nil {
+		return h.answered >= h.needed
+	}
+	h.answered++
+	if h.answered == h.needed {
+		for other, cancel := range h.cancels {
+			r.log.Debug("cancelling speculative query", "peer", other)
+			cancel()
+		}
+	}
+	return false
+}
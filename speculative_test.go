@@ -0,0 +1,68 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	routing "github.com/libp2p/go-libp2p-routing"
+)
+
+func TestSpeculativeQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	dhts := setupDHTS(t, ctx, 4)
+	defer func() {
+		for _, d := range dhts {
+			d.Close()
+			d.host.Close()
+		}
+	}()
+	for _, d := range dhts[1:] {
+		connect(t, ctx, dhts[0], d)
+	}
+	d, slow := dhts[0], dhts[1].self
+	seeds := []peer.ID{dhts[1].self, dhts[2].self, dhts[3].self}
+
+	// the slow peer never answers, the others have nothing closer to offer.
+	qfunc := func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		if p == slow {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &dhtQueryResult{}, nil
+	}
+
+	// without speculation, the slow peer holds the query up.
+	const timeout = 500 * time.Millisecond
+	qctx, qcancel := context.WithTimeout(ctx, timeout)
+	defer qcancel()
+	query := d.newQuery("foo", qfunc)
+	query.concurrency = 2
+	start := time.Now()
+	query.Run(qctx, seeds)
+	if elapsed := time.Since(start); elapsed < timeout {
+		t.Fatalf("expected the query to wait for the slow peer, took %s", elapsed)
+	}
+
+	// with it, the slow peer is cancelled once two others answered.
+	query = d.newQuery("foo", qfunc, WithSpeculativeFactor(1.5))
+	query.concurrency = 2
+	if w := query.workers(); w != 3 {
+		t.Fatalf("expected 3 workers, got %d", w)
+	}
+	qctx, qcancel = context.WithTimeout(ctx, 4*timeout)
+	defer qcancel()
+	res, err := query.Run(qctx, seeds)
+	if err != routing.ErrNotFound {
+		t.Fatalf("expected the query to finish without the slow peer, got %v", err)
+	}
+	if len(res.failedPeers) != 0 {
+		t.Errorf("expected cancelled peers not to count as failures, got %v", res.failedPeers)
+	}
+	if res.queriedSet.Contains(slow) {
+		t.Error("expected the slow peer not to count as queried")
+	}
+}
@@ -0,0 +1,124 @@
+package dht
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// tombstonePrefix namespaces the tombstones in the datastore.
+var tombstonePrefix = ds.NewKey("/tombstones")
+
+// Tombstone records why and when a peer was permanently banned.
+type Tombstone struct {
+	Peer   peer.ID `json:"-"`
+	Reason string
+	Time   time.Time
+}
+
+// TombstoneStore keeps track of the peers that are permanently banned from
+// our queries, e.g. Sybil nodes and protocol violators. Tombstones are
+// written through to a datastore so that, when the datastore is persistent,
+// they survive restarts; they're also kept in memory since queries check
+// them for every peer they learn about.
+type TombstoneStore struct {
+	dstore ds.Datastore
+
+	mu    sync.RWMutex
+	peers map[peer.ID]Tombstone
+}
+
+// NewTombstoneStore returns a TombstoneStore backed by dstore, loaded with
+// the tombstones already in it.
+func NewTombstoneStore(dstore ds.Datastore) (*TombstoneStore, error) {
+	res, err := dstore.Query(dsq.Query{Prefix: tombstonePrefix.String()})
+	if err != nil {
+		return nil, err
+	}
+	entries, err := res.Rest()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &TombstoneStore{
+		dstore: dstore,
+		peers:  make(map[peer.ID]Tombstone, len(entries)),
+	}
+	for _, e := range entries {
+		p, err := peer.IDB58Decode(ds.RawKey(e.Key).BaseNamespace())
+		if err != nil {
+			logger.Warningf("skipping tombstone with invalid key %s: %s", e.Key, err)
+			continue
+		}
+		var t Tombstone
+		if err := json.Unmarshal(e.Value, &t); err != nil {
+			logger.Warningf("skipping invalid tombstone of %s: %s", p, err)
+			continue
+		}
+		t.Peer = p
+		s.peers[p] = t
+	}
+	return s, nil
+}
+
+// Ban permanently bans p for the given reason.
+func (s *TombstoneStore) Ban(p peer.ID, reason string) error {
+	t := Tombstone{Peer: p, Reason: reason, Time: time.Now()}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.dstore.Put(tombstoneKey(p), b); err != nil {
+		return err
+	}
+	s.peers[p] = t
+	return nil
+}
+
+// Unban lifts the ban on p, if any.
+func (s *TombstoneStore) Unban(p peer.ID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.dstore.Delete(tombstoneKey(p)); err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	delete(s.peers, p)
+	return nil
+}
+
+// Get returns the tombstone of p, if it's banned.
+func (s *TombstoneStore) Get(p peer.ID) (Tombstone, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.peers[p]
+	return t, ok
+}
+
+// Banned returns whether p is banned.
+func (s *TombstoneStore) Banned(p peer.ID) bool {
+	_, ok := s.Get(p)
+	return ok
+}
+
+// Tombstones returns the tombstones of all the banned peers, in no
+// particular order.
+func (s *TombstoneStore) Tombstones() []Tombstone {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]Tombstone, 0, len(s.peers))
+	for _, t := range s.peers {
+		out = append(out, t)
+	}
+	return out
+}
+
+func tombstoneKey(p peer.ID) ds.Key {
+	return tombstonePrefix.ChildString(peer.IDB58Encode(p))
+}
@@ -0,0 +1,84 @@
+package dht
+
+import (
+	"context"
+	"testing"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestTombstoneStorePersists(t *testing.T) {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	s, err := NewTombstoneStore(dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sybil, violator := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	if err := s.Ban(sybil, "sybil"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Ban(violator, "protocol violation"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Unban(violator); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store over the same datastore, as after a restart.
+	s, err = NewTombstoneStore(dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, ok := s.Get(sybil)
+	if !ok {
+		t.Fatal("expected the ban to survive a restart")
+	}
+	if ts.Peer != sybil || ts.Reason != "sybil" || ts.Time.IsZero() {
+		t.Errorf("unexpected tombstone: %+v", ts)
+	}
+	if s.Banned(violator) {
+		t.Error("expected the lifted ban to stay lifted")
+	}
+	if n := len(s.Tombstones()); n != 1 {
+		t.Errorf("expected 1 tombstone, got %d", n)
+	}
+}
+
+func TestQuerySkipsBannedPeers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	s, err := NewTombstoneStore(ds.NewMapDatastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.tombstones = s
+	banned, other := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	if err := s.Ban(banned, "sybil"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := newQueryRunner(d.newQuery("foo", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	// keep the counter from reaching zero as the fake peers fail to dial.
+	r.peersRemaining.Increment(1)
+
+	r.addPeerToQuery(banned)
+	r.addPeerToQuery(other)
+	if r.peersSeen.Contains(banned) {
+		t.Error("expected the banned peer to be skipped")
+	}
+	if !r.peersSeen.Contains(other) {
+		t.Error("expected the other peer to be queried")
+	}
+}
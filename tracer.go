@@ -0,0 +1,73 @@
+package dht
+
+import (
+	"fmt"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// QueryTracer is notified of the major steps every DHT query goes through.
+// Implementations must be safe for concurrent use and should return quickly,
+// as they are called synchronously from the query workers.
+type QueryTracer interface {
+	// QueryStarted is called when a query for key begins.
+	QueryStarted(key string)
+	// PeerAdded is called when p is added to the set of peers to query.
+	PeerAdded(key string, p peer.ID)
+	// PeerDialed is called when we successfully connect to p.
+	PeerDialed(key string, p peer.ID)
+	// PeerQueried is called when p successfully answered the query.
+	PeerQueried(key string, p peer.ID)
+	// PeerFailed is called when dialing or querying p failed.
+	PeerFailed(key string, p peer.ID, err error)
+	// QueryFinished is called when the query for key terminates, with the
+	// error it terminated with, if any.
+	QueryFinished(key string, err error)
+}
+
+// NoopTracer is a QueryTracer that ignores everything. It is the default.
+type NoopTracer struct{}
+
+func (NoopTracer) QueryStarted(string)               {}
+func (NoopTracer) PeerAdded(string, peer.ID)         {}
+func (NoopTracer) PeerDialed(string, peer.ID)        {}
+func (NoopTracer) PeerQueried(string, peer.ID)       {}
+func (NoopTracer) PeerFailed(string, peer.ID, error) {}
+func (NoopTracer) QueryFinished(string, error)       {}
+
+// LoggingTracer is a QueryTracer that writes a structured debug log line for
+// every event.
+type LoggingTracer struct{}
+
+func (LoggingTracer) QueryStarted(key string) {
+	logger.Debugf("query event=started key=%s", tracedKey(key))
+}
+
+func (LoggingTracer) PeerAdded(key string, p peer.ID) {
+	logger.Debugf("query event=peer_added key=%s peer=%s", tracedKey(key), p)
+}
+
+func (LoggingTracer) PeerDialed(key string, p peer.ID) {
+	logger.Debugf("query event=peer_dialed key=%s peer=%s", tracedKey(key), p)
+}
+
+func (LoggingTracer) PeerQueried(key string, p peer.ID) {
+	logger.Debugf("query event=peer_queried key=%s peer=%s", tracedKey(key), p)
+}
+
+func (LoggingTracer) PeerFailed(key string, p peer.ID, err error) {
+	logger.Debugf("query event=peer_failed key=%s peer=%s err=%q", tracedKey(key), p, err)
+}
+
+func (LoggingTracer) QueryFinished(key string, err error) {
+	logger.Debugf("query event=finished key=%s err=%v", tracedKey(key), err)
+}
+
+// tracedKey formats key for logging without complaining about keys that
+// aren't CIDs; query keys are frequently raw peer IDs.
+func tracedKey(key string) string {
+	if k, err := tryFormatLoggableKey(key); err == nil {
+		return k
+	}
+	return fmt.Sprintf("%x", key)
+}
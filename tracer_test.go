@@ -0,0 +1,112 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	opts "github.com/libp2p/go-libp2p-kad-dht/opts"
+	peer "github.com/libp2p/go-libp2p-peer"
+	swarmt "github.com/libp2p/go-libp2p-swarm/testing"
+	bhost "github.com/libp2p/go-libp2p/p2p/host/basic"
+)
+
+type recordingTracer struct {
+	mu     sync.Mutex
+	events map[string]int
+}
+
+func newRecordingTracer() *recordingTracer {
+	return &recordingTracer{events: make(map[string]int)}
+}
+
+func (t *recordingTracer) record(ev string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events[ev]++
+}
+
+func (t *recordingTracer) count(ev string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.events[ev]
+}
+
+func (t *recordingTracer) QueryStarted(string)                     { t.record("started") }
+func (t *recordingTracer) PeerAdded(_ string, p peer.ID)           { t.record("added") }
+func (t *recordingTracer) PeerDialed(_ string, p peer.ID)          { t.record("dialed") }
+func (t *recordingTracer) PeerQueried(_ string, p peer.ID)         { t.record("queried") }
+func (t *recordingTracer) PeerFailed(_ string, p peer.ID, _ error) { t.record("failed") }
+func (t *recordingTracer) QueryFinished(string, error)             { t.record("finished") }
+
+func TestQueryTracer(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tracer := newRecordingTracer()
+	d, err := New(
+		ctx,
+		bhost.New(swarmt.GenSwarm(t, ctx, swarmt.OptDisableReuseport)),
+		WithQueryTracer(tracer),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	defer d.host.Close()
+
+	others := setupDHTS(t, ctx, 4)
+	for _, o := range others {
+		defer o.Close()
+		defer o.host.Close()
+	}
+	connect(t, ctx, d, others[0])
+	for i := 1; i < len(others); i++ {
+		connect(t, ctx, others[0], others[i])
+	}
+
+	peers, err := d.GetClosestPeers(ctx, "foo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range peers {
+	}
+
+	if n := tracer.count("started"); n != 1 {
+		t.Fatalf("expected one started event, got %d", n)
+	}
+	if n := tracer.count("finished"); n != 1 {
+		t.Fatalf("expected one finished event, got %d", n)
+	}
+	if tracer.count("added") < len(others) {
+		t.Fatalf("expected all %d peers to be added, got %d", len(others), tracer.count("added"))
+	}
+	if tracer.count("queried") == 0 {
+		t.Fatal("expected at least one peer to be queried")
+	}
+	if tracer.count("dialed") == 0 {
+		t.Fatal("expected the peers we weren't connected to to be dialed")
+	}
+}
+
+func TestQueryTracerDefault(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	if _, ok := d.tracer.(NoopTracer); !ok {
+		t.Fatalf("expected the default tracer to be a NoopTracer, got %T", d.tracer)
+	}
+
+	var o opts.Options
+	if err := o.Apply(WithQueryTracer(LoggingTracer{})); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := o.Other[queryTracerOptionKey{}].(LoggingTracer); !ok {
+		t.Fatal("expected WithQueryTracer to record the tracer")
+	}
+}
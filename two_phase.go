@@ -0,0 +1,52 @@
+package dht
+
+import (
+	"context"
+	"sync"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// PeerResult is the answer of a peer to the request of a TwoPhaseQuery.
+type PeerResult struct {
+	Peer peer.ID
+	Resp *pb.Message // nil if Err is set
+	Err  error
+}
+
+// TwoPhaseQuery separates finding the peers that should hold key from
+// asking them for it: it looks up the K closest peers to key, then sends req
+// to all of them at once, and returns their answers as they arrive. The
+// channel is closed once every peer answered or failed, or ctx is done.
+//
+// Unlike a regular query, whose workers ask every peer they come across in
+// turn, the peers of the second phase are all queried in parallel, which
+// suits requests where the first good answer is enough, e.g. GET_VALUE for
+// a record that isn't updated. req is sent as is, its key is the caller's
+// to transform if the DHT has a KeyTransform.
+func (dht *IpfsDHT) TwoPhaseQuery(ctx context.Context, key string, req *pb.Message) (<-chan PeerResult, error) {
+	closest, err := dht.GetClosestPeers(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan PeerResult, dht.bucketSize)
+	go func() {
+		defer close(out)
+		var wg sync.WaitGroup
+		for p := range closest {
+			wg.Add(1)
+			go func(p peer.ID) {
+				defer wg.Done()
+				resp, err := dht.sendRequest(ctx, p, req)
+				select {
+				case out <- PeerResult{Peer: p, Resp: resp, Err: err}:
+				case <-ctx.Done():
+				}
+			}(p)
+		}
+		wg.Wait()
+	}()
+	return out, nil
+}
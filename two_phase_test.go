@@ -0,0 +1,51 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pb "github.com/libp2p/go-libp2p-kad-dht/pb"
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	recpb "github.com/libp2p/go-libp2p-record/pb"
+)
+
+func TestTwoPhaseQuery(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	d := NewMockDHT(7, 200)
+	defer d.Close()
+	defer d.host.Close()
+
+	// only the closest virtual node holds the record.
+	const key = "/v/hello"
+	var all []peer.ID
+	for p := range d.sim.nodes {
+		all = append(all, p)
+	}
+	holder := kb.SortClosestPeers(all, kb.ConvertKey(key))[0]
+	d.sim.nodes[holder].records[key] = &recpb.Record{Key: []byte(key), Value: []byte("world")}
+
+	ch, err := d.TwoPhaseQuery(ctx, key, pb.NewMessage(pb.Message_GET_VALUE, []byte(key), 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	answered := make(map[peer.ID]bool)
+	for res := range ch {
+		if res.Err != nil {
+			t.Fatalf("unexpected error from %s: %s", res.Peer, res.Err)
+		}
+		if answered[res.Peer] {
+			t.Errorf("expected a single answer from %s", res.Peer)
+		}
+		answered[res.Peer] = true
+		if found := res.Resp.GetRecord() != nil; found != (res.Peer == holder) {
+			t.Errorf("expected only %s to hold the record, %s answered %v", holder, res.Peer, res.Resp)
+		}
+	}
+	if len(answered) != d.bucketSize || !answered[holder] {
+		t.Errorf("expected the %d closest peers to answer, holder included, got %d", d.bucketSize, len(answered))
+	}
+}
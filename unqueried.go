@@ -0,0 +1,96 @@
+package dht
+
+import (
+	"fmt"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+)
+
+// SkipReason tells why a query didn't query a peer it knew of.
+type SkipReason int
+
+const (
+	// SkipFiltered peers were never added to the query: they were banned,
+	// had a poor reputation, were farther from the key than us or were
+	// rejected by a peer filter.
+	SkipFiltered SkipReason = iota + 1
+	// SkipNoAddrs peers were added, but we knew no addresses to dial them on.
+	SkipNoAddrs
+	// SkipDialFailed peers were added, but couldn't be dialed.
+	SkipDialFailed
+	// SkipNotReached peers were added, but the query ended before it got to
+	// them.
+	SkipNotReached
+	// SkipStale peers were added, but K closer peers had answered by the
+	// time they got their turn, see WithStaleDialPruning.
+	SkipStale
+)
+
+func (r SkipReason) String() string {
+	switch r {
+	case SkipFiltered:
+		return "filtered"
+	case SkipNoAddrs:
+		return "no addresses"
+	case SkipDialFailed:
+		return "dial failed"
+	case SkipNotReached:
+		return "not reached"
+	case SkipStale:
+		return "stale"
+	default:
+		return fmt.Sprintf("SkipReason(%d)", int(r))
+	}
+}
+
+// UnqueriedPeer is a peer among the closest ones to the key a query knew of,
+// that it didn't query.
+type UnqueriedPeer struct {
+	Peer   peer.ID
+	Reason SkipReason
+}
+
+// skip records why p won't be queried. The caller must not hold the lock.
+func (r *dhtQueryRunner) skip(p peer.ID, reason SkipReason) {
+	r.Lock()
+	r.skipped[p] = reason
+	r.Unlock()
+}
+
+// skipFiltered records that next was filtered out of the query, unless it was
+// added to it before. The caller must not hold the lock.
+func (r *dhtQueryRunner) skipFiltered(next peer.ID) {
+	if !r.peersSeen.Contains(next) {
+		r.skip(next, SkipFiltered)
+	}
+}
+
+// unqueriedClosest returns the peers among the K closest to the key the query
+// knew of that it didn't query, closest first. The caller must hold the lock.
+func (r *dhtQueryRunner) unqueriedClosest() []UnqueriedPeer {
+	known := r.peersSeen.Peers()
+	for p := range r.skipped {
+		if !r.peersSeen.Contains(p) {
+			known = append(known, p)
+		}
+	}
+	closest := kb.SortClosestPeers(known, r.query.convertedKey)
+	if len(closest) > r.query.kValue {
+		closest = closest[:r.query.kValue]
+	}
+
+	var out []UnqueriedPeer
+	for _, p := range closest {
+		if r.peersQueried.Contains(p) {
+			continue
+		}
+		reason, ok := r.skipped[p]
+		if !ok {
+			// added, but never dialed.
+			reason = SkipNotReached
+		}
+		out = append(out, UnqueriedPeer{Peer: p, Reason: reason})
+	}
+	return out
+}
@@ -0,0 +1,105 @@
+package dht
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	routing "github.com/libp2p/go-libp2p-routing"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+func TestQueryUnqueriedClosest(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	ts, err := NewTombstoneStore(ds.NewMapDatastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.tombstones = ts
+
+	// fake peers: the seed returns one peer of each kind, and the query
+	// ends as soon as the answering one answers.
+	seed, answering, undialable, noAddrs, hanging, banned := tu.RandPeerIDFatal(t),
+		tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t),
+		tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	if err := ts.Ban(banned, "sybil"); err != nil {
+		t.Fatal(err)
+	}
+	addr := ma.StringCast("/ip4/127.0.0.1/tcp/1")
+	for _, p := range []peer.ID{seed, answering, undialable, hanging, banned} {
+		d.peerstore.AddAddr(p, addr, pstore.PermanentAddrTTL)
+	}
+
+	var (
+		mu      sync.Mutex
+		queried = make(map[peer.ID]bool)
+	)
+	query := d.newQuery("foo", func(ctx context.Context, p peer.ID) (*dhtQueryResult, error) {
+		mu.Lock()
+		queried[p] = true
+		mu.Unlock()
+		if p == seed {
+			res := &dhtQueryResult{}
+			for _, next := range []peer.ID{answering, undialable, noAddrs, hanging, banned} {
+				res.closerPeers = append(res.closerPeers, &pstore.PeerInfo{ID: next})
+			}
+			return res, nil
+		}
+		return &dhtQueryResult{success: true}, nil
+	}, WithIPv4Only(), WithDialFunc(func(ctx context.Context, pi pstore.PeerInfo) error {
+		switch pi.ID {
+		case undialable:
+			return routing.ErrNotFound
+		case hanging:
+			<-ctx.Done()
+			return ctx.Err()
+		}
+		return nil
+	}))
+	res, err := query.Run(ctx, []peer.ID{seed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[peer.ID]SkipReason{
+		undialable: SkipDialFailed,
+		noAddrs:    SkipNoAddrs,
+		hanging:    SkipNotReached,
+		banned:     SkipFiltered,
+	}
+	got := make(map[peer.ID]SkipReason)
+	for _, u := range res.UnqueriedClosest() {
+		if _, ok := got[u.Peer]; ok {
+			t.Errorf("expected a single reason for %s", u.Peer)
+		}
+		got[u.Peer] = u.Reason
+	}
+	for p, reason := range want {
+		if got[p] != reason {
+			t.Errorf("expected %s to be skipped as %s, got %s", p, reason, got[p])
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("expected %d unqueried peers, got %v", len(want), got)
+	}
+
+	// every peer is either queried or skipped for some reason.
+	mu.Lock()
+	defer mu.Unlock()
+	for _, p := range []peer.ID{seed, answering, undialable, noAddrs, hanging, banned} {
+		if _, skipped := got[p]; queried[p] == skipped {
+			t.Errorf("expected %s to be either queried or skipped, got queried=%v skipped=%v", p, queried[p], skipped)
+		}
+	}
+}
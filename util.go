@@ -2,17 +2,57 @@ package dht
 
 import (
 	"sync"
+	"time"
+
+	pstore "github.com/libp2p/go-libp2p-peerstore"
 )
 
 // Pool size is the number of nodes used for group find/set RPC calls
 var PoolSize = 6
 
 // K is the maximum number of requests to perform before returning failure.
+//
+// Deprecated: this is only the default; use the KValue DHT option to
+// configure individual DHTs.
 var KValue = 20
 
 // Alpha is the concurrency factor for asynchronous requests.
+//
+// Deprecated: this is only the default; use the AlphaValue DHT option to
+// configure individual DHTs.
 var AlphaValue = 3
 
+// DefaultVerifiedAddrTTL is how long the addresses of the peers that answered
+// a query are kept, unless configured otherwise with the VerifiedAddrTTL DHT
+// option.
+var DefaultVerifiedAddrTTL = pstore.RecentlyConnectedAddrTTL
+
+// DefaultSegmentConcurrency is how many segments SegmentedLookup looks up at a
+// time, unless configured otherwise with the SegmentConcurrency DHT option.
+var DefaultSegmentConcurrency = 4
+
+// DefaultMaxRPCsPerPeer is how many RPCs queries send to the same peer at a
+// time, unless configured otherwise with the MaxRPCsPerPeer DHT option.
+var DefaultMaxRPCsPerPeer = 3
+
+// DefaultDialBackoffBase, DefaultDialBackoffMax and DefaultDialBackoffSize
+// are suitable values for the DialBackoff DHT option, which DHTs have no dial
+// backoff without.
+var (
+	DefaultDialBackoffBase = 5 * time.Second
+	DefaultDialBackoffMax  = 5 * time.Minute
+	DefaultDialBackoffSize = 1000
+)
+
+// DefaultDialTimeout is how long queries wait for a dial to complete, unless
+// configured otherwise with the DialTimeout DHT option.
+var DefaultDialTimeout = 10 * time.Second
+
+// DefaultAutoRefreshInterval is how often DHTs check whether their routing
+// table shrank too much, unless configured otherwise with the AutoRefresh DHT
+// option.
+var DefaultAutoRefreshInterval = 5 * time.Minute
+
 // A counter for incrementing a variable across multiple threads
 type counter struct {
 	n   int
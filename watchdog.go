@@ -0,0 +1,69 @@
+package dht
+
+import (
+	"fmt"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+)
+
+// DefaultWatchdogTimeout is how long a query may run before it's reported as
+// slow, unless configured otherwise with WithWatchdogTimeout.
+var DefaultWatchdogTimeout = 30 * time.Second
+
+// WithWatchdogTimeout makes the query log a warning with its progress so far
+// if it's still running after d. It doesn't interrupt the query. A duration
+// of zero disables the warning.
+//
+// Defaults to DefaultWatchdogTimeout.
+func WithWatchdogTimeout(d time.Duration) QueryOption {
+	return func(q *dhtQuery) {
+		q.watchdogTimeout = d
+	}
+}
+
+// slowQueryReport is the progress of a query the watchdog reports.
+type slowQueryReport struct {
+	elapsed time.Duration
+	seen    int
+	queried int
+	failed  int
+	// the common prefix length of the key and the closest peer found yet,
+	// i.e. the number of leading zero bits of their XOR distance, or -1 if
+	// no peer was found.
+	closestCpl int
+}
+
+func (s *slowQueryReport) String() string {
+	return fmt.Sprintf("elapsed=%s seen=%d queried=%d failed=%d closest_cpl=%d",
+		s.elapsed, s.seen, s.queried, s.failed, s.closestCpl)
+}
+
+// startWatchdog starts the watchdog of the query, if it has one, and returns
+// a function that stops it.
+func (r *dhtQueryRunner) startWatchdog(start time.Time) (stop func()) {
+	d := r.query.watchdogTimeout
+	if d <= 0 {
+		return func() {}
+	}
+	t := time.AfterFunc(d, func() {
+		r.log.Warn("slow query", "key", loggableKey(r.query.key)["key"], "progress", r.slowQueryReport(start))
+	})
+	return func() { t.Stop() }
+}
+
+func (r *dhtQueryRunner) slowQueryReport(start time.Time) *slowQueryReport {
+	r.RLock()
+	defer r.RUnlock()
+	s := &slowQueryReport{
+		elapsed:    time.Since(start),
+		seen:       r.peersSeen.Size(),
+		queried:    r.peersQueried.Size(),
+		failed:     len(r.peerErrors),
+		closestCpl: -1,
+	}
+	if r.closest != "" {
+		s.closestCpl = bitPrefixLen(kb.ConvertPeerID(r.closest), r.query.convertedKey)
+	}
+	return s
+}
@@ -0,0 +1,50 @@
+package dht
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kb "github.com/libp2p/go-libp2p-kbucket"
+	peer "github.com/libp2p/go-libp2p-peer"
+	tu "github.com/libp2p/go-testutil"
+)
+
+func TestSlowQueryReport(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+
+	const key = "foo"
+	r, err := newQueryRunner(d.newQuery(key, nil, WithWatchdogTimeout(time.Hour)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	// keep the counter from reaching zero as the fake peers fail to dial.
+	r.peersRemaining.Increment(1)
+
+	start := time.Now()
+	if s := r.slowQueryReport(start); s.seen != 0 || s.closestCpl != -1 {
+		t.Fatalf("expected an empty report before any peer was added, got %s", s)
+	}
+
+	a, b := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	r.addPeerToQuery(a)
+	r.addPeerToQuery(b)
+	closest := kb.SortClosestPeers([]peer.ID{a, b}, kb.ConvertKey(key))[0]
+	s := r.slowQueryReport(start)
+	if s.seen != 2 {
+		t.Errorf("expected 2 peers seen, got %d", s.seen)
+	}
+	if cpl := bitPrefixLen(kb.ConvertPeerID(closest), kb.ConvertKey(key)); s.closestCpl != cpl {
+		t.Errorf("expected the closest peer to share %d bits with the key, got %d", cpl, s.closestCpl)
+	}
+	if s.elapsed <= 0 {
+		t.Error("expected the report to tell how long the query ran")
+	}
+}
@@ -0,0 +1,48 @@
+package dht
+
+import (
+	"context"
+	"strings"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+// WebRTCSignalingDialer prepares WebRTC connections, as browser nodes need,
+// through a signaling server. Queries call it before dialing a peer that
+// only has WebRTC addresses, so that the WebRTC transport of the host can
+// then connect to it.
+type WebRTCSignalingDialer interface {
+	// Signal exchanges the session descriptions needed to connect to p on
+	// one of addrs through the signaling server.
+	Signal(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) error
+}
+
+// signalWebRTC signals a WebRTC connection to p, if we have a signaling
+// dialer and WebRTC is the only way to reach p.
+func (dht *IpfsDHT) signalWebRTC(ctx context.Context, p peer.ID) error {
+	if dht.webrtc == nil {
+		return nil
+	}
+	addrs := dht.peerstore.Addrs(p)
+	if len(addrs) == 0 {
+		return nil
+	}
+	for _, a := range addrs {
+		if !isWebRTCAddr(a) {
+			return nil
+		}
+	}
+	return dht.webrtc.Signal(ctx, p, addrs)
+}
+
+// isWebRTCAddr returns whether a is a WebRTC address, e.g. a
+// p2p-webrtc-direct or p2p-webrtc-star one.
+func isWebRTCAddr(a ma.Multiaddr) bool {
+	for _, p := range a.Protocols() {
+		if strings.HasPrefix(p.Name, "p2p-webrtc") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	peer "github.com/libp2p/go-libp2p-peer"
+	pstore "github.com/libp2p/go-libp2p-peerstore"
+	tu "github.com/libp2p/go-testutil"
+	ma "github.com/multiformats/go-multiaddr"
+)
+
+type fakeSignaler struct {
+	signaled []peer.ID
+}
+
+var errSignaled = errors.New("signaled")
+
+func (s *fakeSignaler) Signal(ctx context.Context, p peer.ID, addrs []ma.Multiaddr) error {
+	s.signaled = append(s.signaled, p)
+	return errSignaled
+}
+
+func TestWebRTCSignaling(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	d := setupDHT(ctx, t, false)
+	defer d.Close()
+	defer d.host.Close()
+	s := &fakeSignaler{}
+	d.webrtc = s
+
+	webrtc, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/9090/http/p2p-webrtc-direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tcp, err := ma.NewMultiaddr("/ip4/127.0.0.1/tcp/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	browser, mixed := tu.RandPeerIDFatal(t), tu.RandPeerIDFatal(t)
+	d.peerstore.AddAddr(browser, webrtc, pstore.TempAddrTTL)
+	d.peerstore.AddAddrs(mixed, []ma.Multiaddr{webrtc, tcp}, pstore.TempAddrTTL)
+
+	r, err := newQueryRunner(d.newQuery("foo", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.proc.Close()
+	r.runCtx = ctx
+	r.peersRemaining.Increment(2)
+
+	if err := r.dialPeer(ctx, browser); err != errSignaled {
+		t.Errorf("expected the dial of a WebRTC-only peer to go through the signaler, got %v", err)
+	}
+	if err := r.dialPeer(ctx, mixed); err == nil || err == errSignaled {
+		t.Errorf("expected a peer with other addresses to be dialed directly, got %v", err)
+	}
+	if len(s.signaled) != 1 || s.signaled[0] != browser {
+		t.Errorf("expected only the WebRTC-only peer to be signaled, got %v", s.signaled)
+	}
+}